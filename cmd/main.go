@@ -2,64 +2,393 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
 
+	"github.com/mirkoschicchi/TFTP/internal/app/admin"
+	"github.com/mirkoschicchi/TFTP/internal/app/audit"
 	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
 	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/metrics"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/progress"
 	"github.com/mirkoschicchi/TFTP/internal/app/server"
+	"github.com/mirkoschicchi/TFTP/internal/app/shell"
+	"github.com/mirkoschicchi/TFTP/internal/app/trace"
 )
 
-var (
-	isServer      *bool
-	isClient      *bool
-	remoteAddress *string
-	readArg       *string
-	writeArg      *string
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+
+	// stdio is the file name standing for the standard input or output
+	stdio = "-"
 )
 
-func init() {
-	isServer = flag.Bool("server", false, "Set this to true to spawn a TFTP server")
-	isClient = flag.Bool("client", false, "Set this to true to spawn a TFTP client")
-	remoteAddress = flag.String("remote", "127.0.0.1:69", "The address of the TFTP server")
-	readArg = flag.String("read", "", "The path to the file that client wants to read from server")
-	writeArg = flag.String("write", "", "The path to the file that client wants to write to server")
+const usage = `usage: tftp [-log-level level] [-log-format json|console] <command> [arguments]
+
+commands:
+  serve [-config file]     run a TFTP server, see "tftp serve -h"
+  get <remote> [local]     download a file from the server
+  put <local> [remote]     upload a file to the server
+  shell [host[:port]]      start the interactive client
+
+Use "-" as local file to read from stdin or write to stdout.
+Run "tftp <command> -h" for the flags of each command.
+`
 
+// usageError is returned when the command line is not valid
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
 }
 
 func main() {
-	flag.Parse()
-	if (!*isServer && !*isClient) || (*isServer && *isClient) {
-		panic("You have to specify if you want to run a server or a client!")
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	globalFlags := flag.NewFlagSet("tftp", flag.ContinueOnError)
+	globalFlags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	logLevel := globalFlags.String("log-level", "info", "The minimum level of the logged messages: debug, info, warn or error")
+	logFormat := globalFlags.String("log-format", logger.FormatJSON, "The format of the logged messages: json or console")
+	if err := globalFlags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
 	}
+	args = globalFlags.Args()
 
-	if *isServer {
-		logger.Info("Starting the server and listening for incoming connections")
-		s := server.NewServer()
-		err := s.Listen()
-		if err != nil {
-			logger.Fatal("The server has failed during listening: %+v", err)
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+	if err := logger.Configure(*logLevel, *logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "tftp: %v\n", err)
+		return exitUsage
+	}
+
+	var err error
+	switch args[0] {
+	case "serve":
+		err = serve(args[1:])
+	case "get":
+		err = get(args[1:])
+	case "put":
+		err = put(args[1:])
+	case "shell":
+		err = runShell(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return exitOK
+	default:
+		err = usageError{fmt.Sprintf("unknown command %q", args[0])}
+	}
+
+	switch err := err.(type) {
+	case nil:
+		return exitOK
+	case usageError:
+		if err.message != "" {
+			fmt.Fprintf(os.Stderr, "tftp: %s\n\n%s", err.message, usage)
+		}
+		return exitUsage
+	default:
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		fmt.Fprintf(os.Stderr, "tftp: %v\n", err)
+		return exitFailure
+	}
+}
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	configPath := flags.String("config", "", "The YAML configuration file of the server, reloaded on SIGHUP")
+	metricsAddress := flags.String("metrics", "", "The HTTP address exposing the /metrics endpoint, overriding the configuration")
+	adminAddress := flags.String("admin", "", "The local HTTP address of the admin API, overriding the configuration")
+	auditPath := flags.String("audit", "", "The file receiving the audit log of the transfers, overriding the configuration")
+	traceText, pcapPath := traceFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return parseError(err)
+	}
+	if flags.NArg() != 0 {
+		return usageError{"serve does not accept arguments"}
+	}
+
+	var cfg *config.Config
+	if *configPath != "" {
+		var err error
+		if cfg, err = config.Load(*configPath); err != nil {
+			return err
+		}
+		// The server logs with a copy of the default logger, which must
+		// have the format of the configuration first
+		if cfg.Logging.Format != "" {
+			if err := logger.SetFormat(cfg.Logging.Format); err != nil {
+				return err
+			}
 		}
-	} else if *isClient {
-		if (*readArg == "" && *writeArg == "") || (*readArg != "" && *writeArg != "") {
-			panic("You have to specify the path of a file that either you want to read or write to the server!")
+	}
+
+	s := server.NewServer()
+	tracer, err := newTracer(*traceText, *pcapPath)
+	if err != nil {
+		return err
+	}
+	s.Tracer = tracer
+	if cfg != nil {
+		if err := s.SetConfig(cfg); err != nil {
+			return err
 		}
-		logger.Info("Starting the client and connecting to the server")
-		var client client.Client = client.NewClient()
+		s.ConfigPath = *configPath
+	}
+
+	if *metricsAddress == "" {
+		*metricsAddress = s.Config().Metrics.Listen
+	}
+	if *metricsAddress != "" {
+		s.Metrics = metrics.NewMetrics()
+		go func() {
+			s.Logger.Info("Exposing metrics on http://%s/metrics", *metricsAddress)
+			if err := s.Metrics.Serve(*metricsAddress); err != nil {
+				s.Logger.Error("The metrics endpoint has failed: %v", err)
+			}
+		}()
+	}
 
-		remoteAddr, err := net.ResolveUDPAddr("udp4", *remoteAddress)
+	if *adminAddress == "" {
+		*adminAddress = s.Config().Admin.Listen
+	}
+	if *adminAddress != "" {
+		go func() {
+			s.Logger.Info("Exposing the admin API on http://%s/sessions", *adminAddress)
+			if err := admin.Serve(*adminAddress, s); err != nil {
+				s.Logger.Error("The admin API has failed: %v", err)
+			}
+		}()
+	}
+
+	auditConfig := s.Config().Audit
+	if *auditPath == "" {
+		*auditPath = auditConfig.Path
+	}
+	if *auditPath != "" {
+		auditLog, err := audit.Open(*auditPath, int64(auditConfig.MaxSizeMB)<<20, auditConfig.MaxBackups)
 		if err != nil {
-			logger.Fatal("Error encountered while resolving remote addr: %+v", err)
+			return err
 		}
+		defer auditLog.Close()
+		s.Audit = auditLog
+		s.Logger.Info("Writing the audit log of the transfers to %s", *auditPath)
+	}
+
+	s.Logger.Info("Starting the server and listening for incoming connections")
+	if err := s.Listen(); err != nil {
+		return fmt.Errorf("the server has failed during listening: %v", err)
+	}
+
+	return nil
+}
 
-		if *readArg != "" {
-			err = client.RequestFile(remoteAddr, *readArg)
-		} else if *writeArg != "" {
-			err = client.WriteFile(remoteAddr, *writeArg)
+// clientFlags registers the flags shared by get and put
+func clientFlags(flags *flag.FlagSet) (*string, func() (*client.Client, error)) {
+	remoteAddress := flags.String("remote", "127.0.0.1:69", "The address of the TFTP server")
+	mode := flags.String("mode", string(packets.Netascii), "The transfer mode, either netascii or octet")
+	blockSize := flags.Int("blksize", packets.DefaultBlockSize, "The block size proposed to the server")
+	timeout := flags.Duration("timeout", 5*time.Second, "How long to wait for a packet from the server")
+	bandwidth := flags.Int64("bandwidth", 0, "The number of bytes per second sent or received, 0 for unlimited")
+	traceText, pcapPath := traceFlags(flags)
+
+	newClient := func() (*client.Client, error) {
+		c := client.NewClient()
+		switch packets.Mode(*mode) {
+		case packets.Netascii, packets.Octet:
+			c.Mode = packets.Mode(*mode)
+		default:
+			return nil, usageError{fmt.Sprintf("unknown mode %q", *mode)}
+		}
+		if *blockSize < 8 || *blockSize > 65464 {
+			return nil, usageError{fmt.Sprintf("invalid block size %d, it must be between 8 and 65464", *blockSize)}
+		}
+		c.BlockSize = *blockSize
+		c.Timeout = *timeout
+		if *bandwidth < 0 {
+			return nil, usageError{fmt.Sprintf("invalid bandwidth %d, it must not be negative", *bandwidth)}
 		}
+		c.Bandwidth = *bandwidth
+		tracer, err := newTracer(*traceText, *pcapPath)
 		if err != nil {
-			// logger.Fatal("Cannot connect to server: %+v", err)
+			return nil, err
 		}
+		c.Tracer = tracer
+		return &c, nil
+	}
+
+	return remoteAddress, newClient
+}
+
+// traceFlags registers the flags enabling the packet trace
+func traceFlags(flags *flag.FlagSet) (*bool, *string) {
+	traceText := flags.Bool("trace", false, "Print every packet sent or received to stderr")
+	pcapPath := flags.String("pcap", "", "Write every packet sent or received to a pcap file")
+
+	return traceText, pcapPath
+}
+
+// newTracer returns the tracer configured by the trace flags, or nil if
+// tracing is disabled. The pcap file stays open until the program exits
+func newTracer(traceText bool, pcapPath string) (*trace.Tracer, error) {
+	if !traceText && pcapPath == "" {
+		return nil, nil
+	}
+
+	var tracer *trace.Tracer
+	if traceText {
+		tracer = trace.NewTracer(os.Stderr)
+	} else {
+		tracer = trace.NewTracer(nil)
+	}
+	if pcapPath != "" {
+		f, err := os.Create(pcapPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create pcap file: %v", err)
+		}
+		if err := tracer.WritePcap(f); err != nil {
+			return nil, err
+		}
+	}
+
+	return tracer, nil
+}
+
+func get(args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	remoteAddress, newClient := clientFlags(flags)
+	multicast := flags.Bool("multicast", false, "Request the multicast option, sharing the transfer with the other clients reading the file")
+	resume := flags.Bool("resume", false, "Keep the partial file of a failed download and request only the remaining bytes on the next attempt; a checksum mismatch deletes the partial file")
+	checksum := flags.String("sha256", "", "Expected SHA-256 of the file, in hexadecimal; a file not matching it is removed, even a resumed partial download")
+	verify := flags.Bool("verify", false, "Check the SHA-256 of the file against the one published by the server; a file not matching it is removed, even a resumed partial download")
+	if err := flags.Parse(args); err != nil {
+		return parseError(err)
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return usageError{"usage: tftp get [flags] <remote> [local]"}
+	}
+
+	remoteFile := flags.Arg(0)
+	localFile := path.Base(remoteFile)
+	if flags.NArg() == 2 {
+		localFile = flags.Arg(1)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	c.Multicast = *multicast
+	c.Resume = *resume
+	c.SHA256 = *checksum
+	c.Verify = *verify
+	serverAddr, err := net.ResolveUDPAddr("udp4", *remoteAddress)
+	if err != nil {
+		return fmt.Errorf("cannot resolve remote address %s: %v", *remoteAddress, err)
+	}
+
+	// The final ACK is sent again until the server can no longer miss it
+	defer c.Wait()
+	if localFile == stdio {
+		return c.ReceiveFile(serverAddr, remoteFile, os.Stdout)
+	}
+
+	showProgress(c)
+	return c.RequestFileTo(serverAddr, remoteFile, localFile)
+}
+
+func put(args []string) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	remoteAddress, newClient := clientFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return parseError(err)
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return usageError{"usage: tftp put [flags] <local> [remote]"}
+	}
+
+	localFile := flags.Arg(0)
+	remoteFile := filepath.Base(localFile)
+	if flags.NArg() == 2 {
+		remoteFile = flags.Arg(1)
+	} else if localFile == stdio {
+		return usageError{"the remote file name is required when reading from stdin"}
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp4", *remoteAddress)
+	if err != nil {
+		return fmt.Errorf("cannot resolve remote address %s: %v", *remoteAddress, err)
+	}
+
+	showProgress(c)
+	var input io.Reader = os.Stdin
+	if localFile != stdio {
+		f, err := os.Open(localFile)
+		if err != nil {
+			return fmt.Errorf("cannot open %s: %v", localFile, err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	return c.SendFile(serverAddr, remoteFile, input)
+}
+
+func runShell(args []string) error {
+	flags := flag.NewFlagSet("shell", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return parseError(err)
+	}
+	if flags.NArg() > 1 {
+		return usageError{"usage: tftp shell [host[:port]]"}
+	}
+
+	sh := shell.NewShell()
+	if flags.NArg() == 1 {
+		if err := sh.Connect(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	return sh.Run()
+}
+
+// showProgress renders a progress bar for the transfers of the
+// client when the standard output is a terminal
+func showProgress(c *client.Client) {
+	if progress.IsTerminal(os.Stdout) {
+		c.OnProgress = progress.NewBar(os.Stdout).Update
+	}
+}
 
-		logger.Info("Client operations have been successful. Shutting down client")
+// parseError converts the errors of the flag package, which have
+// already been printed together with the usage of the command
+func parseError(err error) error {
+	if err == flag.ErrHelp {
+		return err
 	}
+	return usageError{}
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// runCapturing runs the command line and returns its exit code together
+// with what it has printed on the standard output and error
+func runCapturing(t *testing.T, args []string) (int, string) {
+	t.Helper()
+	output, err := ioutil.TempFile(t.TempDir(), "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = output, output
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+	code := run(args)
+
+	printed, err := ioutil.ReadFile(output.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, string(printed)
+}
+
+func TestExitCodes(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.bin")
+
+	tests := []struct {
+		args []string
+		code int
+		// printed is part of the expected output
+		printed string
+	}{
+		{args: nil, code: exitUsage, printed: "usage: tftp"},
+		{args: []string{"help"}, code: exitOK, printed: "usage: tftp"},
+		{args: []string{"-h"}, code: exitOK, printed: "usage: tftp"},
+		{args: []string{"-unknown", "get", "a"}, code: exitUsage},
+		{args: []string{"-log-format", "xml", "get", "a"}, code: exitUsage, printed: `unknown log format "xml"`},
+		{args: []string{"-log-level", "loud", "get", "a"}, code: exitUsage},
+		{args: []string{"get", "-h"}, code: exitOK},
+		{args: []string{"frobnicate"}, code: exitUsage, printed: `unknown command "frobnicate"`},
+		{args: []string{"serve", "now"}, code: exitUsage, printed: "serve does not accept arguments"},
+		{args: []string{"get"}, code: exitUsage, printed: "usage: tftp get"},
+		{args: []string{"get", "a", "b", "c"}, code: exitUsage, printed: "usage: tftp get"},
+		{args: []string{"get", "-unknown", "a"}, code: exitUsage},
+		{args: []string{"get", "-mode", "ebcdic", "a"}, code: exitUsage, printed: `unknown mode "ebcdic"`},
+		{args: []string{"get", "-blksize", "7", "a"}, code: exitUsage, printed: "invalid block size 7"},
+		{args: []string{"put", "-"}, code: exitUsage, printed: "the remote file name is required"},
+		{args: []string{"shell", "a", "b"}, code: exitUsage, printed: "usage: tftp shell"},
+		{args: []string{"get", "-remote", "127.0.0.1:port", "a"}, code: exitFailure, printed: "cannot resolve remote address"},
+		{args: []string{"put", missing}, code: exitFailure, printed: "cannot open " + missing},
+		{args: []string{"serve", "-config", missing}, code: exitFailure, printed: "cannot read configuration file " + missing},
+	}
+
+	for _, test := range tests {
+		code, printed := runCapturing(t, test.args)
+		if code != test.code {
+			t.Errorf("%q: exited with %d, expected %d", test.args, code, test.code)
+		}
+		if !strings.Contains(printed, test.printed) {
+			t.Errorf("%q: printed %q, expected %q", test.args, printed, test.printed)
+		}
+	}
+}
+
+// TestParseError expects the errors of the flag package to be reported
+// as usage errors without message, as the usage has already been printed,
+// and the request for help to be kept
+func TestParseError(t *testing.T) {
+	if err := parseError(flag.ErrHelp); err != flag.ErrHelp {
+		t.Errorf("-h has been converted to %v", err)
+	}
+	if err, ok := parseError(errors.New("flag provided but not defined: -x")).(usageError); !ok || err.message != "" {
+		t.Errorf("an invalid flag has been converted to %#v", err)
+	}
+}
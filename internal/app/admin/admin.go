@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/server"
+)
+
+const sessionsPath = "/sessions/"
+
+// Handler serves the JSON API used to inspect and control the sessions of
+// a server:
+//
+//	GET    /sessions            lists the transfers in progress
+//	GET    /sessions/completed  lists the last completed transfers
+//	DELETE /sessions/<id>       cancels a transfer in progress
+type Handler struct {
+	server *server.Server
+}
+
+func NewHandler(s *server.Server) *Handler {
+	return &Handler{server: s}
+}
+
+// Serve exposes the API on the given address
+func Serve(address string, s *server.Server) error {
+	return http.ListenAndServe(address, NewHandler(s))
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	switch {
+	case path == "/sessions":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, h.server.Sessions())
+	case path == "/sessions/completed":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, h.server.CompletedSessions())
+	case strings.HasPrefix(path, sessionsPath):
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h.cancel(w, strings.TrimPrefix(path, sessionsPath))
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) cancel(w http.ResponseWriter, id string) {
+	err := h.server.CancelSession(id)
+	if err == server.ErrSessionNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"id": id, "status": "canceled"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
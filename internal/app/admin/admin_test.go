@@ -0,0 +1,154 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/admin"
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/server"
+	"go.uber.org/zap"
+)
+
+// startServer serves a directory holding image.bin on a free port of
+// 127.0.0.1 until the test ends
+func startServer(t *testing.T) (*server.Server, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+
+	cfg := config.Default()
+	cfg.Listen = []string{addr.String()}
+	cfg.Root = t.TempDir()
+	cfg.Logging.Level = "error"
+	if err := ioutil.WriteFile(filepath.Join(cfg.Root, "image.bin"), make([]byte, 1500), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.NewServer()
+	s.Logger = logger.New(zap.NewNop())
+	if err := s.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+
+	return s, addr
+}
+
+// receive returns the next packet sent to conn
+func receive(t *testing.T, conn *net.UDPConn) interface{} {
+	t.Helper()
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := packets.ParsePacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+// request sends a request to the API, decoding the JSON answered into
+// value unless it is nil, and returns the status
+func request(t *testing.T, h http.Handler, method string, path string, value interface{}) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	if value != nil {
+		if err := json.NewDecoder(recorder.Body).Decode(value); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return recorder.Code
+}
+
+// TestCancel expects a transfer in progress to be listed, and to be
+// aborted with an ERROR once canceled
+func TestCancel(t *testing.T) {
+	s, serverAddr := startServer(t)
+	h := admin.NewHandler(s)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteToUDP(packets.NewRRQPacket("image.bin", packets.Octet).Bytes(), serverAddr); err != nil {
+		t.Fatal(err)
+	}
+	packet := receive(t, conn)
+	if data, ok := packet.(packets.DataPacket); !ok || data.BlockNumber != 1 {
+		t.Fatalf("expected DATA 1, got %v", packet)
+	}
+
+	var sessions []server.SessionInfo
+	if status := request(t, h, http.MethodGet, "/sessions", &sessions); status != http.StatusOK {
+		t.Fatalf("the sessions have been listed with status %d", status)
+	}
+	if len(sessions) != 1 || sessions[0].Filename != "image.bin" || sessions[0].Peer != conn.LocalAddr().String() {
+		t.Fatalf("listed %+v, expected the read of image.bin", sessions)
+	}
+
+	if status := request(t, h, http.MethodDelete, "/sessions/"+sessions[0].ID, nil); status != http.StatusOK {
+		t.Fatalf("the session has been canceled with status %d", status)
+	}
+	packet = receive(t, conn)
+	if errorPacket, ok := packet.(packets.ErrorPacket); !ok || errorPacket.ErrorCode != 0 {
+		t.Fatalf("expected ERROR 0, got %v", packet)
+	}
+	s.Stop()
+
+	var completed []server.SessionInfo
+	request(t, h, http.MethodGet, "/sessions/completed", &completed)
+	if len(completed) != 1 || completed[0].ID != sessions[0].ID || completed[0].Result != server.ResultCanceled {
+		t.Errorf("listed %+v as completed, expected the canceled session", completed)
+	}
+	if status := request(t, h, http.MethodDelete, "/sessions/"+sessions[0].ID, nil); status != http.StatusNotFound {
+		t.Errorf("a completed session has been canceled with status %d", status)
+	}
+}
+
+// TestRequestErrors expects the requests the API does not serve to be
+// answered with an error message and the matching status
+func TestRequestErrors(t *testing.T) {
+	h := admin.NewHandler(server.NewServer())
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodPost, "/sessions", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/sessions/completed", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/sessions/unknown", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/sessions/unknown", http.StatusNotFound},
+		{http.MethodGet, "/metrics", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		var answer map[string]string
+		if status := request(t, h, test.method, test.path, &answer); status != test.status {
+			t.Errorf("%s %s: got status %d, expected %d", test.method, test.path, status, test.status)
+		}
+		if answer["error"] == "" {
+			t.Errorf("%s %s: no error message in %v", test.method, test.path, answer)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Record describes a completed transfer
+type Record struct {
+	Time       time.Time         `json:"time"`
+	ClientIP   string            `json:"client_ip"`
+	ClientPort int               `json:"client_port"`
+	Operation  string            `json:"operation"`
+	Path       string            `json:"path"`
+	Mode       string            `json:"mode"`
+	Options    map[string]string `json:"options,omitempty"`
+	Bytes      int64             `json:"bytes"`
+	Duration   float64           `json:"duration_seconds"`
+	Result     string            `json:"result"`
+	Error      string            `json:"error,omitempty"`
+	SHA256     string            `json:"sha256,omitempty"`
+}
+
+// Log appends records as JSON lines to a file, which is rotated when it
+// grows beyond the maximum size. Rotated files are renamed with a numeric
+// suffix, the most recent being .1, and only maxBackups of them are kept
+type Log struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// Open opens the audit log at path, creating it if needed
+func Open(path string, maxSize int64, maxBackups int) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return errors.Wrapf(err, "cannot open audit log %s", l.path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "cannot open audit log %s", l.path)
+	}
+
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends the record and flushes it to the disk
+func (l *Log) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode audit record")
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "cannot write audit record")
+	}
+
+	return l.file.Sync()
+}
+
+// rotate renames the current file and the previous backups,
+// dropping the oldest one, then starts a new file
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return errors.Wrap(err, "cannot close audit log")
+	}
+
+	if l.maxBackups > 0 {
+		os.Remove(l.backupPath(l.maxBackups))
+		for i := l.maxBackups - 1; i >= 1; i-- {
+			os.Rename(l.backupPath(i), l.backupPath(i+1))
+		}
+		if err := os.Rename(l.path, l.backupPath(1)); err != nil {
+			return errors.Wrap(err, "cannot rotate audit log")
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return errors.Wrap(err, "cannot rotate audit log")
+	}
+
+	return l.open()
+}
+
+func (l *Log) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// record returns the record of the transfer of file-<i>, whose line has
+// the same length for i below 10
+func record(i int) Record {
+	return Record{
+		Time:      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		ClientIP:  "10.0.0.1",
+		Operation: "RRQ",
+		Path:      "file-" + strconv.Itoa(i),
+		Result:    "success",
+	}
+}
+
+// lineSize is the size of the line of a record
+func lineSize(t *testing.T) int64 {
+	t.Helper()
+	line, err := json.Marshal(record(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(line)) + 1
+}
+
+// paths returns the paths of the records of a log file, nil if it does
+// not exist
+func paths(t *testing.T, path string) []string {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logged []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		var r Record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("%s holds an invalid line %q: %v", path, line, err)
+		}
+		logged = append(logged, r.Path)
+	}
+	return logged
+}
+
+func write(t *testing.T, l *Log, from int, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		if err := l.Write(record(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRotation writes seven records to logs holding two of them, and
+// expects the most recent ones to be kept in the backups
+func TestRotation(t *testing.T) {
+	tests := []struct {
+		maxBackups int
+		// files are the records of the log and then of its backups
+		files [][]string
+	}{
+		{2, [][]string{{"file-7"}, {"file-5", "file-6"}, {"file-3", "file-4"}, nil}},
+		{0, [][]string{{"file-7"}, nil}},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		l, err := Open(path, 2*lineSize(t), test.maxBackups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, l, 1, 7)
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, expected := range test.files {
+			file := path
+			if i > 0 {
+				file = l.backupPath(i)
+			}
+			if logged := paths(t, file); !reflect.DeepEqual(logged, expected) {
+				t.Errorf("%d backups: %s holds %q, expected %q", test.maxBackups, filepath.Base(file), logged, expected)
+			}
+		}
+	}
+}
+
+// TestReopen expects the records of a reopened log to be appended, and to
+// count towards its size
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for _, records := range [][]int{{1, 1}, {2, 3}} {
+		l, err := Open(path, 2*lineSize(t), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, l, records[0], records[1])
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if logged := paths(t, path+".1"); !reflect.DeepEqual(logged, []string{"file-1", "file-2"}) {
+		t.Errorf("the backup holds %q", logged)
+	}
+	if logged := paths(t, path); !reflect.DeepEqual(logged, []string{"file-3"}) {
+		t.Errorf("the log holds %q", logged)
+	}
+}
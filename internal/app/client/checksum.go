@@ -0,0 +1,92 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/pkg/errors"
+)
+
+// checksumSuffix names the file holding the SHA-256 of another one on the server
+const checksumSuffix = ".sha256"
+
+// ChecksumError is returned when the SHA-256 of a received file is not
+// the expected one
+type ChecksumError struct {
+	Expected string
+	Got      string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("the SHA-256 of the received file is %s, expected %s", e.Got, e.Expected)
+}
+
+// checksum computes the SHA-256 of a file as it is received
+type checksum struct {
+	digest hash.Hash
+	// expected is the digest of the file in hexadecimal, empty until known
+	expected string
+}
+
+func newChecksum(expected string) *checksum {
+	return &checksum{digest: sha256.New(), expected: expected}
+}
+
+func (s *checksum) Write(data []byte) (int, error) {
+	return s.digest.Write(data)
+}
+
+// check compares the digest of the received bytes with the expected one
+func (s *checksum) check() error {
+	got := hex.EncodeToString(s.digest.Sum(nil))
+	if !strings.EqualFold(got, s.expected) {
+		return &ChecksumError{Expected: strings.ToLower(s.expected), Got: got}
+	}
+	return nil
+}
+
+// verifyChecksum checks the digest of a received file, reading the expected
+// one from <file>.sha256 on the server when it is not known yet
+func (c *Client) verifyChecksum(sum *checksum, serverAddr *net.UDPAddr, requestedFilePath string) error {
+	if sum.expected == "" {
+		expected, err := c.fetchChecksum(serverAddr, requestedFilePath)
+		if err != nil {
+			return err
+		}
+		sum.expected = expected
+	}
+	return sum.check()
+}
+
+// fetchChecksum reads the digest of a file from the <file>.sha256 published
+// by the server, in the format of sha256sum
+func (c *Client) fetchChecksum(serverAddr *net.UDPAddr, requestedFilePath string) (string, error) {
+	fetcher := *c
+	fetcher.Mode = packets.Octet
+	fetcher.Multicast = false
+	fetcher.Verify = false
+	fetcher.SHA256 = ""
+	fetcher.OnProgress = nil
+
+	var content bytes.Buffer
+	if err := fetcher.ReceiveFile(serverAddr, requestedFilePath+checksumSuffix, &content); err != nil {
+		return "", errors.Wrapf(err, "cannot read the SHA-256 of %s", requestedFilePath)
+	}
+	fields := strings.Fields(content.String())
+	if len(fields) == 0 || !validDigest(fields[0]) {
+		return "", errors.Errorf("%s%s does not hold a SHA-256", requestedFilePath, checksumSuffix)
+	}
+	return fields[0], nil
+}
+
+// validDigest reports whether sum is a SHA-256 written in hexadecimal
+func validDigest(sum string) bool {
+	decoded, err := hex.DecodeString(sum)
+	return err == nil && len(decoded) == sha256.Size
+}
@@ -0,0 +1,78 @@
+package client_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/server"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// TestVerify expects the digest of a download to be checked against the one
+// of the OACK, of <file>.sha256 when the option is declined, or the one
+// given to the client, and a mismatch to fail the transfer
+func TestVerify(t *testing.T) {
+	expected := content(1500)
+	tests := []struct {
+		name         string
+		sha256Option bool
+		// digestFile is the content of verify.bin.sha256 when not empty
+		digestFile string
+		verify     bool
+		sha256     string
+		mismatch   bool
+	}{
+		{name: "sha256 option", sha256Option: true, verify: true},
+		{name: "checksum file", verify: true},
+		{name: "wrong checksum file", digestFile: sha256Hex(nil) + "  verify.bin\n", verify: true, mismatch: true},
+		{name: "given digest", sha256: sha256Hex(expected)},
+		{name: "wrong given digest", sha256Option: true, sha256: sha256Hex(expected[1:]), mismatch: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network := transport.NewMemory(transport.Conditions{}, 1)
+			s, serverAddr, root := startServer(t, network)
+			writeFile(t, root, "verify.bin", expected)
+			if test.digestFile != "" {
+				writeFile(t, root, "verify.bin.sha256", []byte(test.digestFile))
+			}
+			cfg := *s.Config()
+			if test.sha256Option {
+				cfg.Options = append(append([]string(nil), cfg.Options...), packets.OptionSHA256)
+			}
+			cfg.Checksums.Files = true
+			if err := s.SetConfig(&cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			c := newClient(network)
+			c.Verify, c.SHA256 = test.verify, test.sha256
+			var received bytes.Buffer
+			err := c.ReceiveFile(serverAddr, "verify.bin", &received)
+			if test.mismatch {
+				if _, ok := err.(*client.ChecksumError); !ok {
+					t.Errorf("expected a checksum mismatch, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectContent(t, received.Bytes(), expected)
+			if test.verify && !test.sha256Option {
+				// The digest has been fetched from the checksum file
+				expectSession(t, s, "verify.bin.sha256", server.ResultSuccess)
+			}
+		})
+	}
+}
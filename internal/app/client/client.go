@@ -1,183 +1,618 @@
 package client
 
 import (
+	"fmt"
+	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mirkoschicchi/TFTP/internal/app/logger"
 	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/progress"
+	"github.com/mirkoschicchi/TFTP/internal/app/ratelimit"
+	"github.com/mirkoschicchi/TFTP/internal/app/trace"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
 	"github.com/mirkoschicchi/TFTP/internal/app/utils"
 	"github.com/pkg/errors"
 )
 
+const defaultTimeout = 5 * time.Second
+
 type Client struct {
+	// TID is the local port of the last transfer. Each transfer uses a new
+	// one, as the socket of the previous download may still be dallying
 	TID  int
-	Conn *net.UDPConn
+	Conn net.PacketConn
+	// Network opens the sockets of the client, which are UDP sockets by default
+	Network transport.Network
+	// Mode is the transfer mode sent in read and write requests
+	Mode packets.Mode
+	// BlockSize is the block size proposed to the server with the blksize option
+	BlockSize int
+	// Timeout is how long the client waits for a packet from the server
+	Timeout time.Duration
+	// Multicast requests the multicast option of RFC 2090 with reads, so
+	// that the clients reading the same file share the transfer. Servers
+	// declining it send the file to the client alone
+	Multicast bool
+	// Resume keeps the partial file of a failed download along with its
+	// state, so that the next download of the same file only requests the
+	// remaining bytes with the offset option
+	Resume bool
+	// SHA256 is the expected digest of the received files, in hexadecimal.
+	// It is computed as the blocks arrive, and a file not matching it
+	// fails the transfer
+	SHA256 string
+	// Verify checks the digest of the received files against the one given
+	// by the server, with the sha256 option or as <file>.sha256
+	Verify bool
+	// Bandwidth is the number of bytes per second a transfer sends or
+	// receives, zero means unlimited. Multicast reads are not limited
+	Bandwidth int64
+	// Tracer records every packet sent or received when set
+	Tracer *trace.Tracer
+	// OnProgress is called every time a transfer makes progress
+	OnProgress progress.Func
+	// Logger receives the messages of the transfers
+	Logger *logger.Logger
+
+	// dallies counts the connections of the finished downloads which are
+	// still dallying
+	dallies *sync.WaitGroup
 }
 
 func NewClient() Client {
 	clientTID := utils.GetRandomTID()
 
-	return Client{TID: clientTID}
+	return Client{
+		TID:       clientTID,
+		Mode:      packets.Netascii,
+		BlockSize: packets.DefaultBlockSize,
+		Timeout:   defaultTimeout,
+		Logger:    logger.Default(),
+		Network:   transport.UDP{},
+		dallies:   new(sync.WaitGroup),
+	}
+}
+
+// Wait blocks until the connections of the finished downloads have stopped
+// dallying. It must be called before the program exits, otherwise a server
+// which has missed the final ACK of a download gets no answer
+func (c *Client) Wait() {
+	if c.dallies != nil {
+		c.dallies.Wait()
+	}
+}
+
+// RemoteError is returned when the server aborts a transfer with an ERROR packet
+type RemoteError struct {
+	Code    uint16
+	Message string
 }
 
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("the server has returned error %d: %s", e.Code, e.Message)
+}
+
+// RequestFile retrieves a file from the server and stores it
+// in the current directory using the same base name
 func (c *Client) RequestFile(serverAddr *net.UDPAddr, requestedFilePath string) error {
-	var localAddress *net.UDPAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.TID}
+	splittedFilePath := strings.Split(requestedFilePath, "/")
+	receivedFile := splittedFilePath[len(splittedFilePath)-1]
+
+	return c.RequestFileTo(serverAddr, requestedFilePath, receivedFile)
+}
 
-	logger.Debug("The client local address is %+v", localAddress)
+// RequestFileTo retrieves a file from the server and stores it in localPath.
+// The local file is removed if the transfer fails, unless the download is to
+// be resumed
+func (c *Client) RequestFileTo(serverAddr *net.UDPAddr, requestedFilePath string, localPath string) error {
+	if c.Resume {
+		return c.resumeFile(serverAddr, requestedFilePath, localPath)
+	}
+	return c.createFile(serverAddr, requestedFilePath, localPath)
+}
 
-	initialConnection, err := net.DialUDP("udp4", localAddress, serverAddr)
+// createFile retrieves a file into a new local file
+func (c *Client) createFile(serverAddr *net.UDPAddr, requestedFilePath string, localPath string) error {
+	f, err := os.Create(localPath)
 	if err != nil {
-		return errors.Wrap(err, "cannot connect to server")
+		return errors.Wrap(err, "cannot create file to be received")
 	}
-	c.Conn = initialConnection
 
-	logger.Info("Connection to server at %+v has been created", serverAddr)
+	err = c.ReceiveFile(serverAddr, requestedFilePath, f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "cannot save received file")
+	}
+	if err != nil {
+		os.Remove(localPath)
+		return err
+	}
 
-	rrqPacket := packets.NewRRQPacket(requestedFilePath, packets.Netascii)
-	_, err = c.Conn.Write(rrqPacket.Bytes())
+	return nil
+}
+
+// resumeFile retrieves a file into its local file, requesting only the bytes
+// missing from a partial download of the same file
+func (c *Client) resumeFile(serverAddr *net.UDPAddr, requestedFilePath string, localPath string) error {
+	partial, err := openPartial(localPath, serverAddr, requestedFilePath)
 	if err != nil {
-		return errors.Wrap(err, "cannot write to server")
+		return err
+	}
+	if partial.offset > 0 {
+		c.logger().Info("Resuming the download of %s after %d bytes", localPath, partial.offset)
+	}
+
+	err = c.receiveFile(serverAddr, requestedFilePath, partial, partial)
+	if err == errFileChanged {
+		c.logger().Info("%v, downloading it again", err)
+		err = c.receiveFile(serverAddr, requestedFilePath, partial, partial)
+	}
+	return partial.finish(err)
+}
+
+// ReceiveFile retrieves a file from the server writing its content to w.
+// Once the file has been received, the connection is kept open in the
+// background for a while to acknowledge again the last block if needed,
+// which Wait waits for
+func (c *Client) ReceiveFile(serverAddr *net.UDPAddr, requestedFilePath string, w io.Writer) error {
+	return c.receiveFile(serverAddr, requestedFilePath, w, nil)
+}
+
+// receiveFile retrieves a file from the server, resuming the partial download
+// when set, in which case w is the partial download itself
+func (c *Client) receiveFile(serverAddr *net.UDPAddr, requestedFilePath string, w io.Writer, partial *partialDownload) error {
+	log := c.transferLogger(serverAddr, requestedFilePath)
+	if c.SHA256 != "" && !validDigest(c.SHA256) {
+		return errors.Errorf("invalid SHA-256 %q", c.SHA256)
 	}
+	bucket := c.bandwidthBucket()
+	var sum *checksum
+	if c.Verify || c.SHA256 != "" {
+		sum = newChecksum(c.SHA256)
+		w = io.MultiWriter(w, sum)
+	}
+	c.TID = utils.GetRandomTID()
+	var localAddress *net.UDPAddr = &net.UDPAddr{Port: c.TID}
 
-	logger.Info("Client has sent RRQ packet to the server")
-	initialConnection.Close()
+	log.Debug("The client local address is %+v", localAddress)
 
-	newConnection, err := net.ListenUDP("udp4", localAddress)
+	// The request is sent from the same socket used for the transfer, so
+	// that the client is already listening when the server answers
+	newConnection, err := c.network().ListenPacket(localAddress.String())
 	if err != nil {
 		return errors.Wrap(err, "error while listening for incoming UDP connections")
 	}
-	defer newConnection.Close()
+	dallying := false
+	defer func() {
+		if !dallying {
+			newConnection.Close()
+		}
+	}()
+	c.Conn = newConnection
 
-	logger.Debug("New connection to the client has been created")
-	var receivedBytes []byte
-	var isFinalBlock bool = false
+	log.Debug("New connection to the client has been created")
 
-	for !isFinalBlock {
-		var buf []byte = make([]byte, packets.TftpMaxPacketSize)
-		newConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
-		bytesReceived, remoteAddr, err := newConnection.ReadFromUDP(buf)
-		if err != nil {
-			panic(err)
-		}
+	rrqPacket := packets.NewRRQPacket(requestedFilePath, c.Mode)
+	rrqPacket.Options = c.requestOptions(0)
+	if c.Multicast {
+		rrqPacket.Options[packets.OptionMulticast] = ""
+	}
+	if partial != nil {
+		partial.requestOptions(rrqPacket.Options)
+	}
+	if c.Verify {
+		rrqPacket.Options[packets.OptionSHA256] = "0"
+	}
+	_, err = c.send(log, newConnection, rrqPacket, serverAddr)
+	if err != nil {
+		return errors.Wrap(err, "cannot write to server")
+	}
 
-		// Parse the bytes received into a packet
-		parsedPacket, err := packets.ParsePacket(buf[:bytesReceived])
+	log.Info("Client has sent RRQ packet to the server at %+v", serverAddr)
+	tracker := progress.NewTracker(requestedFilePath, 0, c.OnProgress)
+	var blockSize int = packets.DefaultBlockSize
+	// lastPacket is sent again when the server is silent: the
+	// request until the server answers, then the last ACK
+	var lastPacket packets.Packet = rrqPacket
+	var lastAddr *net.UDPAddr = serverAddr
+	var serverTID *net.UDPAddr
+	var expectedBlock uint16 = 1
+	var retransmissions int
+
+	for {
+		parsedPacket, remoteAddr, err := c.receive(log, newConnection, receiveBufferSize(blockSize))
+		if isTimeout(err) && retransmissions < maxRetransmissions {
+			retransmissions++
+			log.Debug("No answer from the server, sending %v again", lastPacket)
+			tracker.Retransmit()
+			if _, err := c.send(log, newConnection, lastPacket, lastAddr); err != nil {
+				return errors.Wrap(err, "cannot write to server")
+			}
+			continue
+		}
 		if err != nil {
-			return errors.Wrap(err, "cannot parse incoming packet")
+			return err
+		}
+		if serverTID == nil {
+			serverTID = remoteAddr
+		} else if !transport.SameAddr(remoteAddr, serverTID) {
+			c.rejectUnknownTID(log, newConnection, remoteAddr)
+			continue
 		}
 
 		switch parsedPacket := parsedPacket.(type) {
 		case packets.ErrorPacket:
-			logger.Error("Error packet with following content has been received: %v", parsedPacket)
-			return nil
+			log.Error("Error packet with following content has been received: %v", parsedPacket)
+			return &RemoteError{Code: parsedPacket.ErrorCode, Message: parsedPacket.ErrMsg}
+		case packets.OACKPacket:
+			if expectedBlock != 1 {
+				continue
+			}
+			var transferSize int64
+			blockSize, transferSize = acceptedOptions(parsedPacket.Options)
+			tracker.SetTotal(transferSize)
+			log.Debug("The server has acknowledged the options %+v", parsedPacket.Options)
+			if partial != nil {
+				if err := partial.accept(parsedPacket.Options, transferSize); err != nil {
+					errorPacket := packets.NewErrorPacket(0, "Cannot write the received data")
+					if err == errFileChanged {
+						errorPacket = packets.NewErrorPacket(8, "The file has changed")
+					}
+					c.send(log, newConnection, errorPacket, remoteAddr)
+					return err
+				}
+				tracker.Add(int(partial.offset))
+				if sum != nil {
+					if err := partial.hashPrefix(sum); err != nil {
+						return err
+					}
+				}
+			}
+			if sum != nil && sum.expected == "" {
+				sum.expected = parsedPacket.Options[packets.OptionSHA256]
+			}
+
+			if value, ok := parsedPacket.Options[packets.OptionMulticast]; ok {
+				option, err := packets.ParseMulticast(value)
+				if err != nil || option.Group == nil {
+					c.send(log, newConnection, packets.NewErrorPacket(8, "Invalid multicast option"), remoteAddr)
+					return errors.Errorf("the server has acknowledged an invalid multicast option %q", value)
+				}
+				finalAck, err := c.receiveMulticast(log, newConnection, remoteAddr, option, blockSize, tracker, w)
+				if err != nil {
+					return err
+				}
+				tracker.Finish()
+				dallying = true
+				c.startDally(log, newConnection, finalAck, remoteAddr)
+				if sum != nil {
+					return c.verifyChecksum(sum, serverAddr, requestedFilePath)
+				}
+				return nil
+			}
+
+			// Confirm the options with an ACK for block 0
+			lastPacket, lastAddr = packets.NewAckPacket(0), remoteAddr
+			_, err = c.send(log, newConnection, lastPacket, lastAddr)
+			if err != nil {
+				return errors.Wrap(err, "cannot write to server")
+			}
 		case packets.DataPacket:
-			receivedBytes = append(receivedBytes, parsedPacket.Data...)
-			if len(parsedPacket.Data) < utils.MAX_DATA_FIELD_LENGTH {
-				isFinalBlock = true
+			if parsedPacket.BlockNumber == expectedBlock-1 {
+				// The server has not received the ACK of the previous block
+				log.Debug("Duplicate block %d received, sending %v again", parsedPacket.BlockNumber, lastPacket)
+				if _, err := c.send(log, newConnection, lastPacket, lastAddr); err != nil {
+					return errors.Wrap(err, "cannot write to server")
+				}
+				continue
+			}
+			if parsedPacket.BlockNumber != expectedBlock {
+				log.Debug("Ignoring unexpected block %d", parsedPacket.BlockNumber)
+				continue
 			}
 
-			ackPacket := packets.NewAckPacket(parsedPacket.BlockNumber)
+			// The server waits for the ACK before sending the next block
+			time.Sleep(bucket.Reserve(len(parsedPacket.Data)))
+			if partial != nil && !partial.answered {
+				// The server has ignored the options, the file is sent
+				// from its start
+				if err := partial.accept(nil, 0); err != nil {
+					c.send(log, newConnection, packets.NewErrorPacket(0, "Cannot write the received data"), remoteAddr)
+					return err
+				}
+			}
 
-			_, err = newConnection.WriteToUDP(ackPacket.Bytes(), remoteAddr)
+			retransmissions = 0
+			if _, err := w.Write(parsedPacket.Data); err != nil {
+				return errors.Wrap(err, "cannot write received data")
+			}
+			tracker.Add(len(parsedPacket.Data))
+			lastBlock := len(parsedPacket.Data) < blockSize
+			if lastBlock && sum != nil && sum.expected != "" {
+				// The transfer fails rather than ending with the final ACK
+				if err := sum.check(); err != nil {
+					c.send(log, newConnection, packets.NewErrorPacket(0, "Checksum mismatch"), remoteAddr)
+					return err
+				}
+			}
+
+			ackPacket := packets.NewAckPacket(parsedPacket.BlockNumber)
+			lastPacket, lastAddr = ackPacket, remoteAddr
+			_, err = c.send(log, newConnection, ackPacket, remoteAddr)
 			if err != nil {
 				return errors.Wrap(err, "cannot write to server")
 			}
+			expectedBlock++
+
+			if lastBlock {
+				tracker.Finish()
+				dallying = true
+				c.startDally(log, newConnection, ackPacket, remoteAddr)
+				if sum != nil && sum.expected == "" {
+					return c.verifyChecksum(sum, serverAddr, requestedFilePath)
+				}
+				return nil
+			}
 		}
 	}
+}
 
-	splittedFilePath := strings.Split(requestedFilePath, "/")
-	receivedFile := splittedFilePath[len(splittedFilePath)-1]
-	f, err := os.Create(receivedFile)
+// WriteFile sends a local file to the server using its path as remote name
+func (c *Client) WriteFile(serverAddr *net.UDPAddr, fileToWritePath string) error {
+	return c.WriteFileAs(serverAddr, fileToWritePath, fileToWritePath)
+}
+
+// WriteFileAs sends the local file at localPath to the server as remoteFilePath
+func (c *Client) WriteFileAs(serverAddr *net.UDPAddr, localPath string, remoteFilePath string) error {
+	c.logger().Info(">>> Reading file that needs to be written from the file-system: %s", localPath)
+	f, err := os.Open(localPath)
 	if err != nil {
-		return errors.Wrap(err, "cannot create file to be received")
+		return errors.Wrap(err, "cannot read file to be written")
 	}
-	f.WriteString(string(receivedBytes))
+	defer f.Close()
 
-	return nil
+	return c.SendFile(serverAddr, remoteFilePath, f)
 }
 
-func (c *Client) WriteFile(serverAddr *net.UDPAddr, fileToWritePath string) error {
-	var localAddress *net.UDPAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.TID}
+// SendFile sends the content read from r to the server as remoteFilePath.
+// The content is read one block at a time, as it is sent
+func (c *Client) SendFile(serverAddr *net.UDPAddr, remoteFilePath string, r io.Reader) error {
+	log := c.transferLogger(serverAddr, remoteFilePath)
+	size := contentSize(r)
+
+	c.TID = utils.GetRandomTID()
+	var localAddress *net.UDPAddr = &net.UDPAddr{Port: c.TID}
 
-	logger.Debug("The client local address is %+v", localAddress)
+	log.Debug("The client local address is %+v", localAddress)
 
-	initialConnection, err := net.DialUDP("udp4", localAddress, serverAddr)
+	// Listen for incoming connection from the server before sending the request
+	newConnection, err := c.network().ListenPacket(localAddress.String())
 	if err != nil {
-		return errors.Wrap(err, "cannot connect to server")
+		return errors.Wrap(err, "error while listening for incoming UDP connections")
 	}
-	c.Conn = initialConnection
+	defer newConnection.Close()
+	c.Conn = newConnection
 
-	logger.Debug("Connection to server at %+v has been created", serverAddr)
+	log.Debug("New connection has been created")
 
-	wrqPacket := packets.NewWRQPacket(fileToWritePath, packets.Netascii)
-	_, err = c.Conn.Write(wrqPacket.Bytes())
+	wrqPacket := packets.NewWRQPacket(remoteFilePath, c.Mode)
+	wrqPacket.Options = c.requestOptions(size)
+	_, err = c.send(log, newConnection, wrqPacket, serverAddr)
 	if err != nil {
 		return errors.Wrap(err, "cannot write to server")
 	}
 
-	logger.Debug("Client has sent the first WRQ packet to the server")
-	initialConnection.Close()
+	log.Debug("Client has sent the first WRQ packet to the server at %+v", serverAddr)
+	var total int64
+	if size > 0 {
+		total = size
+	}
+	tracker := progress.NewTracker(remoteFilePath, total, c.OnProgress)
+
+	// Wait for the server to accept the request, either with an ACK for
+	// block 0 or with an OACK, coming from the transfer ID of the server
+	var blockSize int = packets.DefaultBlockSize
+	var remoteAddress *net.UDPAddr
+	var retransmissions int
+	for remoteAddress == nil {
+		parsedPacket, addr, err := c.receive(log, newConnection, packets.TftpMaxPacketSize)
+		if isTimeout(err) && retransmissions < maxRetransmissions {
+			// The request or its answer may have been lost, send it again
+			retransmissions++
+			log.Debug("No answer from the server, sending %v again", wrqPacket)
+			tracker.Retransmit()
+			if _, err := c.send(log, newConnection, wrqPacket, serverAddr); err != nil {
+				return errors.Wrap(err, "cannot write to server")
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
 
-	// Listen for incoming connection from the server
-	newConnection, err := net.ListenUDP("udp4", localAddress)
-	if err != nil {
-		return errors.Wrap(err, "error while listening for incoming UDP connections")
+		switch parsedPacket := parsedPacket.(type) {
+		case packets.ErrorPacket:
+			return &RemoteError{Code: parsedPacket.ErrorCode, Message: parsedPacket.ErrMsg}
+		case packets.OACKPacket:
+			blockSize, _ = acceptedOptions(parsedPacket.Options)
+			log.Debug("The server has acknowledged the options %+v", parsedPacket.Options)
+			remoteAddress = addr
+		case packets.AckPacket:
+			if parsedPacket.BlockNumber == 0 {
+				remoteAddress = addr
+			}
+		}
 	}
 
-	// var buf []byte = make([]byte, packets.TftpMaxPacketSize)
-	// newConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
-	// _, remoteAddr, err := newConnection.ReadFromUDP(buf)
-	defer newConnection.Close()
+	// A block shorter than the block size, possibly empty, ends the transfer
+	bucket := c.bandwidthBucket()
+	buf := make([]byte, blockSize)
+	for blockNumber := uint16(1); ; blockNumber++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			c.send(log, newConnection, packets.NewErrorPacket(0, "Cannot read the file"), remoteAddress)
+			return errors.Wrap(err, "cannot read file to be written")
+		}
 
-	logger.Debug("New connection has been created")
+		time.Sleep(bucket.Reserve(n))
+		dataPacket := packets.NewDataPacket(blockNumber, buf[:n])
+		if _, err := c.send(log, newConnection, dataPacket, remoteAddress); err != nil {
+			log.Error("%+v", err)
+			return errors.Wrapf(err, "cannot send data to machine %+v", serverAddr)
+		}
+		tracker.Add(n)
 
-	logger.Info(">>> Reading file that needs to be written from the file-system: %s", fileToWritePath)
-	fileToWriteContent, err := utils.ReadFileFromFS(fileToWritePath)
-	if err != nil {
-		errorPacket := packets.NewErrorPacket(2, err.Error())
-		_, err = newConnection.Write(errorPacket.Bytes())
+		// The next block is only sent once this one is acknowledged
+		if err := c.awaitAck(log, newConnection, dataPacket, dataPacket.BlockNumber, remoteAddress, tracker); err != nil {
+			return err
+		}
+		if n < blockSize {
+			break
+		}
+	}
+	tracker.Finish()
+	return nil
+}
+
+// contentSize returns the number of bytes left to be read from r, or -1
+// when it cannot be known without reading them
+func contentSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case io.Seeker:
+		current, err := r.Seek(0, io.SeekCurrent)
 		if err != nil {
-			return errors.Wrapf(err, "cannot send error packet to server %+v", serverAddr)
+			return -1
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		if _, err := r.Seek(current, io.SeekStart); err != nil {
+			return -1
+		}
+		return end - current
+	}
+	return -1
+}
+
+// requestOptions returns the options to be sent along with a request.
+// transferSize is the size of the file to be written, negative when it is
+// not known, or 0 for reads
+func (c *Client) requestOptions(transferSize int64) map[string]string {
+	options := make(map[string]string)
+	if transferSize >= 0 {
+		options[packets.OptionTsize] = strconv.FormatInt(transferSize, 10)
+	}
+	if c.BlockSize != packets.DefaultBlockSize {
+		options[packets.OptionBlksize] = strconv.Itoa(c.BlockSize)
+	}
+
+	return options
+}
+
+// receiveBufferSize returns the size of the buffer needed to receive a DATA
+// packet, which is never smaller than the default so that ERROR and OACK
+// packets are not truncated when a small block size is negotiated
+func receiveBufferSize(blockSize int) int {
+	if blockSize+packets.DataHeaderSize < packets.TftpMaxPacketSize {
+		return packets.TftpMaxPacketSize
+	}
+	return blockSize + packets.DataHeaderSize
+}
+
+// acceptedOptions returns the block size and the transfer size
+// acknowledged by the server in an OACK packet
+func acceptedOptions(options map[string]string) (int, int64) {
+	var blockSize int = packets.DefaultBlockSize
+	if value, ok := options[packets.OptionBlksize]; ok {
+		if size, err := strconv.Atoi(value); err == nil {
+			blockSize = size
 		}
-		return errors.Wrap(err, "cannot read requested file from server FS")
 	}
 
-	fileDataBlocks, numberOfBlocks := utils.CreateDataBlocks(fileToWriteContent)
-	logger.Debug(">>> The file has been splitted into %d blocks", numberOfBlocks)
+	var transferSize int64
+	if value, ok := options[packets.OptionTsize]; ok {
+		transferSize, _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	return blockSize, transferSize
+}
+
+// send writes a packet to the server and records it in the trace
+func (c *Client) send(log *logger.Logger, conn net.PacketConn, packet packets.Packet, addr *net.UDPAddr) (int, error) {
+	datagram := packet.Bytes()
+	n, err := conn.WriteTo(datagram, addr)
+	if err != nil {
+		return n, err
+	}
+	c.Tracer.Sent(conn.LocalAddr(), addr, datagram)
+	log.With(packets.LogFields(packet)...).Debug("Packet sent")
+
+	return n, nil
+}
 
-	for _, dataBlock := range fileDataBlocks {
-		var buf []byte = make([]byte, packets.TftpMaxPacketSize)
-		newConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
-		_, remoteAddress, err := newConnection.ReadFromUDP(buf)
+// receive waits for the next datagram from the server, records it
+// in the trace and parses it into a packet
+func (c *Client) receive(log *logger.Logger, conn net.PacketConn, bufferSize int) (interface{}, *net.UDPAddr, error) {
+	return c.receiveUntil(log, conn, bufferSize, time.Now().Add(c.Timeout))
+}
+
+// receiveUntil is like receive, failing with a timeout at the deadline.
+// The unparsable datagrams are dropped like the network would drop them
+func (c *Client) receiveUntil(log *logger.Logger, conn net.PacketConn, bufferSize int, deadline time.Time) (interface{}, *net.UDPAddr, error) {
+	var buf []byte = make([]byte, bufferSize)
+	conn.SetReadDeadline(deadline)
+	for {
+		bytesReceived, addr, err := conn.ReadFrom(buf)
 		if err != nil {
-			return errors.Wrap(err, "cannot read client request")
+			return nil, nil, errors.Wrap(err, "cannot read server response")
 		}
+		remoteAddr := transport.UDPAddr(addr)
+		c.Tracer.Received(conn.LocalAddr(), remoteAddr, buf[:bytesReceived])
 
 		// Parse the bytes received into a packet
-		parsedPacket, err := packets.ParsePacket(buf)
+		parsedPacket, err := packets.ParsePacket(buf[:bytesReceived])
 		if err != nil {
-			return errors.Wrap(err, "cannot parse incoming packet")
+			log.Warning("Dropping unparsable packet from %s: %v", remoteAddr, err)
+			continue
 		}
+		log.With(packets.LogFields(parsedPacket)...).Debug("Packet received")
 
-		switch parsedPacket := parsedPacket.(type) {
-		case packets.AckPacket:
-			dataPacket := packets.NewDataPacket(parsedPacket.BlockNumber+1, dataBlock)
-			_, err := newConnection.WriteToUDP(dataPacket.Bytes(), remoteAddress)
-			if err != nil {
-				logger.Error("%+v", err)
-				return errors.Wrapf(err, "cannot send data to machine %+v", serverAddr)
-			}
-		default:
-			errorPacket := packets.NewErrorPacket(4, "invalid packet received")
-			_, err = newConnection.Write(errorPacket.Bytes())
-			if err != nil {
-				logger.Error("%+v", err)
-				return errors.Wrapf(err, "cannot send error packet to machine %+v", serverAddr)
-			}
-		}
+		return parsedPacket, remoteAddr, nil
 	}
-	return nil
+}
+
+// bandwidthBucket returns the bucket limiting the bandwidth of a transfer,
+// nil when it is unlimited
+func (c *Client) bandwidthBucket() *ratelimit.Bucket {
+	if c.Bandwidth <= 0 {
+		return nil
+	}
+	return ratelimit.NewBucket(c.Bandwidth, ratelimit.BandwidthBurst(c.Bandwidth))
+}
+
+// transferLogger returns a logger adding the fields identifying a transfer
+func (c *Client) transferLogger(serverAddr *net.UDPAddr, filename string) *logger.Logger {
+	return c.logger().With("session", utils.NewSessionID(), "peer", serverAddr.String(), "filename", filename)
+}
+
+func (c *Client) network() transport.Network {
+	if c.Network == nil {
+		return transport.UDP{}
+	}
+	return c.Network
+}
+
+func (c *Client) logger() *logger.Logger {
+	if c.Logger == nil {
+		return logger.Default()
+	}
+	return c.Logger
 }
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/progress"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"github.com/pkg/errors"
+)
+
+// maxMulticastSilences is how many timeouts a client which is not the master
+// waits for before giving up, leaving time for the server to give the role
+// of a silent master to another client
+const maxMulticastSilences = 2*maxRetransmissions + 1
+
+// incomingPacket is a packet read by readPackets
+type incomingPacket struct {
+	packet interface{}
+	from   *net.UDPAddr
+	// group is set for the packets sent to the multicast group
+	group bool
+}
+
+// receiveMulticast receives a file sent to a multicast group following
+// RFC 2090, once the server has acknowledged the multicast option. The master
+// client acknowledges the blocks, the others only listen until the server
+// makes them master, and then acknowledge the last block they have received
+// in sequence to get the ones they have missed. It returns the final ACK,
+// which has been sent to the server
+func (c *Client) receiveMulticast(log *logger.Logger, conn net.PacketConn, serverAddr *net.UDPAddr, option packets.Multicast, blockSize int, tracker *progress.Tracker, w io.Writer) (packets.AckPacket, error) {
+	groupConn, err := c.network().ListenMulticast(option.Group)
+	if err != nil {
+		c.send(log, conn, packets.NewErrorPacket(0, "Cannot join the multicast group"), serverAddr)
+		return packets.AckPacket{}, errors.Wrapf(err, "cannot join multicast group %v", option.Group)
+	}
+	log.Info("Client has joined multicast group %v", option.Group)
+
+	incoming := make(chan incomingPacket)
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(2)
+	conn.SetReadDeadline(time.Time{})
+	go c.readPackets(log, groupConn, true, receiveBufferSize(blockSize), incoming, stop, &readers)
+	go c.readPackets(log, conn, false, packets.TftpMaxPacketSize, incoming, stop, &readers)
+	defer func() {
+		// The connection of the transfer is still used once done, so its
+		// reader is interrupted rather than closed
+		close(stop)
+		groupConn.Close()
+		conn.SetReadDeadline(time.Now())
+		readers.Wait()
+	}()
+
+	receiver := newBlockReceiver(w, blockSize)
+	master := option.Master
+	ack := func() error {
+		_, err := c.send(log, conn, packets.NewAckPacket(uint16(receiver.consecutive)), serverAddr)
+		return errors.Wrap(err, "cannot write to server")
+	}
+	if master {
+		if err := ack(); err != nil {
+			return packets.AckPacket{}, err
+		}
+	}
+
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+	var silences int
+	for !receiver.complete() {
+		select {
+		case received := <-incoming:
+			if received.group {
+				data, ok := received.packet.(packets.DataPacket)
+				// Other transfers may share the group. The server may send
+				// from another address than the one it has answered from
+				if !ok || received.from.Port != serverAddr.Port {
+					continue
+				}
+				added, err := receiver.store(data)
+				if err != nil {
+					c.send(log, conn, packets.NewErrorPacket(0, "Cannot write the received data"), serverAddr)
+					return packets.AckPacket{}, err
+				}
+				tracker.Add(added)
+				if master {
+					if err := ack(); err != nil {
+						return packets.AckPacket{}, err
+					}
+				}
+			} else {
+				if !transport.SameAddr(received.from, serverAddr) {
+					c.rejectUnknownTID(log, conn, received.from)
+					continue
+				}
+				switch packet := received.packet.(type) {
+				case packets.ErrorPacket:
+					return packets.AckPacket{}, &RemoteError{Code: packet.ErrorCode, Message: packet.ErrMsg}
+				case packets.OACKPacket:
+					update, err := packets.ParseMulticast(packet.Options[packets.OptionMulticast])
+					if err != nil || !update.Master {
+						continue
+					}
+					log.Debug("The client has become the master client, having received %d blocks in sequence", receiver.consecutive)
+					master = true
+					if err := ack(); err != nil {
+						return packets.AckPacket{}, err
+					}
+				default:
+					continue
+				}
+			}
+			silences = 0
+			resetTimer(timer, c.Timeout)
+		case <-timer.C:
+			silences++
+			if (master && silences > maxRetransmissions) || silences > maxMulticastSilences {
+				return packets.AckPacket{}, errors.Errorf("no block received from the server after block %d", receiver.consecutive)
+			}
+			if master {
+				log.Debug("No block received, acknowledging block %d again", receiver.consecutive)
+				tracker.Retransmit()
+				if err := ack(); err != nil {
+					return packets.AckPacket{}, err
+				}
+			}
+			timer.Reset(c.Timeout)
+		}
+	}
+
+	// Every client tells the server it is done, so that it does not
+	// become master afterwards
+	finalAck := packets.NewAckPacket(uint16(receiver.last))
+	if _, err := c.send(log, conn, finalAck, serverAddr); err != nil {
+		return packets.AckPacket{}, errors.Wrap(err, "cannot write to server")
+	}
+	return finalAck, nil
+}
+
+// readPackets passes the packets read from conn to incoming until stop is
+// closed, ignoring the datagrams which cannot be parsed
+func (c *Client) readPackets(log *logger.Logger, conn net.PacketConn, group bool, bufferSize int, incoming chan<- incomingPacket, stop <-chan struct{}, readers *sync.WaitGroup) {
+	defer readers.Done()
+
+	buf := make([]byte, bufferSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if isTimeout(err) {
+				select {
+				case <-stop:
+					return
+				default:
+					continue
+				}
+			}
+			return
+		}
+		remoteAddr := transport.UDPAddr(addr)
+		c.Tracer.Received(conn.LocalAddr(), remoteAddr, buf[:n])
+
+		// The data of the packet is kept by the receiver while the buffer
+		// is filled with the next datagram
+		datagram := append([]byte(nil), buf[:n]...)
+		parsedPacket, err := packets.ParsePacket(datagram)
+		if err != nil {
+			continue
+		}
+		log.With(packets.LogFields(parsedPacket)...).Debug("Packet received")
+		select {
+		case incoming <- incomingPacket{packet: parsedPacket, from: remoteAddr, group: group}:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// blockReceiver writes the blocks of a file received in any order. They are
+// written in place when the writer is a regular file, and otherwise kept
+// until the previous ones have been written
+type blockReceiver struct {
+	w         io.Writer
+	at        io.WriterAt
+	blockSize int
+	received  map[int]bool
+	pending   map[int][]byte
+	// consecutive is the last block received in sequence
+	consecutive int
+	// last is the number of the final block, zero until it is received
+	last int
+}
+
+func newBlockReceiver(w io.Writer, blockSize int) *blockReceiver {
+	receiver := &blockReceiver{
+		w:         w,
+		blockSize: blockSize,
+		received:  make(map[int]bool),
+		pending:   make(map[int][]byte),
+	}
+	receiver.at = regularFile(w)
+	return receiver
+}
+
+// regularFile returns w as an io.WriterAt if it is a regular file. Pipes and
+// terminals implement it as well, but cannot be written at an offset
+func regularFile(w io.Writer) io.WriterAt {
+	f, ok := w.(*os.File)
+	if !ok {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return f
+}
+
+// store writes a block, returning the number of bytes added to the file,
+// which is zero for a block already received
+func (r *blockReceiver) store(data packets.DataPacket) (int, error) {
+	block := int(data.BlockNumber)
+	if block == 0 || r.received[block] || (r.last != 0 && block > r.last) {
+		return 0, nil
+	}
+
+	switch {
+	case r.at != nil:
+		if _, err := r.at.WriteAt(data.Data, int64(block-1)*int64(r.blockSize)); err != nil {
+			return 0, errors.Wrap(err, "cannot write received data")
+		}
+	case block == r.consecutive+1:
+		if _, err := r.w.Write(data.Data); err != nil {
+			return 0, errors.Wrap(err, "cannot write received data")
+		}
+	default:
+		r.pending[block] = append([]byte(nil), data.Data...)
+	}
+	r.received[block] = true
+	if len(data.Data) < r.blockSize {
+		r.last = block
+	}
+
+	for r.received[r.consecutive+1] {
+		r.consecutive++
+		if content, ok := r.pending[r.consecutive]; ok {
+			delete(r.pending, r.consecutive)
+			if _, err := r.w.Write(content); err != nil {
+				return 0, errors.Wrap(err, "cannot write received data")
+			}
+		}
+	}
+
+	return len(data.Data), nil
+}
+
+// complete reports whether every block has been received
+func (r *blockReceiver) complete() bool {
+	return r.last != 0 && r.consecutive == r.last
+}
+
+// resetTimer makes the timer fire after d, discarding a pending expiration
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+// outOfOrder are the blocks of a 10 bytes file of blocks of 4 bytes, in the
+// order a client joining late receives them
+var outOfOrder = []packets.DataPacket{
+	packets.NewDataPacket(2, []byte("4567")),
+	packets.NewDataPacket(3, []byte("89")),
+	packets.NewDataPacket(2, []byte("4567")),
+	packets.NewDataPacket(1, []byte("0123")),
+}
+
+func receiveBlocks(t *testing.T, receiver *blockReceiver) {
+	t.Helper()
+	for _, block := range outOfOrder {
+		if _, err := receiver.store(block); err != nil {
+			t.Fatalf("cannot store block %d: %v", block.BlockNumber, err)
+		}
+	}
+	if !receiver.complete() {
+		t.Fatalf("the file is not complete after block %d", receiver.consecutive)
+	}
+}
+
+func TestBlockReceiverRegularFile(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "received"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	receiver := newBlockReceiver(f, 4)
+	if receiver.at == nil {
+		t.Fatal("the blocks are not written in place in a regular file")
+	}
+	receiveBlocks(t, receiver)
+
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "0123456789" {
+		t.Errorf("received %q", content)
+	}
+}
+
+func TestBlockReceiverPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	receiver := newBlockReceiver(w, 4)
+	if receiver.at != nil {
+		t.Fatal("the blocks are written at an offset in a pipe")
+	}
+	receiveBlocks(t, receiver)
+	w.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "0123456789" {
+		t.Errorf("received %q", content)
+	}
+}
+
+func TestBlockReceiverWriter(t *testing.T) {
+	var buf bytes.Buffer
+	receiveBlocks(t, newBlockReceiver(&buf, 4))
+	if buf.String() != "0123456789" {
+		t.Errorf("received %q", buf.String())
+	}
+}
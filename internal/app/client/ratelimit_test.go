@@ -0,0 +1,66 @@
+package client_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/server"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+)
+
+// TestBandwidth expects the bandwidth limit of the client to slow down its
+// transfers both ways: 5000 bytes at 10000 bytes per second take at least
+// 300ms, a tenth of a second of data going through at once
+func TestBandwidth(t *testing.T) {
+	expected := content(5000)
+	tests := []struct {
+		name     string
+		transfer func(c *client.Client, serverAddr *net.UDPAddr, received *bytes.Buffer) error
+		// received returns the content received by the other end
+		received func(t *testing.T, s *server.Server, root string, received *bytes.Buffer) []byte
+	}{
+		{
+			name: "read",
+			transfer: func(c *client.Client, serverAddr *net.UDPAddr, received *bytes.Buffer) error {
+				return c.ReceiveFile(serverAddr, "slow.bin", received)
+			},
+			received: func(t *testing.T, s *server.Server, root string, received *bytes.Buffer) []byte {
+				return received.Bytes()
+			},
+		},
+		{
+			name: "write",
+			transfer: func(c *client.Client, serverAddr *net.UDPAddr, received *bytes.Buffer) error {
+				return c.SendFile(serverAddr, "upload.bin", bytes.NewReader(expected))
+			},
+			received: func(t *testing.T, s *server.Server, root string, received *bytes.Buffer) []byte {
+				expectSession(t, s, "upload.bin", server.ResultSuccess)
+				return readFile(t, root, "upload.bin")
+			},
+		},
+	}
+	minimum := 300 * time.Millisecond
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network := transport.NewMemory(transport.Conditions{}, 1)
+			s, serverAddr, root := startServer(t, network)
+			writeFile(t, root, "slow.bin", expected)
+
+			c := newClient(network)
+			c.Bandwidth = 10000
+			var received bytes.Buffer
+			started := time.Now()
+			if err := test.transfer(&c, serverAddr, &received); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(started); elapsed < minimum {
+				t.Errorf("the transfer has taken %v, expected at least %v", elapsed, minimum)
+			}
+			expectContent(t, test.received(t, s, root, &received), expected)
+		})
+	}
+}
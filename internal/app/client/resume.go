@@ -0,0 +1,176 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/pkg/errors"
+)
+
+// resumeSuffix is appended to the path of a partial download to name the
+// file recording what it is a part of
+const resumeSuffix = ".resume"
+
+// errFileChanged is returned when the file has changed on the server since
+// the bytes of a partial download have been received
+var errFileChanged = errors.New("the file has changed on the server since the previous attempt")
+
+// resumeState identifies the file a partial download is a part of
+type resumeState struct {
+	Server string `json:"server"`
+	Remote string `json:"remote"`
+	// Size is the size of the whole file announced by the server,
+	// zero when it is unknown
+	Size int64 `json:"size"`
+}
+
+// partialDownload is the local file of a download which can be resumed. Its
+// state is kept next to it until the download succeeds
+type partialDownload struct {
+	file      *os.File
+	statePath string
+	state     resumeState
+	// offset is the number of bytes received by the previous attempts
+	offset int64
+	// answered is set once the server has told whether it resumes the read
+	answered bool
+}
+
+// openPartial opens the local file of a download, keeping the bytes received
+// by a previous attempt of the same download
+func openPartial(localPath string, serverAddr *net.UDPAddr, remoteFilePath string) (*partialDownload, error) {
+	partial := &partialDownload{
+		statePath: localPath + resumeSuffix,
+		state:     resumeState{Server: serverAddr.String(), Remote: remoteFilePath},
+	}
+
+	var previous resumeState
+	content, err := ioutil.ReadFile(partial.statePath)
+	resumable := err == nil && json.Unmarshal(content, &previous) == nil &&
+		previous.Server == partial.state.Server && previous.Remote == remoteFilePath
+
+	flags := os.O_RDWR | os.O_CREATE
+	if !resumable {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(localPath, flags, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create file to be received")
+	}
+	partial.file = f
+	if resumable {
+		offset, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "cannot read the partial download")
+		}
+		partial.offset = offset
+		partial.state.Size = previous.Size
+	}
+
+	if err := partial.save(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return partial, nil
+}
+
+func (p *partialDownload) Write(data []byte) (int, error) {
+	return p.file.Write(data)
+}
+
+// requestOptions adds the offset option to the request of a resumed download
+func (p *partialDownload) requestOptions(options map[string]string) {
+	p.answered = false
+	if p.offset > 0 {
+		options[packets.OptionOffset] = strconv.FormatInt(p.offset, 10)
+	}
+}
+
+// accept applies the answer of the server, given by the options it has
+// acknowledged, nil when it has not sent an OACK. The download starts over
+// if the server sends the file from its start, and fails with errFileChanged
+// if the size of the file is not the one of the previous attempt
+func (p *partialDownload) accept(options map[string]string, size int64) error {
+	p.answered = true
+	if p.offset > 0 {
+		_, resumed := options[packets.OptionOffset]
+		if resumed && size != 0 && p.state.Size != 0 && size != p.state.Size {
+			return p.discard(errFileChanged)
+		}
+		if !resumed {
+			if err := p.discard(nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	p.state.Size = size
+	return p.save()
+}
+
+// hashPrefix passes the bytes received by the previous attempts to w
+func (p *partialDownload) hashPrefix(w io.Writer) error {
+	if _, err := io.Copy(w, io.NewSectionReader(p.file, 0, p.offset)); err != nil {
+		return errors.Wrap(err, "cannot read the partial download")
+	}
+	return nil
+}
+
+// discard drops the bytes received by the previous attempts
+func (p *partialDownload) discard(reason error) error {
+	if err := p.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "cannot discard the partial download")
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "cannot discard the partial download")
+	}
+	p.offset = 0
+	p.state.Size = 0
+	if err := p.save(); err != nil {
+		return err
+	}
+	return reason
+}
+
+// save records the state of the download next to its file
+func (p *partialDownload) save() error {
+	content, err := json.Marshal(p.state)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode the state of the download")
+	}
+	if err := ioutil.WriteFile(p.statePath, content, 0644); err != nil {
+		return errors.Wrap(err, "cannot save the state of the download")
+	}
+	return nil
+}
+
+// finish closes the file, removing the state once the download has
+// succeeded. The partial file and its state are kept otherwise, unless
+// the file does not match its checksum: the bytes in error cannot be told
+// apart, so that the whole file is removed to be downloaded again
+func (p *partialDownload) finish(err error) error {
+	closeErr := p.file.Close()
+	if _, corrupted := err.(*ChecksumError); corrupted {
+		for _, name := range []string{p.file.Name(), p.statePath} {
+			if removeErr := os.Remove(name); removeErr != nil && !os.IsNotExist(removeErr) {
+				return errors.WithMessagef(err, "cannot remove the corrupted download: %v", removeErr)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return errors.Wrap(closeErr, "cannot save received file")
+	}
+	if err := os.Remove(p.statePath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot remove the state of the download")
+	}
+	return nil
+}
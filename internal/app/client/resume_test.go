@@ -0,0 +1,147 @@
+package client_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/server"
+	"github.com/mirkoschicchi/TFTP/internal/app/tftptest"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"github.com/pkg/errors"
+)
+
+// expectSession waits for a transfer of the file ending with the result
+// and returns it
+func expectSession(t *testing.T, s *server.Server, filename string, result string) server.SessionInfo {
+	t.Helper()
+	deadline := time.Now().Add(10 * tftptest.Timeout)
+	for time.Now().Before(deadline) {
+		for _, session := range s.CompletedSessions() {
+			if session.Filename == filename && session.Result == result {
+				return session
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no transfer of %s has ended with result %s", filename, result)
+	return server.SessionInfo{}
+}
+
+// serveFailingOnce serves the content as filename, failing after 3000 bytes
+// the first time
+func serveFailingOnce(s *server.Server, filename string, expected []byte) {
+	attempts := 0
+	s.Router.HandleReadFunc(filename, func(req *server.Request) (io.Reader, int64, error) {
+		attempts++
+		if attempts == 1 {
+			broken := io.MultiReader(bytes.NewReader(expected[:3000]), iotest.ErrReader(errors.New("disk failure")))
+			return broken, int64(len(expected)), nil
+		}
+		return bytes.NewReader(expected), int64(len(expected)), nil
+	})
+}
+
+// TestResume expects a failed download to be kept and resumed from where
+// it has stopped, the server only sending the missing bytes
+func TestResume(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	s, serverAddr, _ := startServer(t, network)
+	expected := content(5000)
+	serveFailingOnce(s, "resume.bin", expected)
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "resume.bin")
+
+	c := newClient(network)
+	c.Resume = true
+	if err := c.RequestFileTo(serverAddr, "resume.bin", localPath); err == nil {
+		t.Fatal("the first attempt has succeeded")
+	}
+	partial := readFile(t, dir, "resume.bin")
+	if len(partial) == 0 {
+		t.Fatal("nothing has been received by the first attempt")
+	}
+	expectContent(t, partial, expected[:len(partial)])
+	expectSession(t, s, "resume.bin", server.ResultFailure)
+
+	c.SHA256 = sha256Hex(expected)
+	if err := c.RequestFileTo(serverAddr, "resume.bin", localPath); err != nil {
+		t.Fatalf("second attempt: %v", err)
+	}
+	expectContent(t, readFile(t, dir, "resume.bin"), expected)
+	if _, err := os.Stat(localPath + ".resume"); !os.IsNotExist(err) {
+		t.Error("the state of the download has not been removed")
+	}
+
+	session := expectSession(t, s, "resume.bin", server.ResultSuccess)
+	if missing := int64(len(expected) - len(partial)); session.Transferred != missing {
+		t.Errorf("the server has sent %d bytes, expected the %d missing ones", session.Transferred, missing)
+	}
+}
+
+// TestResumeChecksumMismatch expects a resumed download not matching its
+// checksum to be removed along with its state
+func TestResumeChecksumMismatch(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	s, serverAddr, _ := startServer(t, network)
+	expected := content(5000)
+	serveFailingOnce(s, "resume.bin", expected)
+	localPath := filepath.Join(t.TempDir(), "resume.bin")
+
+	c := newClient(network)
+	c.Resume = true
+	if err := c.RequestFileTo(serverAddr, "resume.bin", localPath); err == nil {
+		t.Fatal("the first attempt has succeeded")
+	}
+	c.SHA256 = sha256Hex(expected[1:])
+	if _, ok := c.RequestFileTo(serverAddr, "resume.bin", localPath).(*client.ChecksumError); !ok {
+		t.Fatal("the second attempt has not failed with a checksum mismatch")
+	}
+	for _, name := range []string{localPath, localPath + ".resume"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s has not been removed", name)
+		}
+	}
+}
+
+// TestResumeDeclined expects a resumed download to start over when the
+// server ignores the offset option
+func TestResumeDeclined(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	expected := content(700)
+	listener, transfer := scriptedServer(t, network)
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "700.bin")
+	writeFile(t, dir, "700.bin", []byte("stale partial download"))
+	state := `{"server":"` + listener.Addr().String() + `","remote":"700.bin","size":700}`
+	if err := ioutil.WriteFile(localPath+".resume", []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient(network)
+	c.Resume = true
+	done := make(chan error, 1)
+	go func() { done <- c.RequestFileTo(listener.Addr(), "700.bin", localPath) }()
+
+	rrq := listener.ExpectRRQ()
+	if offset := rrq.Options[packets.OptionOffset]; offset != "22" {
+		t.Fatalf("expected the request of the bytes after 22, got offset %q", offset)
+	}
+	transfer.Remote = listener.Remote
+	for i, data := range [][]byte{expected[:512], expected[512:]} {
+		transfer.Send(packets.NewDataPacket(uint16(i+1), data))
+		transfer.ExpectAck(uint16(i + 1))
+	}
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, readFile(t, dir, "700.bin"), expected)
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"net"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/progress"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"github.com/pkg/errors"
+)
+
+// maxRetransmissions is how many times a packet is sent again
+// before giving up on a silent server
+const maxRetransmissions = 5
+
+// dallyTimeouts is how many timeouts the client dallies for, so that the
+// last block sent again by a server using the same timeout still arrives
+const dallyTimeouts = 2
+
+// isTimeout reports whether the error is caused by a read timeout
+func isTimeout(err error) bool {
+	netErr, ok := errors.Cause(err).(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// awaitAck waits for the ACK of the given block after sending packet,
+// sending it again when nothing arrives in time. Stale ACKs are ignored
+// rather than answered, which would duplicate every following packet.
+// The transfer fails if the server sends an ERROR or stays silent
+func (c *Client) awaitAck(log *logger.Logger, conn net.PacketConn, packet packets.Packet, block uint16, serverAddr *net.UDPAddr, tracker *progress.Tracker) error {
+	var retransmissions int
+	deadline := time.Now().Add(c.Timeout)
+	for {
+		parsedPacket, remoteAddr, err := c.receiveUntil(log, conn, packets.TftpMaxPacketSize, deadline)
+		if isTimeout(err) && retransmissions < maxRetransmissions {
+			retransmissions++
+			log.Debug("No ACK of block %d received, sending %v again", block, packet)
+			tracker.Retransmit()
+			if _, err := c.send(log, conn, packet, serverAddr); err != nil {
+				return errors.Wrapf(err, "cannot send %v again", packet)
+			}
+			deadline = time.Now().Add(c.Timeout)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "the ACK of block %d has not been received", block)
+		}
+		if !transport.SameAddr(remoteAddr, serverAddr) {
+			c.rejectUnknownTID(log, conn, remoteAddr)
+			continue
+		}
+
+		switch parsedPacket := parsedPacket.(type) {
+		case packets.AckPacket:
+			if parsedPacket.BlockNumber == block {
+				return nil
+			}
+			log.Debug("Ignoring stale ACK of block %d", parsedPacket.BlockNumber)
+		case packets.ErrorPacket:
+			return &RemoteError{Code: parsedPacket.ErrorCode, Message: parsedPacket.ErrMsg}
+		}
+	}
+}
+
+// startDally dallies in the background, counted by Wait. The clients
+// not created by NewClient cannot be waited for and dally before returning
+func (c *Client) startDally(log *logger.Logger, conn net.PacketConn, finalAck packets.AckPacket, serverAddr *net.UDPAddr) {
+	if c.dallies == nil {
+		c.dally(log, conn, finalAck, serverAddr)
+		return
+	}
+
+	// The copy keeps the settings of the download, which the caller may
+	// change for the next transfers while the connection dallies
+	dallying, dallies := *c, c.dallies
+	dallies.Add(1)
+	go func() {
+		defer dallies.Done()
+		dallying.dally(log, conn, finalAck, serverAddr)
+	}()
+}
+
+// dally lingers after the final ACK of a download for dallyTimeouts times
+// the timeout, acknowledging again the last block if the server sends it again
+// because the final ACK has been lost, or makes the client the master of a
+// multicast transfer. It closes the connection when done
+func (c *Client) dally(log *logger.Logger, conn net.PacketConn, finalAck packets.AckPacket, serverAddr *net.UDPAddr) {
+	defer conn.Close()
+
+	buf := make([]byte, packets.TftpMaxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(dallyTimeouts * c.Timeout))
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		remoteAddr := transport.UDPAddr(addr)
+		c.Tracer.Received(conn.LocalAddr(), remoteAddr, buf[:n])
+		if !transport.SameAddr(remoteAddr, serverAddr) {
+			continue
+		}
+
+		// Only the header is needed to recognize the last block
+		parsedPacket, err := packets.ParsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch packet := parsedPacket.(type) {
+		case packets.DataPacket:
+			if packet.BlockNumber != finalAck.BlockNumber {
+				continue
+			}
+			log.Debug("The final block has been sent again, acknowledging it again")
+		case packets.OACKPacket:
+			// A multicast server has missed the final ACK, and has made
+			// the client master to get it
+			log.Debug("The client has become the master client once done, acknowledging the final block again")
+		default:
+			continue
+		}
+		if _, err := c.send(log, conn, finalAck, serverAddr); err != nil {
+			return
+		}
+	}
+}
+
+// rejectUnknownTID answers a packet coming from another port than
+// the one of the server with an ERROR, as the transfer goes on
+func (c *Client) rejectUnknownTID(log *logger.Logger, conn net.PacketConn, addr *net.UDPAddr) {
+	log.Warning("Ignoring packet of unknown transfer ID from %+v", addr)
+	if _, err := c.send(log, conn, packets.NewErrorPacket(5, "Unknown transfer ID"), addr); err != nil {
+		log.Error("Cannot send error packet to %+v: %v", addr, err)
+	}
+}
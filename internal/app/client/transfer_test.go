@@ -0,0 +1,546 @@
+package client_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/server"
+	"github.com/mirkoschicchi/TFTP/internal/app/tftptest"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// networks are those over which the client and the server are tested
+// against each other
+var networks = []struct {
+	name       string
+	newNetwork func() transport.Network
+}{
+	{"memory", func() transport.Network { return transport.NewMemory(transport.Conditions{}, 1) }},
+	{"udp", func() transport.Network { return transport.UDP{} }},
+}
+
+// startServer serves a temporary directory on a free port of the network
+// until the test ends, and returns the server along with its address and
+// its root
+func startServer(t *testing.T, network transport.Network) (*server.Server, *net.UDPAddr, string) {
+	t.Helper()
+	conn, err := network.ListenPacket("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot find a free port: %v", err)
+	}
+	addr := transport.UDPAddr(conn.LocalAddr())
+	conn.Close()
+
+	cfg := config.Default()
+	cfg.Listen = []string{addr.String()}
+	cfg.Root = t.TempDir()
+	cfg.Timeouts.Default = tftptest.Timeout
+	cfg.Logging.Level = "error"
+
+	s := server.NewServer()
+	s.Logger = logger.New(zap.NewNop())
+	s.Network = network
+	if err := s.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("cannot start the server: %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	return s, addr, cfg.Root
+}
+
+func newClient(network transport.Network) client.Client {
+	c := client.NewClient()
+	c.Network = network
+	c.Mode = packets.Octet
+	c.Timeout = tftptest.Timeout
+	c.Logger = logger.New(zap.NewNop())
+	return c
+}
+
+// content returns size bytes covering every byte value, NUL included
+func content(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	return data
+}
+
+func writeFile(t *testing.T, dir string, name string, content []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, dir string, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// expectContent reports an error when got differs from expected
+func expectContent(t *testing.T, got []byte, expected []byte) {
+	t.Helper()
+	if !bytes.Equal(got, expected) {
+		t.Errorf("the content differs: got %d bytes, expected %d", len(got), len(expected))
+	}
+}
+
+func TestReceiveFile(t *testing.T) {
+	for _, network := range networks {
+		t.Run(network.name, func(t *testing.T) {
+			n := network.newNetwork()
+			_, serverAddr, root := startServer(t, n)
+			expected := content(1500)
+			writeFile(t, root, "read.bin", expected)
+
+			var received bytes.Buffer
+			c := newClient(n)
+			if err := c.ReceiveFile(serverAddr, "read.bin", &received); err != nil {
+				t.Fatal(err)
+			}
+			expectContent(t, received.Bytes(), expected)
+		})
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	for _, network := range networks {
+		t.Run(network.name, func(t *testing.T) {
+			n := network.newNetwork()
+			s, serverAddr, root := startServer(t, n)
+			expected := content(1500)
+
+			c := newClient(n)
+			if err := c.SendFile(serverAddr, "write.bin", bytes.NewReader(expected)); err != nil {
+				t.Fatal(err)
+			}
+			s.Stop()
+			expectContent(t, readFile(t, root, "write.bin"), expected)
+		})
+	}
+}
+
+// TestMemoryNetwork transfers a file both ways over a memory network
+// delaying the datagrams by a random amount
+func TestMemoryNetwork(t *testing.T) {
+	memory := transport.NewMemory(transport.Conditions{Delay: time.Millisecond, Jitter: 2 * time.Millisecond}, 1)
+	s, serverAddr, root := startServer(t, memory)
+	expected := content(3000)
+	writeFile(t, root, "image.bin", expected)
+
+	c := newClient(memory)
+	var received bytes.Buffer
+	if err := c.ReceiveFile(serverAddr, "image.bin", &received); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	expectContent(t, received.Bytes(), expected)
+
+	if err := c.SendFile(serverAddr, "copy.bin", bytes.NewReader(expected)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	s.Stop()
+	expectContent(t, readFile(t, root, "copy.bin"), expected)
+
+	if stats := memory.Stats(); stats.Sent == 0 || stats.Dropped != 0 {
+		t.Errorf("got %+v, expected every datagram to be delivered", stats)
+	}
+}
+
+// TestLossyNetwork transfers a file both ways over a network losing,
+// duplicating or reordering some datagrams
+func TestLossyNetwork(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions transport.Conditions
+	}{
+		{"loss", transport.Conditions{Loss: 0.05}},
+		{"duplicate", transport.Conditions{Duplicate: 0.05}},
+		{"reorder", transport.Conditions{Reorder: 0.05}},
+		{"all", transport.Conditions{Loss: 0.05, Duplicate: 0.05, Reorder: 0.05}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			memory := transport.NewMemory(test.conditions, 1)
+			s, serverAddr, root := startServer(t, memory)
+			expected := content(10000)
+			writeFile(t, root, "lossy.bin", expected)
+
+			c := newClient(memory)
+			var received bytes.Buffer
+			if err := c.ReceiveFile(serverAddr, "lossy.bin", &received); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			expectContent(t, received.Bytes(), expected)
+
+			if err := c.SendFile(serverAddr, "lossy-copy.bin", bytes.NewReader(expected)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			s.Stop()
+			expectContent(t, readFile(t, root, "lossy-copy.bin"), expected)
+		})
+	}
+}
+
+// scriptedServer returns a peer receiving the request of the client, and
+// another one acting as the transfer ID of the server
+func scriptedServer(t *testing.T, network transport.Network) (*tftptest.Peer, *tftptest.Peer) {
+	return tftptest.NewPeer(t, network, nil), tftptest.NewPeer(t, network, nil)
+}
+
+// wait returns the outcome of a transfer run in the background
+func wait(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * tftptest.Timeout):
+		t.Fatal("the transfer has not completed")
+		return nil
+	}
+}
+
+// TestReceiveCorruptedData expects a download to go on after a DATA
+// corrupted by the network, which cannot be parsed and is dropped
+func TestReceiveCorruptedData(t *testing.T) {
+	// The seed flips a bit of the opcode of the first corrupted datagram
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+
+	var received bytes.Buffer
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.ReceiveFile(listener.Addr(), "small", &received) }()
+
+	listener.ExpectRRQ()
+	transfer.Remote = listener.Remote
+	network.SetConditions(transport.Conditions{Corrupt: 1})
+	transfer.Send(packets.NewDataPacket(1, []byte("ab")))
+	network.SetConditions(transport.Conditions{})
+	transfer.Send(packets.NewDataPacket(1, []byte("ab")))
+	transfer.ExpectAck(1)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, received.Bytes(), []byte("ab"))
+	if corrupted := network.Stats().Corrupted; corrupted != 1 {
+		t.Errorf("the network has corrupted %d datagrams, expected 1", corrupted)
+	}
+}
+
+func TestReceiveZeroLengthFile(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+
+	var received bytes.Buffer
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.ReceiveFile(listener.Addr(), "empty", &received) }()
+
+	listener.ExpectRRQ()
+	transfer.Remote = listener.Remote
+	transfer.Send(packets.NewDataPacket(1, nil))
+	transfer.ExpectAck(1)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, received.Bytes(), nil)
+}
+
+// TestReceiveDuplicateData expects a duplicate DATA to be acknowledged
+// again without being written twice
+func TestReceiveDuplicateData(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+	expected := content(600)
+
+	var received bytes.Buffer
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.ReceiveFile(listener.Addr(), "600.bin", &received) }()
+
+	listener.ExpectRRQ()
+	transfer.Remote = listener.Remote
+	for _, step := range []struct {
+		block uint16
+		data  []byte
+	}{{1, expected[:512]}, {1, expected[:512]}, {2, expected[512:]}} {
+		transfer.Send(packets.NewDataPacket(step.block, step.data))
+		transfer.ExpectAck(step.block)
+	}
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, received.Bytes(), expected)
+}
+
+// TestReceiveLostFinalAck expects the client to dally after the final ACK
+// of a download, acknowledging the last block again when it is sent again
+func TestReceiveLostFinalAck(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+	expected := content(100)
+
+	var received bytes.Buffer
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.ReceiveFile(listener.Addr(), "small.bin", &received) }()
+
+	listener.ExpectRRQ()
+	transfer.Remote = listener.Remote
+	transfer.Send(packets.NewDataPacket(1, expected))
+	transfer.ExpectAck(1)
+	// The final ACK is considered lost: send the last block again
+	transfer.Send(packets.NewDataPacket(1, expected))
+	transfer.ExpectAck(1)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, received.Bytes(), expected)
+}
+
+// TestWaitDally drops the final ACK of a download and expects Wait to
+// return once it has been sent again, the server ending the transfer
+// successfully
+func TestWaitDally(t *testing.T) {
+	dropped := false
+	memory := transport.NewMemory(transport.Conditions{Drop: func(_ *net.UDPAddr, _ *net.UDPAddr, datagram []byte) bool {
+		packet, err := packets.ParsePacket(datagram)
+		if _, ack := packet.(packets.AckPacket); err != nil || !ack || dropped {
+			return false
+		}
+		dropped = true
+		return true
+	}}, 1)
+	s, serverAddr, root := startServer(t, memory)
+	expected := content(100)
+	writeFile(t, root, "small.bin", expected)
+
+	c := newClient(memory)
+	var received bytes.Buffer
+	if err := c.ReceiveFile(serverAddr, "small.bin", &received); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, received.Bytes(), expected)
+	c.Wait()
+
+	sessions := s.CompletedSessions()
+	if len(sessions) != 1 || sessions[0].Result != server.ResultSuccess || sessions[0].Retransmits != 1 {
+		t.Errorf("the server has completed the sessions %+v, expected a success after sending the block again", sessions)
+	}
+}
+
+// TestSendMissingFinalAck expects an upload to fail when the last block is
+// never acknowledged, even if a stale ACK arrives
+func TestSendMissingFinalAck(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.SendFile(listener.Addr(), "small.bin", bytes.NewReader(content(100))) }()
+
+	listener.ExpectWRQ()
+	transfer.Remote = listener.Remote
+	transfer.Send(packets.NewAckPacket(0))
+	transfer.ExpectData(1, 100)
+	transfer.Send(packets.NewAckPacket(0))
+	if err := wait(t, done); err == nil {
+		t.Fatal("the upload has succeeded without the final ACK")
+	}
+}
+
+// TestSendLastBlock expects the client to end an upload with a DATA
+// shorter than the block size, which is empty when the size of the file
+// is a multiple of it
+func TestSendLastBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		blocks []int
+	}{
+		{"zero-length", 0, []int{0}},
+		{"multiple of the block size", 2 * packets.DefaultBlockSize, []int{512, 512, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network := transport.NewMemory(transport.Conditions{}, 1)
+			listener, transfer := scriptedServer(t, network)
+			expected := content(test.size)
+
+			c := newClient(network)
+			done := make(chan error, 1)
+			go func() { done <- c.SendFile(listener.Addr(), "file.bin", bytes.NewReader(expected)) }()
+
+			listener.ExpectWRQ()
+			// The options are ignored, as allowed by RFC 2347
+			transfer.Remote = listener.Remote
+			transfer.Send(packets.NewAckPacket(0))
+
+			var received []byte
+			for block, size := range test.blocks {
+				data := transfer.ExpectData(uint16(block+1), size)
+				received = append(received, data.Data...)
+				transfer.Send(packets.NewAckPacket(uint16(block + 1)))
+			}
+			if err := wait(t, done); err != nil {
+				t.Fatal(err)
+			}
+			expectContent(t, received, expected)
+		})
+	}
+}
+
+// TestSendStream expects an upload to read its content one block at a time,
+// without the tsize option when its size is not known
+func TestSendStream(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+	expected := content(600)
+	r, w := io.Pipe()
+
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.SendFile(listener.Addr(), "stream.bin", r) }()
+
+	// Nothing has been written to the pipe yet
+	request := listener.ExpectWRQ()
+	if _, ok := request.Options[packets.OptionTsize]; ok {
+		t.Errorf("the tsize option %q has been requested for a content of unknown size", request.Options[packets.OptionTsize])
+	}
+	transfer.Remote = listener.Remote
+	transfer.Send(packets.NewAckPacket(0))
+	w.Write(expected[:512])
+	transfer.ExpectData(1, 512)
+	transfer.Send(packets.NewAckPacket(1))
+	w.Write(expected[512:])
+	w.Close()
+	transfer.ExpectData(2, 88)
+	transfer.Send(packets.NewAckPacket(2))
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSendReadError expects an upload whose content cannot be read to be
+// aborted with an ERROR
+func TestSendReadError(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+	r, w := io.Pipe()
+
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.SendFile(listener.Addr(), "broken.bin", r) }()
+
+	listener.ExpectWRQ()
+	transfer.Remote = listener.Remote
+	transfer.Send(packets.NewAckPacket(0))
+	w.Write(content(512))
+	transfer.ExpectData(1, 512)
+	transfer.Send(packets.NewAckPacket(1))
+	w.CloseWithError(errors.New("input/output error"))
+	transfer.ExpectError(0)
+	if err := wait(t, done); err == nil || !strings.Contains(err.Error(), "input/output error") {
+		t.Errorf("expected the read error, got %v", err)
+	}
+}
+
+// TestServerError expects the client to return the ERROR of the server
+func TestServerError(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.ReceiveFile(listener.Addr(), "missing", &bytes.Buffer{}) }()
+
+	listener.ExpectRRQ()
+	transfer.Remote = listener.Remote
+	transfer.Send(packets.NewErrorPacket(1, "File not found"))
+
+	err := wait(t, done)
+	remoteErr, ok := err.(*client.RemoteError)
+	if !ok {
+		t.Fatalf("expected the ERROR of the server, got %v", err)
+	}
+	if remoteErr.Code != 1 {
+		t.Errorf("expected error code 1, got %d", remoteErr.Code)
+	}
+}
+
+// TestSendStaleAck expects a stale ACK to be ignored during an upload, the
+// current block being sent again when its ACK does not arrive in time
+func TestSendStaleAck(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+	expected := content(600)
+
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.SendFile(listener.Addr(), "600.bin", bytes.NewReader(expected)) }()
+
+	listener.ExpectWRQ()
+	transfer.Remote = listener.Remote
+	transfer.Send(packets.NewAckPacket(0))
+	transfer.ExpectData(1, 512)
+	transfer.Send(packets.NewAckPacket(0))
+	// The stale ACK is ignored: DATA 1 is only sent again after the timeout
+	sent := time.Now()
+	transfer.ExpectData(1, 512)
+	if time.Since(sent) < tftptest.Timeout/2 {
+		t.Fatal("DATA 1 has been sent again in answer to the stale ACK")
+	}
+	transfer.Send(packets.NewAckPacket(1))
+	transfer.ExpectData(2, 88)
+	transfer.Send(packets.NewAckPacket(2))
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSendServerError expects the client to stop an upload aborted by the
+// server, returning its ERROR
+func TestSendServerError(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener, transfer := scriptedServer(t, network)
+
+	c := newClient(network)
+	done := make(chan error, 1)
+	go func() { done <- c.SendFile(listener.Addr(), "full.bin", bytes.NewReader(content(1100))) }()
+
+	listener.ExpectWRQ()
+	transfer.Remote = listener.Remote
+	transfer.Send(packets.NewAckPacket(0))
+	transfer.ExpectData(1, 512)
+	transfer.Send(packets.NewErrorPacket(3, "Disk full"))
+	transfer.ExpectNothing()
+
+	err := wait(t, done)
+	if remoteErr, ok := err.(*client.RemoteError); !ok || remoteErr.Code != 3 {
+		t.Errorf("expected the ERROR of the server, got %v", err)
+	}
+}
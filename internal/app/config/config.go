@@ -0,0 +1,476 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	MinBlockSize = 8
+	MaxBlockSize = 65464
+)
+
+const (
+	// ProfilePXE tunes the server for network boots
+	ProfilePXE = "pxe"
+	// PXEMaxBlockSize is the largest block fitting an Ethernet frame, as
+	// some PXE ROMs cannot reassemble fragmented datagrams
+	PXEMaxBlockSize = 1468
+)
+
+// Config holds the whole configuration of the server
+type Config struct {
+	// Profile applies the settings suited to a kind of clients on top of the
+	// others. With "pxe", paths are matched regardless of case, blksize is
+	// capped to PXEMaxBlockSize and missing pxelinux.cfg files fall back as
+	// PXELINUX does
+	Profile string `yaml:"profile"`
+	// Listen is the list of UDP addresses the server listens on
+	Listen []string `yaml:"listen"`
+	// SinglePort makes the sessions use the listening port instead of a
+	// random one, for the clients behind NAT devices and firewalls which
+	// only let the replies from the port they have sent the request to in
+	SinglePort bool `yaml:"single_port"`
+	// Root is the directory files are served from and written to
+	Root string `yaml:"root"`
+	// ACL is the ordered list of rules matching the clients. When it is
+	// empty every client can read and write, otherwise the first rule
+	// matching the client address applies and unmatched clients are refused
+	ACL      []Rule   `yaml:"acl"`
+	Limits   Limits   `yaml:"limits"`
+	Timeouts Timeouts `yaml:"timeouts"`
+	// Options is the list of options the server accepts to negotiate
+	Options []string `yaml:"options"`
+	Logging Logging  `yaml:"logging"`
+	Metrics Metrics  `yaml:"metrics"`
+	Admin   Admin    `yaml:"admin"`
+	Audit   Audit    `yaml:"audit"`
+	// Hooks are the commands run once an upload has been stored
+	Hooks     []Hook    `yaml:"hooks"`
+	Paths     Paths     `yaml:"paths"`
+	Templates Templates `yaml:"templates"`
+	Multicast Multicast `yaml:"multicast"`
+	Checksums Checksums `yaml:"checksums"`
+	// Quotas bound the size of the directories receiving uploads
+	Quotas []Quota `yaml:"quotas"`
+}
+
+// Rule grants permissions to the clients of a network
+type Rule struct {
+	Network string `yaml:"network"`
+	Read    bool   `yaml:"read"`
+	Write   bool   `yaml:"write"`
+
+	network *net.IPNet
+}
+
+type Limits struct {
+	// MaxSessions is the number of concurrent transfers, zero means unlimited
+	MaxSessions int `yaml:"max_sessions"`
+	// MaxBlockSize caps the size negotiated with the blksize option
+	MaxBlockSize int `yaml:"max_block_size"`
+	// MaxBandwidth is the number of bytes per second sent and received by
+	// every session together, zero means unlimited
+	MaxBandwidth int64 `yaml:"max_bandwidth"`
+	// MaxClientBandwidth is the number of bytes per second sent and received
+	// by the sessions of a client IP address, zero means unlimited
+	MaxClientBandwidth int64 `yaml:"max_client_bandwidth"`
+	// MaxSessionBandwidth is the number of bytes per second sent or received
+	// by each session, zero means unlimited
+	MaxSessionBandwidth int64 `yaml:"max_session_bandwidth"`
+	// MaxRequestsPerSecond is the number of requests accepted every second,
+	// the others being dropped, zero means unlimited
+	MaxRequestsPerSecond int64 `yaml:"max_requests_per_second"`
+	// MaxUploadSize is the number of bytes an upload can hold, zero means
+	// unlimited
+	MaxUploadSize int64 `yaml:"max_upload_size"`
+	// MinFreeSpace is the number of bytes which must remain free on the disk
+	// of the root directory for uploads to be accepted, zero disables the check
+	MinFreeSpace int64 `yaml:"min_free_space"`
+}
+
+type Timeouts struct {
+	// Default is how long to wait for a packet when no timeout has been negotiated
+	Default time.Duration `yaml:"default"`
+	// Max caps the value negotiated with the timeout option
+	Max time.Duration `yaml:"max"`
+}
+
+type Logging struct {
+	// Level is one of debug, info, warn or error. When empty the
+	// level given on the command line is kept
+	Level string `yaml:"level"`
+	// Format is either json or console. When empty the format given on
+	// the command line is kept. It is only read when the server starts
+	Format string `yaml:"format"`
+}
+
+type Metrics struct {
+	// Listen is the HTTP address exposing the /metrics endpoint. Metrics are
+	// disabled when it is empty. It is only read when the server starts
+	Listen string `yaml:"listen"`
+}
+
+type Admin struct {
+	// Listen is the HTTP address of the admin API. The API is disabled when
+	// it is empty and it should only be bound to a local address. It is only
+	// read when the server starts
+	Listen string `yaml:"listen"`
+}
+
+type Audit struct {
+	// Path is the file receiving a JSON line for every completed transfer.
+	// The audit log is disabled when it is empty. It is only read when the
+	// server starts
+	Path string `yaml:"path"`
+	// MaxSizeMB is the size in megabytes beyond which the file is rotated,
+	// zero disables the rotation
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// MaxBackups is the number of rotated files kept
+	MaxBackups int `yaml:"max_backups"`
+}
+
+// Hook runs a command once a file matching Pattern has been uploaded.
+// The command runs in the root directory with the TFTP_PATH, TFTP_FILENAME,
+// TFTP_MODE, TFTP_CLIENT_IP, TFTP_CLIENT_PORT, TFTP_SIZE and TFTP_SHA256
+// environment variables describing the upload
+type Hook struct {
+	// Pattern is matched against the uploaded path as done by path.Match,
+	// a pattern ending with a slash matching a whole directory
+	Pattern string `yaml:"pattern"`
+	// Command is the program to run followed by its arguments
+	Command []string `yaml:"command"`
+	// Timeout is how long the command can run before being killed
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// defaultHookTimeout applies to the hooks having no timeout
+const defaultHookTimeout = time.Minute
+
+type Paths struct {
+	// NormalizeBackslashes replaces the backslashes of the requested
+	// paths with slashes, as sent by Windows clients
+	NormalizeBackslashes bool `yaml:"normalize_backslashes"`
+	// CaseInsensitive looks for a file differing only by case when the
+	// requested file does not exist in the root directory
+	CaseInsensitive bool `yaml:"case_insensitive"`
+	// Rewrites is the ordered list of rules applied to the requested
+	// paths, the first rule matching the path applies
+	Rewrites []Rewrite `yaml:"rewrites"`
+}
+
+// Rewrite replaces the parts of a requested path matching a regular
+// expression, which is usually anchored to replace the whole path
+type Rewrite struct {
+	Match string `yaml:"match"`
+	// Replace is the new path, where $1 or ${name} stand for the
+	// groups captured by Match
+	Replace string `yaml:"replace"`
+
+	regexp *regexp.Regexp
+}
+
+type Templates struct {
+	// Suffix enables the templates: a requested file missing from the root
+	// directory is rendered from the file having the same path followed by
+	// the suffix, such as boot.cfg.tmpl for boot.cfg. Templates are disabled
+	// when it is empty
+	Suffix string `yaml:"suffix"`
+	// Inventory is an optional CSV or JSON file giving the variables of the
+	// clients, identified by their "ip" or "mac" column
+	Inventory string `yaml:"inventory"`
+}
+
+// Multicast configures the multicast option of RFC 2090, which is only
+// negotiated when it is listed in the options
+type Multicast struct {
+	// Group is the IPv4 multicast address and port the DATA packets of
+	// the multicast transfers are sent to
+	Group string `yaml:"group"`
+
+	group *net.UDPAddr
+}
+
+// Quota bounds the total size of the files of a directory receiving uploads.
+// The uploads stored by the server land in the root directory, so that the
+// quota of a subdirectory only bounds the uploads of write handlers
+type Quota struct {
+	// Directory is relative to the root directory, unless it is absolute
+	Directory string `yaml:"directory"`
+	// MaxSize is the number of bytes the files of the directory can hold
+	MaxSize int64 `yaml:"max_size"`
+}
+
+// Checksums publishes the SHA-256 of the files, so that the clients can
+// verify what they have received. The sha256 option gives it in the OACK
+// when it is listed in the options
+type Checksums struct {
+	// Files serves a missing <file>.sha256 with the digest of <file>,
+	// in the format of sha256sum
+	Files bool `yaml:"files"`
+	// Uploads writes the digest of the uploads stored in a file next to
+	// them, as <file>.sha256
+	Uploads bool `yaml:"uploads"`
+}
+
+// Default returns the configuration used when no file is given
+func Default() *Config {
+	return &Config{
+		Listen: []string{"127.0.0.1:69"},
+		Root:   ".",
+		Limits: Limits{MaxBlockSize: MaxBlockSize},
+		Timeouts: Timeouts{
+			Default: 5 * time.Second,
+			Max:     255 * time.Second,
+		},
+		Options: []string{packets.OptionBlksize, packets.OptionTsize, packets.OptionTimeout, packets.OptionOffset},
+		Audit:   Audit{MaxSizeMB: 100, MaxBackups: 5},
+		Paths:   Paths{NormalizeBackslashes: true},
+	}
+}
+
+// Load reads and validates the configuration file at path. Settings
+// missing from the file keep the value returned by Default
+func Load(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read configuration file %s", path)
+	}
+
+	cfg := Default()
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse configuration file %s", path)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid configuration file %s", path)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks every setting and prepares the ACL rules for matching
+func (c *Config) Validate() error {
+	if len(c.Listen) == 0 {
+		return errors.New("listen: at least one address is required")
+	}
+	for i, address := range c.Listen {
+		if _, err := net.ResolveUDPAddr("udp4", address); err != nil {
+			return errors.Errorf("listen[%d]: invalid address %q: %v", i, address, err)
+		}
+	}
+
+	info, err := os.Stat(c.Root)
+	if err != nil {
+		return errors.Errorf("root: %v", err)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("root: %s is not a directory", c.Root)
+	}
+
+	switch c.Profile {
+	case "":
+	case ProfilePXE:
+		c.Paths.NormalizeBackslashes = true
+		c.Paths.CaseInsensitive = true
+		if c.Limits.MaxBlockSize > PXEMaxBlockSize {
+			c.Limits.MaxBlockSize = PXEMaxBlockSize
+		}
+	default:
+		return errors.Errorf("profile: unknown profile %q", c.Profile)
+	}
+
+	for i := range c.ACL {
+		rule := &c.ACL[i]
+		network := rule.Network
+		if !strings.Contains(network, "/") {
+			network += "/32"
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return errors.Errorf("acl[%d].network: invalid network %q", i, rule.Network)
+		}
+		rule.network = ipNet
+	}
+
+	if c.Limits.MaxSessions < 0 {
+		return errors.Errorf("limits.max_sessions: must not be negative, got %d", c.Limits.MaxSessions)
+	}
+	for _, limit := range []struct {
+		name  string
+		value int64
+	}{
+		{"max_bandwidth", c.Limits.MaxBandwidth},
+		{"max_client_bandwidth", c.Limits.MaxClientBandwidth},
+		{"max_session_bandwidth", c.Limits.MaxSessionBandwidth},
+		{"max_requests_per_second", c.Limits.MaxRequestsPerSecond},
+		{"max_upload_size", c.Limits.MaxUploadSize},
+		{"min_free_space", c.Limits.MinFreeSpace},
+	} {
+		if limit.value < 0 {
+			return errors.Errorf("limits.%s: must not be negative, got %d", limit.name, limit.value)
+		}
+	}
+	if c.Limits.MaxBlockSize < MinBlockSize || c.Limits.MaxBlockSize > MaxBlockSize {
+		return errors.Errorf("limits.max_block_size: must be between %d and %d, got %d", MinBlockSize, MaxBlockSize, c.Limits.MaxBlockSize)
+	}
+
+	if c.Timeouts.Default < time.Second {
+		return errors.Errorf("timeouts.default: must be at least 1s, got %v", c.Timeouts.Default)
+	}
+	if c.Timeouts.Max < time.Second || c.Timeouts.Max > 255*time.Second {
+		return errors.Errorf("timeouts.max: must be between 1s and 255s, got %v", c.Timeouts.Max)
+	}
+
+	for i, option := range c.Options {
+		switch option {
+		case packets.OptionBlksize, packets.OptionTsize, packets.OptionTimeout, packets.OptionOffset, packets.OptionSHA256, packets.OptionMulticast:
+		default:
+			return errors.Errorf("options[%d]: unknown option %q", i, option)
+		}
+	}
+
+	c.Multicast.group = nil
+	if c.Multicast.Group != "" {
+		group, err := net.ResolveUDPAddr("udp4", c.Multicast.Group)
+		if err != nil || !group.IP.IsMulticast() || group.Port == 0 {
+			return errors.Errorf("multicast.group: invalid multicast address %q", c.Multicast.Group)
+		}
+		c.Multicast.group = group
+	}
+	if c.OptionAllowed(packets.OptionMulticast) && c.Multicast.group == nil {
+		return errors.New("options: the multicast option requires multicast.group")
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return errors.Errorf("metrics.listen: invalid address %q: %v", c.Metrics.Listen, err)
+		}
+	}
+
+	if c.Admin.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			return errors.Errorf("admin.listen: invalid address %q: %v", c.Admin.Listen, err)
+		}
+	}
+
+	if c.Audit.MaxSizeMB < 0 {
+		return errors.Errorf("audit.max_size_mb: must not be negative, got %d", c.Audit.MaxSizeMB)
+	}
+	if c.Audit.MaxBackups < 0 {
+		return errors.Errorf("audit.max_backups: must not be negative, got %d", c.Audit.MaxBackups)
+	}
+
+	for i := range c.Hooks {
+		hook := &c.Hooks[i]
+		if _, err := path.Match(hook.Pattern, ""); err != nil || hook.Pattern == "" {
+			return errors.Errorf("hooks[%d].pattern: invalid pattern %q", i, hook.Pattern)
+		}
+		if len(hook.Command) == 0 {
+			return errors.Errorf("hooks[%d].command: a command is required", i)
+		}
+		if hook.Timeout < 0 {
+			return errors.Errorf("hooks[%d].timeout: must not be negative, got %v", i, hook.Timeout)
+		}
+		if hook.Timeout == 0 {
+			hook.Timeout = defaultHookTimeout
+		}
+	}
+
+	for i, quota := range c.Quotas {
+		if quota.Directory == "" {
+			return errors.Errorf("quotas[%d].directory: a directory is required", i)
+		}
+		if quota.MaxSize <= 0 {
+			return errors.Errorf("quotas[%d].max_size: must be positive, got %d", i, quota.MaxSize)
+		}
+	}
+
+	for i := range c.Paths.Rewrites {
+		rewrite := &c.Paths.Rewrites[i]
+		re, err := regexp.Compile(rewrite.Match)
+		if err != nil {
+			return errors.Errorf("paths.rewrites[%d].match: invalid regular expression %q: %v", i, rewrite.Match, err)
+		}
+		rewrite.regexp = re
+	}
+
+	if c.Templates.Inventory != "" && c.Templates.Suffix == "" {
+		return errors.New("templates.inventory: the inventory requires templates.suffix")
+	}
+
+	switch c.Logging.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return errors.Errorf("logging.level: unknown level %q", c.Logging.Level)
+	}
+	switch c.Logging.Format {
+	case "", "json", "console":
+	default:
+		return errors.Errorf("logging.format: unknown format %q", c.Logging.Format)
+	}
+
+	return nil
+}
+
+// Permissions returns whether the client having the given IP address
+// is allowed to read and to write files
+func (c *Config) Permissions(ip net.IP) (read bool, write bool) {
+	if len(c.ACL) == 0 {
+		return true, true
+	}
+	for _, rule := range c.ACL {
+		if rule.network != nil && rule.network.Contains(ip) {
+			return rule.Read, rule.Write
+		}
+	}
+
+	return false, false
+}
+
+// RewritePath returns the path to look up for the requested one, after the
+// normalization of the backslashes and the first matching rewrite rule
+func (c *Config) RewritePath(filename string) string {
+	if c.Paths.NormalizeBackslashes {
+		filename = strings.ReplaceAll(filename, "\\", "/")
+	}
+	for _, rewrite := range c.Paths.Rewrites {
+		if rewrite.regexp != nil && rewrite.regexp.MatchString(filename) {
+			return rewrite.regexp.ReplaceAllString(filename, rewrite.Replace)
+		}
+	}
+
+	return filename
+}
+
+// MulticastGroup returns the address the DATA packets of the multicast
+// transfers are sent to, or nil when the multicast option is not allowed
+func (c *Config) MulticastGroup() *net.UDPAddr {
+	if !c.OptionAllowed(packets.OptionMulticast) {
+		return nil
+	}
+	return c.Multicast.group
+}
+
+// OptionAllowed reports whether the server accepts to negotiate the option
+func (c *Config) OptionAllowed(name string) bool {
+	for _, option := range c.Options {
+		if option == name {
+			return true
+		}
+	}
+
+	return false
+}
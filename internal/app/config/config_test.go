@@ -0,0 +1,179 @@
+package config
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoad loads files whose root directory is ROOT, expecting an error
+// holding err or the settings checked by check
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+		check   func(cfg *Config) bool
+	}{
+		{
+			name:    "defaults",
+			content: "root: ROOT\n",
+			check: func(cfg *Config) bool {
+				return cfg.Listen[0] == "127.0.0.1:69" && cfg.Timeouts.Default == 5*time.Second && len(cfg.Options) == 4
+			},
+		},
+		{
+			name:    "settings",
+			content: "root: ROOT\nlisten: [\"0.0.0.0:69\", \"127.0.0.1:1069\"]\nlimits:\n  max_sessions: 10\ntimeouts:\n  default: 2s\noptions: [blksize]\n",
+			check: func(cfg *Config) bool {
+				return len(cfg.Listen) == 2 && cfg.Limits.MaxSessions == 10 && cfg.Timeouts.Default == 2*time.Second &&
+					cfg.OptionAllowed("blksize") && !cfg.OptionAllowed("tsize")
+			},
+		},
+		{
+			name:    "hook",
+			content: "root: ROOT\nhooks:\n  - pattern: \"*.cfg\"\n    command: [\"true\"]\n",
+			check: func(cfg *Config) bool {
+				return len(cfg.Hooks) == 1 && cfg.Hooks[0].Pattern == "*.cfg" && cfg.Hooks[0].Timeout == time.Minute
+			},
+		},
+		{
+			name:    "pxe profile",
+			content: "root: ROOT\nprofile: pxe\n",
+			check: func(cfg *Config) bool {
+				return cfg.Paths.CaseInsensitive && cfg.Paths.NormalizeBackslashes && cfg.Limits.MaxBlockSize == PXEMaxBlockSize
+			},
+		},
+		{name: "unknown setting", content: "root: ROOT\nroots: ROOT\n", err: "field roots not found"},
+		{name: "not YAML", content: "root: [ROOT", err: "cannot parse"},
+		{name: "missing root", content: "root: ROOT/missing\n", err: "root:"},
+		{name: "no listen address", content: "root: ROOT\nlisten: []\n", err: "listen: at least one address"},
+		{name: "invalid listen address", content: "root: ROOT\nlisten: [\"localhost:port\"]\n", err: "listen[0]"},
+		{name: "invalid network", content: "root: ROOT\nacl:\n  - network: 10.0.0.0/33\n", err: "acl[0].network"},
+		{name: "negative sessions", content: "root: ROOT\nlimits:\n  max_sessions: -1\n", err: "limits.max_sessions"},
+		{name: "negative bandwidth", content: "root: ROOT\nlimits:\n  max_client_bandwidth: -1\n", err: "limits.max_client_bandwidth"},
+		{name: "block size", content: "root: ROOT\nlimits:\n  max_block_size: 4\n", err: "limits.max_block_size"},
+		{name: "default timeout", content: "root: ROOT\ntimeouts:\n  default: 500ms\n", err: "timeouts.default"},
+		{name: "maximum timeout", content: "root: ROOT\ntimeouts:\n  max: 256s\n", err: "timeouts.max"},
+		{name: "unknown option", content: "root: ROOT\noptions: [windowsize]\n", err: `unknown option "windowsize"`},
+		{name: "hook pattern", content: "root: ROOT\nhooks:\n  - pattern: \"[\"\n    command: [\"true\"]\n", err: "hooks[0].pattern"},
+		{name: "hook command", content: "root: ROOT\nhooks:\n  - pattern: \"*.cfg\"\n", err: "hooks[0].command"},
+		{name: "unknown profile", content: "root: ROOT\nprofile: uefi\n", err: `unknown profile "uefi"`},
+		{name: "multicast group", content: "root: ROOT\nmulticast:\n  group: 10.0.0.1:1758\n", err: "multicast.group"},
+		{name: "multicast without group", content: "root: ROOT\noptions: [multicast]\n", err: "requires multicast.group"},
+		{name: "negative upload size", content: "root: ROOT\nlimits:\n  max_upload_size: -1\n", err: "limits.max_upload_size"},
+		{name: "quota directory", content: "root: ROOT\nquotas:\n  - max_size: 1000\n", err: "quotas[0].directory"},
+		{name: "quota size", content: "root: ROOT\nquotas:\n  - directory: uploads\n", err: "quotas[0].max_size"},
+		{name: "logging level", content: "root: ROOT\nlogging:\n  level: verbose\n", err: "logging.level"},
+		{name: "logging format", content: "root: ROOT\nlogging:\n  format: xml\n", err: "logging.format"},
+	}
+
+	for _, test := range tests {
+		root := t.TempDir()
+		path := filepath.Join(root, "tftp.yaml")
+		if err := ioutil.WriteFile(path, []byte(strings.Replace(test.content, "ROOT", root, -1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := Load(path)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		case test.check != nil && !test.check(cfg):
+			t.Errorf("%s: the settings have not been loaded: %+v", test.name, cfg)
+		}
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("a missing file has been loaded")
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	cfg := Default()
+	cfg.Root = t.TempDir()
+	cfg.ACL = []Rule{
+		{Network: "10.0.0.1", Read: true, Write: true},
+		{Network: "10.0.0.0/8", Read: true},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip    string
+		read  bool
+		write bool
+	}{
+		{"10.0.0.1", true, true},
+		{"10.1.2.3", true, false},
+		{"192.168.1.1", false, false},
+	}
+	for _, test := range tests {
+		read, write := cfg.Permissions(net.ParseIP(test.ip))
+		if read != test.read || write != test.write {
+			t.Errorf("%s may read %v and write %v, expected %v and %v", test.ip, read, write, test.read, test.write)
+		}
+	}
+
+	if read, write := Default().Permissions(net.ParseIP("192.168.1.1")); !read || !write {
+		t.Error("the clients are restricted without ACL")
+	}
+}
+
+// TestLoadExample expects the example configuration to be valid
+func TestLoadExample(t *testing.T) {
+	if _, err := Load(filepath.Join("..", "..", "..", "configs", "server.yaml")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	cfg := Default()
+	cfg.Root = t.TempDir()
+	cfg.Paths.Rewrites = []Rewrite{
+		{Match: `^pxelinux\.cfg/01-([0-9a-f-]+)$`, Replace: "hosts/$1.cfg"},
+		{Match: `^pxelinux\.cfg/.*$`, Replace: "hosts/default.cfg"},
+		{Match: `^(?P<name>[a-z]+)\.img$`, Replace: "images/${name}/latest.img"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		requested string
+		expected  string
+	}{
+		{"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", "hosts/aa-bb-cc-dd-ee-ff.cfg"},
+		{"pxelinux.cfg/C0A8", "hosts/default.cfg"},
+		{"debian.img", "images/debian/latest.img"},
+		{`\Boot\x86\wdsnbp.com`, "/Boot/x86/wdsnbp.com"},
+		{"kernel", "kernel"},
+	}
+	for _, test := range tests {
+		if rewritten := cfg.RewritePath(test.requested); rewritten != test.expected {
+			t.Errorf("%s has been rewritten to %s, expected %s", test.requested, rewritten, test.expected)
+		}
+	}
+
+	cfg.Paths.NormalizeBackslashes = false
+	if rewritten := cfg.RewritePath(`boot\pxe`); rewritten != `boot\pxe` {
+		t.Errorf("the backslashes have been replaced in %s", rewritten)
+	}
+}
+
+func TestInvalidRewrite(t *testing.T) {
+	cfg := Default()
+	cfg.Root = t.TempDir()
+	cfg.Paths.Rewrites = []Rewrite{{Match: "(", Replace: "x"}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("an invalid regular expression has been accepted")
+	}
+}
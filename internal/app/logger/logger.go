@@ -1,37 +1,188 @@
 package logger
 
 import (
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Logger writes printf-style messages enriched with structured fields.
+// It wraps a zap logger, so that callers can inject their own
+type Logger struct {
+	sugar *zap.SugaredLogger
+	// level drops the messages below it before they reach the zap logger.
+	// It is shared with the loggers returned by With
+	level zap.AtomicLevel
+}
+
 var zapLog *zap.Logger
+var level zap.AtomicLevel
+var defaultLogger *Logger
 
 func init() {
-	var err error
-	config := zap.NewProductionConfig()
+	level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	if err := build(FormatJSON); err != nil {
+		panic(err)
+	}
+}
+
+func build(format string) error {
+	var config zap.Config
+	var enccoderConfig zapcore.EncoderConfig
+	switch format {
+	case FormatJSON:
+		config = zap.NewProductionConfig()
+		enccoderConfig = zap.NewProductionEncoderConfig()
+	case FormatConsole:
+		config = zap.NewDevelopmentConfig()
+		enccoderConfig = zap.NewDevelopmentEncoderConfig()
+		enccoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	default:
+		return errors.Errorf("unknown log format %q, it must be either json or console", format)
+	}
+	// The messages are filtered by the level of each Logger
 	config.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
-	enccoderConfig := zap.NewProductionEncoderConfig()
 	enccoderConfig.StacktraceKey = "" // to hide stacktrace info
 	enccoderConfig.EncodeTime = zapcore.RFC3339TimeEncoder
 	config.EncoderConfig = enccoderConfig
 
-	zapLog, err = config.Build(zap.AddCallerSkip(1))
+	base, err := config.Build()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	zapLog = base.WithOptions(zap.AddCallerSkip(1))
+	defaultLogger = &Logger{sugar: zapLog.Sugar(), level: level}
+
+	return nil
+}
+
+// Configure replaces the default logger with one using the given level and
+// format, which is either json or console. It must be called before the
+// default logger is handed to servers and clients
+func Configure(levelName string, format string) error {
+	if err := SetLevel(levelName); err != nil {
+		return err
+	}
+
+	return build(format)
+}
+
+// SetFormat replaces the default logger with one using the given format,
+// keeping its level. It must be called before the default logger is handed
+// to servers and clients
+func SetFormat(format string) error {
+	return build(format)
+}
+
+// New returns a Logger writing to the given zap logger. Its level is debug,
+// leaving the filtering to the zap logger until it is raised with SetLevel
+func New(z *zap.Logger) *Logger {
+	return &Logger{sugar: z.WithOptions(zap.AddCallerSkip(1)).Sugar(), level: zap.NewAtomicLevelAt(zap.DebugLevel)}
+}
+
+// Default returns the logger used by the package level functions
+func Default() *Logger {
+	return defaultLogger
+}
+
+// With returns a logger adding the given key and value pairs to every message
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	return &Logger{sugar: l.sugar.With(keysAndValues...), level: l.level}
+}
+
+// Fork returns a copy of the logger whose level is set independently,
+// starting at the current one
+func (l *Logger) Fork() *Logger {
+	return &Logger{sugar: l.sugar, level: zap.NewAtomicLevelAt(l.level.Level())}
+}
+
+// SetLevel sets the minimum level of the messages of the logger and of the
+// ones returned by its With, which is one of debug, info, warn or error.
+// It cannot let through the messages the wrapped zap logger drops
+func (l *Logger) SetLevel(name string) error {
+	return setLevel(l.level, name)
+}
+
+func (l *Logger) Info(message string, values ...interface{}) {
+	if l.level.Enabled(zap.InfoLevel) {
+		l.sugar.Infof(message, values...)
+	}
+}
+
+func (l *Logger) Debug(message string, values ...interface{}) {
+	if l.level.Enabled(zap.DebugLevel) {
+		l.sugar.Debugf(message, values...)
+	}
+}
+
+func (l *Logger) Error(message string, values ...interface{}) {
+	if l.level.Enabled(zap.ErrorLevel) {
+		l.sugar.Errorf(message, values...)
+	}
+}
+
+func (l *Logger) Fatal(message string, values ...interface{}) {
+	l.sugar.Fatalf(message, values...)
+}
+
+func (l *Logger) Warning(message string, values ...interface{}) {
+	if l.level.Enabled(zap.WarnLevel) {
+		l.sugar.Warnf(message, values...)
+	}
+}
+
+// SetVerbose enables debug messages of the default logger when verbose is
+// true, otherwise only messages from the info level up are logged
+func SetVerbose(verbose bool) {
+	if verbose {
+		level.SetLevel(zap.DebugLevel)
+	} else {
+		level.SetLevel(zap.InfoLevel)
+	}
+}
+
+// Verbose returns whether the default logger logs debug messages
+func Verbose() bool {
+	return level.Enabled(zap.DebugLevel)
+}
+
+// SetLevel sets the minimum level of the messages of the default logger,
+// which is one of debug, info, warn or error
+func SetLevel(name string) error {
+	return setLevel(level, name)
+}
+
+func setLevel(level zap.AtomicLevel, name string) error {
+	var newLevel zapcore.Level
+	if err := newLevel.UnmarshalText([]byte(name)); err != nil {
+		return err
 	}
+	level.SetLevel(newLevel)
+
+	return nil
 }
 
 func Info(message string, values ...interface{}) {
-	zapLog.Sugar().Infof(message, values...)
+	if level.Enabled(zap.InfoLevel) {
+		zapLog.Sugar().Infof(message, values...)
+	}
 }
 
 func Debug(message string, values ...interface{}) {
-	zapLog.Sugar().Debugf(message, values...)
+	if level.Enabled(zap.DebugLevel) {
+		zapLog.Sugar().Debugf(message, values...)
+	}
 }
 
 func Error(message string, values ...interface{}) {
-	zapLog.Sugar().Errorf(message, values...)
+	if level.Enabled(zap.ErrorLevel) {
+		zapLog.Sugar().Errorf(message, values...)
+	}
 }
 
 func Fatal(message string, values ...interface{}) {
@@ -39,5 +190,7 @@ func Fatal(message string, values ...interface{}) {
 }
 
 func Warning(message string, values ...interface{}) {
-	zapLog.Sugar().Warnf(message, values...)
+	if level.Enabled(zap.WarnLevel) {
+		zapLog.Sugar().Warnf(message, values...)
+	}
 }
@@ -0,0 +1,90 @@
+package logger
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWith(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	log := New(zap.New(core))
+	session := log.With("session", "1", "peer", "127.0.0.1:5000")
+
+	session.Debug("received block %d", 3)
+	log.Warning("no fields")
+
+	messages := logs.AllUntimed()
+	if len(messages) != 2 {
+		t.Fatalf("logged %v", messages)
+	}
+	if messages[0].Message != "received block 3" || messages[0].Level != zapcore.DebugLevel {
+		t.Errorf("logged %v", messages[0])
+	}
+	fields := messages[0].ContextMap()
+	if len(fields) != 2 || fields["session"] != "1" || fields["peer"] != "127.0.0.1:5000" {
+		t.Errorf("the fields are %v", fields)
+	}
+	if len(messages[1].Context) != 0 {
+		t.Errorf("the fields of the session have been added to its parent: %v", messages[1].Context)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		level  string
+		format string
+		valid  bool
+	}{
+		{"debug", FormatConsole, true},
+		{"info", FormatJSON, true},
+		{"info", "xml", false},
+		{"loud", FormatJSON, false},
+	}
+
+	for _, test := range tests {
+		if err := Configure(test.level, test.format); (err == nil) != test.valid {
+			t.Errorf("level %s and format %s: got error %v", test.level, test.format, err)
+		}
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	log := New(zap.New(core))
+	session := log.With("session", "1")
+
+	session.Debug("debug %d", 1)
+	if err := log.SetLevel("warn"); err != nil {
+		t.Fatal(err)
+	}
+	session.Info("info %d", 2)
+	session.Warning("warning %d", 3)
+
+	messages := logs.AllUntimed()
+	if len(messages) != 2 || messages[0].Message != "debug 1" || messages[1].Message != "warning 3" {
+		t.Errorf("logged %v", messages)
+	}
+	if err := log.SetLevel("verbose"); err == nil {
+		t.Error("an unknown level has been accepted")
+	}
+}
+
+func TestFork(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	log := New(zap.New(core))
+	fork := log.Fork()
+
+	if err := fork.SetLevel("error"); err != nil {
+		t.Fatal(err)
+	}
+	log.Info("kept")
+	fork.Info("dropped")
+
+	messages := logs.AllUntimed()
+	if len(messages) != 1 || messages[0].Message != "kept" {
+		t.Errorf("logged %v", messages)
+	}
+}
@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tftp"
+
+// Outcomes of a request
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+	OutcomeBusy    = "busy"
+	// OutcomeRateLimited is the outcome of the requests dropped
+	// beyond the requests per second limit
+	OutcomeRateLimited = "rate_limited"
+)
+
+// Metrics collects the statistics of a server. A nil *Metrics is
+// valid and discards everything, so that metrics are optional
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	bytesSent       prometheus.Counter
+	bytesReceived   prometheus.Counter
+	activeSessions  prometheus.Gauge
+	retransmissions prometheus.Counter
+	timeouts        prometheus.Counter
+	errorsSent      *prometheus.CounterVec
+	duration        *prometheus.HistogramVec
+	throughput      *prometheus.HistogramVec
+	throttled       prometheus.Counter
+	rateLimits      *prometheus.GaugeVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Requests received, by opcode and outcome.",
+		}, []string{"opcode", "outcome"}),
+		bytesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_sent_total",
+			Help:      "Data bytes sent to clients.",
+		}),
+		bytesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_received_total",
+			Help:      "Data bytes received from clients.",
+		}),
+		activeSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_sessions",
+			Help:      "Transfers currently in progress.",
+		}),
+		retransmissions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "retransmissions_total",
+			Help:      "Packets sent again after a timeout.",
+		}),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "timeouts_total",
+			Help:      "Times the server has waited too long for a client packet.",
+		}),
+		errorsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_sent_total",
+			Help:      "ERROR packets sent to clients, by error code.",
+		}, []string{"code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "transfer_duration_seconds",
+			Help:      "Duration of the completed transfers.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"opcode"}),
+		throughput: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "transfer_throughput_bytes_per_second",
+			Help:      "Average throughput of the completed transfers.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+		}, []string{"opcode"}),
+		throttled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "throttled_seconds_total",
+			Help:      "Time the transfers have waited for the bandwidth limits.",
+		}),
+		rateLimits: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rate_limit",
+			Help:      "Configured rate limits, in bytes or requests per second, zero when unlimited.",
+		}, []string{"limit"}),
+	}
+
+	m.registry.MustRegister(m.requests, m.bytesSent, m.bytesReceived, m.activeSessions,
+		m.retransmissions, m.timeouts, m.errorsSent, m.duration, m.throughput,
+		m.throttled, m.rateLimits)
+
+	return m
+}
+
+// Handler returns the HTTP handler exposing the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Serve exposes the metrics on the /metrics path of the given address
+func (m *Metrics) Serve(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+
+	return http.ListenAndServe(address, mux)
+}
+
+// RequestRefused records a request that has not been accepted
+func (m *Metrics) RequestRefused(opcode string, outcome string) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(opcode, outcome).Inc()
+}
+
+func (m *Metrics) SessionStarted() {
+	if m == nil {
+		return
+	}
+	m.activeSessions.Inc()
+}
+
+// SessionEnded records the outcome of a session. Duration and
+// throughput are only observed for successful transfers
+func (m *Metrics) SessionEnded(opcode string, success bool, bytes int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.activeSessions.Dec()
+
+	if !success {
+		m.requests.WithLabelValues(opcode, OutcomeFailure).Inc()
+		return
+	}
+	m.requests.WithLabelValues(opcode, OutcomeSuccess).Inc()
+	m.duration.WithLabelValues(opcode).Observe(duration.Seconds())
+	if duration > 0 {
+		m.throughput.WithLabelValues(opcode).Observe(float64(bytes) / duration.Seconds())
+	}
+}
+
+func (m *Metrics) BytesSent(n int) {
+	if m == nil {
+		return
+	}
+	m.bytesSent.Add(float64(n))
+}
+
+func (m *Metrics) BytesReceived(n int) {
+	if m == nil {
+		return
+	}
+	m.bytesReceived.Add(float64(n))
+}
+
+func (m *Metrics) Retransmission() {
+	if m == nil {
+		return
+	}
+	m.retransmissions.Inc()
+}
+
+func (m *Metrics) Timeout() {
+	if m == nil {
+		return
+	}
+	m.timeouts.Inc()
+}
+
+func (m *Metrics) ErrorSent(code uint16) {
+	if m == nil {
+		return
+	}
+	m.errorsSent.WithLabelValues(strconv.Itoa(int(code))).Inc()
+}
+
+// Throttled records the time a transfer has waited for the bandwidth limits
+func (m *Metrics) Throttled(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.throttled.Add(d.Seconds())
+}
+
+// SetRateLimits records the bandwidth limits, in bytes per second, and the
+// limit of the requests per second
+func (m *Metrics) SetRateLimits(bandwidth int64, clientBandwidth int64, sessionBandwidth int64, requests int64) {
+	if m == nil {
+		return
+	}
+	m.rateLimits.WithLabelValues("bandwidth").Set(float64(bandwidth))
+	m.rateLimits.WithLabelValues("client_bandwidth").Set(float64(clientBandwidth))
+	m.rateLimits.WithLabelValues("session_bandwidth").Set(float64(sessionBandwidth))
+	m.rateLimits.WithLabelValues("requests").Set(float64(requests))
+}
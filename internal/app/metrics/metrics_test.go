@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("the scrape has failed with status %d", recorder.Code)
+	}
+	return recorder.Body.String()
+}
+
+// TestSessionEnded expects the duration and the throughput to be observed
+// for successful sessions only, and the throughput to be skipped when no
+// time has elapsed
+func TestSessionEnded(t *testing.T) {
+	m := NewMetrics()
+	for i := 0; i < 4; i++ {
+		m.SessionStarted()
+	}
+	m.SessionEnded("RRQ", true, 4096, 2*time.Second)
+	m.SessionEnded("RRQ", true, 512, 0)
+	m.SessionEnded("RRQ", false, 100, time.Second)
+
+	scraped := scrape(t, m)
+	for _, line := range []string{
+		`tftp_active_sessions 1`,
+		`tftp_requests_total{opcode="RRQ",outcome="success"} 2`,
+		`tftp_requests_total{opcode="RRQ",outcome="failure"} 1`,
+		`tftp_transfer_duration_seconds_count{opcode="RRQ"} 2`,
+		`tftp_transfer_duration_seconds_sum{opcode="RRQ"} 2`,
+		`tftp_transfer_throughput_bytes_per_second_count{opcode="RRQ"} 1`,
+		`tftp_transfer_throughput_bytes_per_second_sum{opcode="RRQ"} 2048`,
+	} {
+		if !strings.Contains(scraped, line+"\n") {
+			t.Errorf("the metrics do not hold %s", line)
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	m := NewMetrics()
+	m.RequestRefused("WRQ", OutcomeDenied)
+	m.RequestRefused("RRQ", OutcomeBusy)
+	m.BytesSent(512)
+	m.BytesSent(100)
+	m.BytesReceived(42)
+	m.Retransmission()
+	m.Timeout()
+	m.ErrorSent(2)
+
+	scraped := scrape(t, m)
+	for _, line := range []string{
+		`tftp_requests_total{opcode="WRQ",outcome="denied"} 1`,
+		`tftp_requests_total{opcode="RRQ",outcome="busy"} 1`,
+		`tftp_bytes_sent_total 612`,
+		`tftp_bytes_received_total 42`,
+		`tftp_retransmissions_total 1`,
+		`tftp_timeouts_total 1`,
+		`tftp_errors_sent_total{code="2"} 1`,
+	} {
+		if !strings.Contains(scraped, line+"\n") {
+			t.Errorf("the metrics do not hold %s", line)
+		}
+	}
+}
+
+// TestNilMetrics expects a nil *Metrics to discard everything
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.RequestRefused("RRQ", OutcomeDenied)
+	m.SessionStarted()
+	m.SessionEnded("RRQ", true, 512, time.Second)
+	m.BytesSent(512)
+	m.BytesReceived(512)
+	m.Retransmission()
+	m.Timeout()
+	m.ErrorSent(1)
+}
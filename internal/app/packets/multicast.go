@@ -0,0 +1,61 @@
+package packets
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Multicast is the value of the multicast option sent by the server in an
+// OACK, as "address,port,mc". The address and the port may be left empty
+// when the server only changes the role of the client
+type Multicast struct {
+	// Group is where the DATA packets are sent
+	Group *net.UDPAddr
+	// Master tells the client to acknowledge the blocks
+	Master bool
+}
+
+// String encodes the value of the option
+func (m Multicast) String() string {
+	master := 0
+	if m.Master {
+		master = 1
+	}
+	if m.Group == nil {
+		return fmt.Sprintf(",,%d", master)
+	}
+	return fmt.Sprintf("%s,%d,%d", m.Group.IP, m.Group.Port, master)
+}
+
+// ParseMulticast decodes the value of the multicast option of an OACK
+func ParseMulticast(value string) (Multicast, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 3 {
+		return Multicast{}, errors.Errorf("invalid multicast option %q", value)
+	}
+
+	var m Multicast
+	switch fields[2] {
+	case "0":
+	case "1":
+		m.Master = true
+	default:
+		return Multicast{}, errors.Errorf("invalid master flag in multicast option %q", value)
+	}
+	if fields[0] == "" && fields[1] == "" {
+		return m, nil
+	}
+
+	ip := net.ParseIP(fields[0]).To4()
+	port, err := strconv.Atoi(fields[1])
+	if ip == nil || !ip.IsMulticast() || err != nil || port <= 0 || port > 65535 {
+		return Multicast{}, errors.Errorf("invalid multicast group in option %q", value)
+	}
+	m.Group = &net.UDPAddr{IP: ip, Port: port}
+
+	return m, nil
+}
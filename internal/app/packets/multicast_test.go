@@ -0,0 +1,36 @@
+package packets
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseMulticast(t *testing.T) {
+	tests := []struct {
+		value string
+		// expected is nil when the value is expected to be rejected
+		expected *Multicast
+	}{
+		{"239.255.42.69,1758,1", &Multicast{Group: &net.UDPAddr{IP: net.IPv4(239, 255, 42, 69).To4(), Port: 1758}, Master: true}},
+		{",,0", &Multicast{}},
+		{",,2", nil},
+		{"10.0.0.1,1758,1", nil},
+		{"239.255.42.69,0,1", nil},
+		{"239.255.42.69,1758", nil},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMulticast(test.value)
+		switch {
+		case test.expected == nil && err == nil:
+			t.Errorf("%q has been accepted as %v", test.value, m)
+		case test.expected != nil && err != nil:
+			t.Errorf("%q: %v", test.value, err)
+		case test.expected != nil && !reflect.DeepEqual(m, *test.expected):
+			t.Errorf("%q has been parsed as %+v, expected %+v", test.value, m, *test.expected)
+		case test.expected != nil && m.String() != test.value:
+			t.Errorf("%q has been encoded back as %q", test.value, m.String())
+		}
+	}
+}
@@ -4,11 +4,41 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
-const TftpMaxPacketSize = 512
+const (
+	// DefaultBlockSize is the size of a DATA block when no blksize option has been negotiated
+	DefaultBlockSize = 512
+	// DataHeaderSize is the size of the opcode and block number preceding the data
+	DataHeaderSize = 4
+	// TftpMaxPacketSize is the size of a full DATA packet with the default block size
+	TftpMaxPacketSize = DefaultBlockSize + DataHeaderSize
+)
+
+// Options negotiated following RFC 2347, 2348 and 2349
+const (
+	OptionBlksize = "blksize"
+	OptionTsize   = "tsize"
+	OptionTimeout = "timeout"
+)
+
+// OptionMulticast is the option of RFC 2090 sharing a read between the
+// clients requesting the same file
+const OptionMulticast = "multicast"
+
+// OptionOffset is an extension understood by this server and its client
+// resuming a read at the given byte of the file, which the first DATA
+// block starts with. Other servers ignore it and send the whole file
+const OptionOffset = "offset"
+
+// OptionSHA256 is an extension understood by this server and its client
+// asking for the SHA-256 of the whole file in hexadecimal, like tsize
+// asks for its size
+const OptionSHA256 = "sha256"
 
 // Packet represents any TFTP packet
 type Packet interface {
@@ -27,6 +57,7 @@ const (
 	opDATA  = uint16(3) // Data
 	opACK   = uint16(4) // Acknowledgement
 	opERROR = uint16(5) // Error
+	opOACK  = uint16(6) // Option acknowledgement
 )
 
 const (
@@ -39,12 +70,14 @@ type RRQPacket struct {
 	Opcode   uint16
 	Filename string
 	Mode     Mode
+	Options  map[string]string
 }
 
 type WRQPacket struct {
 	Opcode   uint16
 	Filename string
 	Mode     Mode
+	Options  map[string]string
 }
 
 type DataPacket struct {
@@ -64,6 +97,11 @@ type ErrorPacket struct {
 	ErrMsg    string
 }
 
+type OACKPacket struct {
+	Opcode  uint16
+	Options map[string]string
+}
+
 func NewRRQPacket(filename string, mode Mode) RRQPacket {
 	return RRQPacket{Opcode: opRRQ, Filename: filename, Mode: mode}
 }
@@ -84,6 +122,10 @@ func NewErrorPacket(errorCode uint16, errMsg string) ErrorPacket {
 	return ErrorPacket{Opcode: opERROR, ErrorCode: errorCode, ErrMsg: errMsg}
 }
 
+func NewOACKPacket(options map[string]string) OACKPacket {
+	return OACKPacket{Opcode: opOACK, Options: options}
+}
+
 func (rrqPacket RRQPacket) Bytes() []byte {
 	encodedPacket := make([]byte, 2)
 
@@ -92,6 +134,7 @@ func (rrqPacket RRQPacket) Bytes() []byte {
 	encodedPacket = append(encodedPacket, byte(0))
 	encodedPacket = append(encodedPacket, []byte(rrqPacket.Mode)...)
 	encodedPacket = append(encodedPacket, byte(0))
+	encodedPacket = appendOptions(encodedPacket, rrqPacket.Options)
 
 	return encodedPacket
 }
@@ -104,6 +147,7 @@ func (wrqPacket WRQPacket) Bytes() []byte {
 	encodedPacket = append(encodedPacket, byte(0))
 	encodedPacket = append(encodedPacket, []byte(wrqPacket.Mode)...)
 	encodedPacket = append(encodedPacket, byte(0))
+	encodedPacket = appendOptions(encodedPacket, wrqPacket.Options)
 
 	return encodedPacket
 }
@@ -150,37 +194,110 @@ func (errorPacket ErrorPacket) Bytes() []byte {
 	return encodedPacket
 }
 
-func rrqPacketFromBytes(b []byte) RRQPacket {
-	var parsedPacket RRQPacket
+func (oackPacket OACKPacket) Bytes() []byte {
+	encodedPacket := make([]byte, 2)
 
-	vals := bytes.Split(b[2:], []byte{0})
-	filename := vals[0]
-	mode := vals[1]
+	binary.BigEndian.PutUint16(encodedPacket, oackPacket.Opcode)
+	encodedPacket = appendOptions(encodedPacket, oackPacket.Options)
 
-	parsedPacket = NewRRQPacket(string(filename), Mode(mode))
+	return encodedPacket
+}
 
-	return parsedPacket
+// appendOptions encodes the options as a sequence of null terminated
+// name and value pairs. Names are sorted to keep the encoding stable
+func appendOptions(encodedPacket []byte, options map[string]string) []byte {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		encodedPacket = append(encodedPacket, []byte(name)...)
+		encodedPacket = append(encodedPacket, byte(0))
+		encodedPacket = append(encodedPacket, []byte(options[name])...)
+		encodedPacket = append(encodedPacket, byte(0))
+	}
+
+	return encodedPacket
+}
+
+// splitFields splits a sequence of null terminated fields, failing when
+// the last one is not terminated
+func splitFields(b []byte) ([][]byte, error) {
+	if len(b) == 0 || b[len(b)-1] != 0 {
+		return nil, errors.New("missing null terminator")
+	}
+	return bytes.Split(b[:len(b)-1], []byte{0}), nil
+}
+
+// parseOptions decodes a list of null separated name and value pairs.
+// Option names are case insensitive so they are stored in lower case.
+// An empty name ends the list, tolerating the padding some clients send
+func parseOptions(vals [][]byte) (map[string]string, error) {
+	options := make(map[string]string)
+	for i := 0; i < len(vals); i += 2 {
+		if len(vals[i]) == 0 {
+			break
+		}
+		if i+1 == len(vals) {
+			return nil, fmt.Errorf("option %s has no value", vals[i])
+		}
+		options[strings.ToLower(string(vals[i]))] = string(vals[i+1])
+	}
+
+	return options, nil
 }
 
-func wrqPacketFromBytes(b []byte) WRQPacket {
-	var parsedPacket WRQPacket
+// requestFromBytes decodes the filename, the mode and the options of a
+// read or write request
+func requestFromBytes(b []byte) (string, Mode, map[string]string, error) {
+	vals, err := splitFields(b[2:])
+	if err != nil {
+		return "", "", nil, err
+	}
+	if len(vals) < 2 {
+		return "", "", nil, errors.New("missing mode")
+	}
+	options, err := parseOptions(vals[2:])
+	if err != nil {
+		return "", "", nil, err
+	}
 
-	vals := bytes.Split(b[2:], []byte{0})
-	filename := vals[0]
-	mode := vals[1]
+	return string(vals[0]), Mode(strings.ToLower(string(vals[1]))), options, nil
+}
 
-	parsedPacket = NewWRQPacket(string(filename), Mode(mode))
+func rrqPacketFromBytes(b []byte) (RRQPacket, error) {
+	filename, mode, options, err := requestFromBytes(b)
+	if err != nil {
+		return RRQPacket{}, errors.Wrap(err, "malformed RRQ packet")
+	}
 
-	return parsedPacket
+	parsedPacket := NewRRQPacket(filename, mode)
+	parsedPacket.Options = options
+
+	return parsedPacket, nil
+}
+
+func wrqPacketFromBytes(b []byte) (WRQPacket, error) {
+	filename, mode, options, err := requestFromBytes(b)
+	if err != nil {
+		return WRQPacket{}, errors.Wrap(err, "malformed WRQ packet")
+	}
+
+	parsedPacket := NewWRQPacket(filename, mode)
+	parsedPacket.Options = options
+
+	return parsedPacket, nil
 }
 
 func dataPacketFromBytes(b []byte) DataPacket {
 	var parsedPacket DataPacket
 
+	// The data is binary and it can contain NUL bytes, so
+	// it extends up to the end of the datagram
 	blockNumber := binary.BigEndian.Uint16(b[2:4])
-	data := b[4:]
-	splitted := bytes.Split(data, []byte{0})
-	parsedPacket = NewDataPacket(uint16(blockNumber), splitted[0])
+	parsedPacket = NewDataPacket(uint16(blockNumber), b[4:])
 
 	return parsedPacket
 }
@@ -206,6 +323,21 @@ func errorPacketFromBytes(b []byte) ErrorPacket {
 	return parsedPacket
 }
 
+func oackPacketFromBytes(b []byte) (OACKPacket, error) {
+	if len(b) == 2 {
+		return NewOACKPacket(map[string]string{}), nil
+	}
+	vals, err := splitFields(b[2:])
+	if err == nil {
+		var options map[string]string
+		if options, err = parseOptions(vals); err == nil {
+			return NewOACKPacket(options), nil
+		}
+	}
+
+	return OACKPacket{}, errors.Wrap(err, "malformed OACK packet")
+}
+
 func (rrqPacket RRQPacket) GetType() uint16 {
 	return opRRQ
 }
@@ -226,6 +358,70 @@ func (rrqPacket ErrorPacket) GetType() uint16 {
 	return opERROR
 }
 
+func (rrqPacket OACKPacket) GetType() uint16 {
+	return opOACK
+}
+
+func (rrqPacket RRQPacket) String() string {
+	return fmt.Sprintf("RRQ <file=%s, mode=%s%s>", rrqPacket.Filename, rrqPacket.Mode, formatOptions(rrqPacket.Options))
+}
+
+func (wrqPacket WRQPacket) String() string {
+	return fmt.Sprintf("WRQ <file=%s, mode=%s%s>", wrqPacket.Filename, wrqPacket.Mode, formatOptions(wrqPacket.Options))
+}
+
+func (dataPacket DataPacket) String() string {
+	return fmt.Sprintf("DATA <block=%d, %d bytes>", dataPacket.BlockNumber, len(dataPacket.Data))
+}
+
+func (ackPacket AckPacket) String() string {
+	return fmt.Sprintf("ACK <block=%d>", ackPacket.BlockNumber)
+}
+
+func (errorPacket ErrorPacket) String() string {
+	return fmt.Sprintf("ERROR <code=%d, message=%s>", errorPacket.ErrorCode, errorPacket.ErrMsg)
+}
+
+func (oackPacket OACKPacket) String() string {
+	return fmt.Sprintf("OACK <%s>", strings.TrimPrefix(formatOptions(oackPacket.Options), ", "))
+}
+
+// LogFields returns the opcode and, when present, the block
+// number of the packet as key and value pairs for the logger
+func LogFields(packet interface{}) []interface{} {
+	switch packet := packet.(type) {
+	case RRQPacket:
+		return []interface{}{"opcode", "RRQ"}
+	case WRQPacket:
+		return []interface{}{"opcode", "WRQ"}
+	case DataPacket:
+		return []interface{}{"opcode", "DATA", "block", packet.BlockNumber}
+	case AckPacket:
+		return []interface{}{"opcode", "ACK", "block", packet.BlockNumber}
+	case ErrorPacket:
+		return []interface{}{"opcode", "ERROR", "error_code", packet.ErrorCode}
+	case OACKPacket:
+		return []interface{}{"opcode", "OACK"}
+	default:
+		return nil
+	}
+}
+
+func formatOptions(options map[string]string) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var formatted string
+	for _, name := range names {
+		formatted += fmt.Sprintf(", %s=%s", name, options[name])
+	}
+
+	return formatted
+}
+
 func ParsePacket(p []byte) (interface{}, error) {
 	packetLength := len(p)
 
@@ -239,12 +435,12 @@ func ParsePacket(p []byte) (interface{}, error) {
 		if packetLength < 4 {
 			return nil, fmt.Errorf("short RRQ packet: %d", packetLength)
 		}
-		return rrqPacketFromBytes(p), nil
+		return rrqPacketFromBytes(p)
 	case opWRQ:
 		if packetLength < 4 {
 			return nil, fmt.Errorf("short WRQ packet: %d", packetLength)
 		}
-		return wrqPacketFromBytes(p), nil
+		return wrqPacketFromBytes(p)
 	case opDATA:
 		if packetLength < 4 {
 			return nil, fmt.Errorf("short DATA packet: %d", packetLength)
@@ -260,6 +456,8 @@ func ParsePacket(p []byte) (interface{}, error) {
 			return nil, fmt.Errorf("short ERROR packet: %d", packetLength)
 		}
 		return errorPacketFromBytes(p), nil
+	case opOACK:
+		return oackPacketFromBytes(p)
 	default:
 		return nil, fmt.Errorf("unknown opcode: %d", opCode)
 
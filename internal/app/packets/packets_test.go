@@ -0,0 +1,89 @@
+package packets
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	packet, err := ParsePacket([]byte("\x00\x01boot/pxelinux.0\x00OCTET\x00BLKSIZE\x001428\x00tsize\x000\x00"))
+	if err != nil {
+		t.Fatalf("cannot parse the request: %v", err)
+	}
+
+	expected := NewRRQPacket("boot/pxelinux.0", Octet)
+	expected.Options = map[string]string{OptionBlksize: "1428", OptionTsize: "0"}
+	if !reflect.DeepEqual(packet, expected) {
+		t.Errorf("parsed %v, expected %v", packet, expected)
+	}
+}
+
+func TestParseRequestPadding(t *testing.T) {
+	packet, err := ParsePacket([]byte("\x00\x02file\x00octet\x00\x00\x00\x00"))
+	if err != nil {
+		t.Fatalf("cannot parse the request: %v", err)
+	}
+
+	wrq, ok := packet.(WRQPacket)
+	if !ok || wrq.Filename != "file" || wrq.Mode != Octet || len(wrq.Options) != 0 {
+		t.Errorf("parsed %v, expected a WRQ of file without options", packet)
+	}
+}
+
+func TestParseMalformedPacket(t *testing.T) {
+	tests := []struct {
+		name     string
+		datagram string
+	}{
+		{"empty", ""},
+		{"opcode only", "\x00\x01"},
+		{"filename without terminator", "\x00\x01ab"},
+		{"missing mode", "\x00\x01file\x00"},
+		{"mode without terminator", "\x00\x02file\x00octet"},
+		{"option without value", "\x00\x01file\x00octet\x00blksize\x00"},
+		{"value without terminator", "\x00\x01file\x00octet\x00blksize\x001024"},
+		{"short DATA", "\x00\x03\x00"},
+		{"short ACK", "\x00\x04\x00"},
+		{"short ERROR", "\x00\x05\x00\x01"},
+		{"OACK option without value", "\x00\x06blksize\x00"},
+		{"OACK without terminator", "\x00\x06blksize\x001024"},
+		{"unknown opcode", "\x00\x09\x00\x00"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if packet, err := ParsePacket([]byte(test.datagram)); err == nil {
+				t.Errorf("parsed %q as %v, expected an error", test.datagram, packet)
+			}
+		})
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	rrq := NewRRQPacket("file", Netascii)
+	rrq.Options = map[string]string{OptionTimeout: "3"}
+	wrq := NewWRQPacket("upload", Octet)
+	wrq.Options = map[string]string{}
+
+	tests := []Packet{
+		rrq,
+		wrq,
+		NewDataPacket(7, []byte("data")),
+		NewDataPacket(8, []byte("\x00bin\x00\x00")),
+		NewAckPacket(65535),
+		NewErrorPacket(1, "File not found"),
+		NewOACKPacket(map[string]string{OptionBlksize: "1024", OptionTsize: "42"}),
+		NewOACKPacket(map[string]string{}),
+	}
+
+	for _, packet := range tests {
+		parsed, err := ParsePacket(packet.Bytes())
+		if err != nil {
+			t.Errorf("cannot parse %v: %v", packet, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, packet) {
+			t.Errorf("parsed %v, expected %v", parsed, packet)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	barWidth        = 30
+	refreshInterval = 100 * time.Millisecond
+)
+
+// Bar renders a single-line progress bar on a terminal
+type Bar struct {
+	mu         sync.Mutex
+	out        io.Writer
+	lastRender time.Time
+}
+
+// NewBar returns a progress bar that writes to out
+func NewBar(out io.Writer) *Bar {
+	return &Bar{out: out}
+}
+
+// IsTerminal reports whether the file is attached to a terminal
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Update renders the report. It can be used directly as a progress Func
+func (b *Bar) Update(r Report) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !r.Done && time.Since(b.lastRender) < refreshInterval {
+		return
+	}
+	b.lastRender = time.Now()
+
+	var line string
+	if r.Total > 0 {
+		ratio := float64(r.Transferred) / float64(r.Total)
+		if ratio > 1 {
+			ratio = 1
+		}
+		filled := int(ratio * barWidth)
+		line = fmt.Sprintf("%s [%s%s] %5.1f%% %s/%s %s/s ETA %s",
+			r.Filename,
+			strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled),
+			ratio*100,
+			formatBytes(float64(r.Transferred)), formatBytes(float64(r.Total)),
+			formatBytes(r.Rate()), formatDuration(r.ETA()))
+	} else {
+		line = fmt.Sprintf("%s %s %s/s", r.Filename, formatBytes(float64(r.Transferred)), formatBytes(r.Rate()))
+	}
+	if r.Retransmits > 0 {
+		line += fmt.Sprintf(" (%d retransmits)", r.Retransmits)
+	}
+
+	fmt.Fprintf(b.out, "\r\033[K%s", line)
+	if r.Done {
+		fmt.Fprintln(b.out)
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	m := (d % time.Hour) / time.Minute
+	s := (d % time.Minute) / time.Second
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
@@ -0,0 +1,84 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBar(t *testing.T) {
+	tests := []struct {
+		name   string
+		report Report
+		line   string
+	}{
+		{
+			name:   "known total",
+			report: Report{Filename: "boot.bin", Transferred: 1024, Total: 4096, Elapsed: time.Second},
+			line:   "boot.bin [=======                       ]  25.0% 1.0KiB/4.0KiB 1.0KiB/s ETA 00:03",
+		},
+		{
+			name:   "unknown total",
+			report: Report{Filename: "boot.bin", Transferred: 1536, Elapsed: time.Second},
+			line:   "boot.bin 1.5KiB 1.5KiB/s",
+		},
+		{
+			name:   "no time elapsed",
+			report: Report{Filename: "boot.bin", Transferred: 100, Total: 200},
+			line:   "boot.bin [===============               ]  50.0% 100B/200B 0B/s ETA 00:00",
+		},
+		{
+			name:   "beyond the total",
+			report: Report{Filename: "boot.bin", Transferred: 300, Total: 200, Elapsed: time.Second},
+			line:   "boot.bin [==============================] 100.0% 300B/200B 300B/s ETA 00:00",
+		},
+		{
+			name:   "retransmits",
+			report: Report{Filename: "boot.bin", Transferred: 512, Retransmits: 2, Elapsed: time.Second},
+			line:   "boot.bin 512B 512B/s (2 retransmits)",
+		},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		NewBar(&out).Update(test.report)
+		if line := strings.TrimPrefix(out.String(), "\r\033[K"); line != test.line {
+			t.Errorf("%s: rendered %q, expected %q", test.name, line, test.line)
+		}
+	}
+}
+
+// TestBarRefresh expects the reports to be rendered at most once per
+// refresh interval, except the final one
+func TestBarRefresh(t *testing.T) {
+	var out bytes.Buffer
+	bar := NewBar(&out)
+	for _, report := range []Report{{Transferred: 1}, {Transferred: 2}, {Transferred: 3, Done: true}} {
+		report.Filename = "boot.bin"
+		bar.Update(report)
+	}
+
+	lines := strings.Split(out.String(), "\r\033[K")[1:]
+	if len(lines) != 2 || lines[0] != "boot.bin 1B 0B/s" || lines[1] != "boot.bin 3B 0B/s\n" {
+		t.Errorf("rendered %q", out.String())
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		text     string
+	}{
+		{0, "00:00"},
+		{1500 * time.Millisecond, "00:02"},
+		{75 * time.Second, "01:15"},
+		{3*time.Hour + 2*time.Minute + 5*time.Second, "3:02:05"},
+	}
+
+	for _, test := range tests {
+		if text := formatDuration(test.duration); text != test.text {
+			t.Errorf("%v is formatted as %q, expected %q", test.duration, text, test.text)
+		}
+	}
+}
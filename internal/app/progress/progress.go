@@ -0,0 +1,100 @@
+package progress
+
+import (
+	"sync"
+	"time"
+)
+
+// Report is a snapshot of the state of a single transfer
+type Report struct {
+	Filename    string
+	Transferred int64
+	// Total is zero when the size of the transfer is not known
+	Total       int64
+	Retransmits int
+	Elapsed     time.Duration
+	Done        bool
+}
+
+// Func is the callback invoked every time a transfer makes progress
+type Func func(Report)
+
+// Rate returns the average transfer rate in bytes per second
+func (r Report) Rate() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Transferred) / r.Elapsed.Seconds()
+}
+
+// ETA returns the estimated time needed to complete the transfer.
+// It returns zero when the total size or the rate are not known
+func (r Report) ETA() time.Duration {
+	rate := r.Rate()
+	if r.Total <= 0 || rate <= 0 || r.Transferred >= r.Total {
+		return 0
+	}
+	remaining := float64(r.Total-r.Transferred) / rate
+	return time.Duration(remaining * float64(time.Second))
+}
+
+// Tracker accumulates the progress of a transfer and reports it
+// to the registered callback
+type Tracker struct {
+	mu     sync.Mutex
+	report Report
+	start  time.Time
+	fn     Func
+}
+
+// NewTracker returns a tracker for the given file. The callback
+// may be nil, in which case the tracker only records the progress
+func NewTracker(filename string, total int64, fn Func) *Tracker {
+	return &Tracker{
+		report: Report{Filename: filename, Total: total},
+		start:  time.Now(),
+		fn:     fn,
+	}
+}
+
+// SetTotal updates the expected size of the transfer
+func (t *Tracker) SetTotal(total int64) {
+	t.mu.Lock()
+	t.report.Total = total
+	t.mu.Unlock()
+}
+
+// Add records that n more bytes have been transferred
+func (t *Tracker) Add(n int) {
+	t.update(func(r *Report) { r.Transferred += int64(n) })
+}
+
+// Retransmit records that a packet had to be sent again
+func (t *Tracker) Retransmit() {
+	t.update(func(r *Report) { r.Retransmits++ })
+}
+
+// Finish marks the transfer as completed
+func (t *Tracker) Finish() {
+	t.update(func(r *Report) { r.Done = true })
+}
+
+// Report returns the current snapshot of the transfer
+func (t *Tracker) Report() Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.report.Elapsed = time.Since(t.start)
+	return t.report
+}
+
+func (t *Tracker) update(change func(r *Report)) {
+	t.mu.Lock()
+	change(&t.report)
+	t.report.Elapsed = time.Since(t.start)
+	report := t.report
+	t.mu.Unlock()
+
+	if t.fn != nil {
+		t.fn(report)
+	}
+}
@@ -0,0 +1,91 @@
+package progress
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		report Report
+		rate   float64
+	}{
+		{"no time elapsed", Report{Transferred: 1024}, 0},
+		{"negative elapsed time", Report{Transferred: 1024, Elapsed: -time.Second}, 0},
+		{"nothing transferred", Report{Elapsed: time.Second}, 0},
+		{"average", Report{Transferred: 3072, Elapsed: 2 * time.Second}, 1536},
+	}
+
+	for _, test := range tests {
+		if rate := test.report.Rate(); rate != test.rate {
+			t.Errorf("%s: the rate is %v, expected %v", test.name, rate, test.rate)
+		}
+	}
+}
+
+func TestETA(t *testing.T) {
+	tests := []struct {
+		name   string
+		report Report
+		eta    time.Duration
+	}{
+		{"unknown total", Report{Transferred: 1024, Elapsed: time.Second}, 0},
+		{"no time elapsed", Report{Transferred: 1024, Total: 4096}, 0},
+		{"nothing transferred", Report{Total: 4096, Elapsed: time.Second}, 0},
+		{"completed", Report{Transferred: 4096, Total: 4096, Elapsed: time.Second}, 0},
+		{"beyond the total", Report{Transferred: 5000, Total: 4096, Elapsed: time.Second}, 0},
+		{"halfway", Report{Transferred: 2048, Total: 4096, Elapsed: 3 * time.Second}, 3 * time.Second},
+	}
+
+	for _, test := range tests {
+		if eta := test.report.ETA(); eta != test.eta {
+			t.Errorf("%s: the ETA is %v, expected %v", test.name, eta, test.eta)
+		}
+	}
+}
+
+// TestTracker expects every change to be reported to the callback, along
+// with the changes made before it
+func TestTracker(t *testing.T) {
+	var reports []Report
+	tracker := NewTracker("boot.bin", 0, func(r Report) { reports = append(reports, r) })
+	tracker.SetTotal(1000)
+	tracker.Add(512)
+	tracker.Retransmit()
+	tracker.Add(488)
+	tracker.Finish()
+
+	expected := []Report{
+		{Filename: "boot.bin", Transferred: 512, Total: 1000},
+		{Filename: "boot.bin", Transferred: 512, Total: 1000, Retransmits: 1},
+		{Filename: "boot.bin", Transferred: 1000, Total: 1000, Retransmits: 1},
+		{Filename: "boot.bin", Transferred: 1000, Total: 1000, Retransmits: 1, Done: true},
+	}
+	if len(reports) != len(expected) {
+		t.Fatalf("%d reports, expected %d", len(reports), len(expected))
+	}
+	for i, report := range reports {
+		if report.Elapsed < 0 {
+			t.Errorf("report %d: the elapsed time is %v", i+1, report.Elapsed)
+		}
+		report.Elapsed = 0
+		if report != expected[i] {
+			t.Errorf("report %d is %+v, expected %+v", i+1, report, expected[i])
+		}
+	}
+
+	if report := tracker.Report(); report.Transferred != 1000 || !report.Done {
+		t.Errorf("the last report is %+v", report)
+	}
+}
+
+// TestTrackerWithoutCallback expects the progress to be recorded when
+// nobody is notified
+func TestTrackerWithoutCallback(t *testing.T) {
+	tracker := NewTracker("boot.bin", 100, nil)
+	tracker.Add(60)
+	if report := tracker.Report(); report.Transferred != 60 || report.Total != 100 {
+		t.Errorf("the report is %+v", report)
+	}
+}
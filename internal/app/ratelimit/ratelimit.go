@@ -0,0 +1,127 @@
+// Package ratelimit implements the token buckets limiting the bandwidth
+// of the transfers and the rate of the requests
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+// minBandwidthBurst is the smallest number of bytes held by a bucket
+// limiting a bandwidth, so that a block of the default size goes through
+// at once however low the rate
+const minBandwidthBurst = packets.DefaultBlockSize
+
+// Bucket is a token bucket refilled at a steady rate, holding up to its
+// burst. A nil *Bucket, like a bucket of rate zero, is unlimited
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket refilled with rate tokens per second
+// and holding up to burst tokens
+func NewBucket(rate int64, burst int64) *Bucket {
+	b := &Bucket{last: time.Now()}
+	b.SetRate(rate, burst)
+	return b
+}
+
+// BandwidthBurst returns the number of bytes a bucket limiting a bandwidth
+// to rate holds, spreading the bandwidth over each tenth of a second
+func BandwidthBurst(rate int64) int64 {
+	if burst := rate / 10; burst > minBandwidthBurst {
+		return burst
+	}
+	return minBandwidthBurst
+}
+
+// SetRate changes the rate and the burst of the bucket, zero making it
+// unlimited. A bucket which was unlimited starts full
+func (b *Bucket) SetRate(rate int64, burst int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	unlimited := b.rate <= 0
+	b.rate = float64(rate)
+	b.burst = float64(burst)
+	if unlimited || b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Allow takes n tokens if the bucket holds them, and reports whether it has
+func (b *Bucket) Allow(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Reserve takes n tokens, even more than the bucket holds, and returns how
+// long to wait for the bucket to have earned them. The callers reserving
+// after it wait for its tokens too, so that the rate is shared
+func (b *Bucket) Reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refill adds the tokens earned since the last call, up to the burst
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last)
+	b.last = now
+	if elapsed <= 0 || b.rate <= 0 {
+		return
+	}
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Wait sleeps for d, in steps of at most step, and returns false as soon
+// as canceled reports true
+func Wait(d time.Duration, step time.Duration, canceled func() bool) bool {
+	for d > 0 {
+		if canceled() {
+			return false
+		}
+		sleep := d
+		if sleep > step {
+			sleep = step
+		}
+		time.Sleep(sleep)
+		d -= sleep
+	}
+	return !canceled()
+}
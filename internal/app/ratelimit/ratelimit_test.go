@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+func TestBandwidthBurst(t *testing.T) {
+	tests := []struct {
+		rate  int64
+		burst int64
+	}{
+		{1, packets.DefaultBlockSize},
+		{9, packets.DefaultBlockSize},
+		{5000, packets.DefaultBlockSize},
+		{1 << 20, 1 << 20 / 10},
+	}
+
+	for _, test := range tests {
+		if burst := BandwidthBurst(test.rate); burst != test.burst {
+			t.Errorf("burst of rate %d: got %d, expected %d", test.rate, burst, test.burst)
+		}
+	}
+}
+
+func TestLowRateAllowsABlock(t *testing.T) {
+	bucket := NewBucket(5, BandwidthBurst(5))
+	if !bucket.Allow(packets.DefaultBlockSize) {
+		t.Fatal("a full bucket of rate 5 does not let a block through")
+	}
+	if bucket.Allow(1) {
+		t.Error("an empty bucket lets a byte through")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	bucket := NewBucket(1000, 100)
+	if wait := bucket.Reserve(100); wait != 0 {
+		t.Errorf("reserving the burst waits %v", wait)
+	}
+	// The tokens of the first reservation are owed by the second one
+	wait := bucket.Reserve(500)
+	if wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("reserving 500 tokens at 1000/s waits %v", wait)
+	}
+	if wait := bucket.Reserve(500); wait < 950*time.Millisecond {
+		t.Errorf("reserving 500 more tokens waits %v", wait)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var nilBucket *Bucket
+	for _, bucket := range []*Bucket{nilBucket, NewBucket(0, 0)} {
+		if !bucket.Allow(1 << 30) {
+			t.Error("an unlimited bucket refuses tokens")
+		}
+		if wait := bucket.Reserve(1 << 30); wait != 0 {
+			t.Errorf("an unlimited bucket waits %v", wait)
+		}
+	}
+}
+
+func TestSetRateFromUnlimited(t *testing.T) {
+	bucket := NewBucket(0, 0)
+	bucket.SetRate(10, 10)
+	if !bucket.Allow(10) {
+		t.Error("a bucket which was unlimited does not start full")
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	canceled := false
+	start := time.Now()
+	ok := Wait(time.Second, 10*time.Millisecond, func() bool {
+		if time.Since(start) > 30*time.Millisecond {
+			canceled = true
+		}
+		return canceled
+	})
+	if ok {
+		t.Error("the wait has not been canceled")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the canceled wait has lasted %v", elapsed)
+	}
+}
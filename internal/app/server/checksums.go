@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// checksumSuffix names the file holding the SHA-256 of another one
+const checksumSuffix = ".sha256"
+
+// checksumCache keeps the digests of the files until they are modified,
+// as the same boot images are read by many clients
+type checksumCache struct {
+	mu      sync.Mutex
+	entries map[string]checksumEntry
+}
+
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+func newChecksumCache() *checksumCache {
+	return &checksumCache{entries: make(map[string]checksumEntry)}
+}
+
+// digest returns the SHA-256 of a whole file in hexadecimal. The file is
+// read from its start and then rewound. Only files are hashed, as their
+// digest is kept until they are modified: hashing the content generated
+// by a handler or a template would read all of it before every transfer
+func (c *checksumCache) digest(content io.Reader) (string, error) {
+	file, ok := content.(*os.File)
+	if !ok {
+		return "", errors.New("the content is not a file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot read the content")
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[file.Name()]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.sum, nil
+	}
+
+	hash := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", errors.Wrap(err, "cannot rewind the content")
+	}
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", errors.Wrap(err, "cannot read the content")
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", errors.Wrap(err, "cannot rewind the content")
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	c.mu.Lock()
+	c.entries[file.Name()] = checksumEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// checksumLine formats the digest of a file as sha256sum does
+func checksumLine(sum string, name string) string {
+	return sum + "  " + name + "\n"
+}
+
+// checksum serves the digest of the file named by a missing <file>.sha256
+func (files staticFiles) checksum(req *Request, filename string) (io.Reader, int64, error) {
+	name := strings.TrimSuffix(filename, checksumSuffix)
+	content, _, err := files.serve(req, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if closer, ok := content.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	sum, err := files.checksums.digest(content)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "cannot compute the SHA-256 of %s", name)
+	}
+	line := checksumLine(sum, path.Base(name))
+	return strings.NewReader(line), int64(len(line)), nil
+}
+
+// writeChecksum records the digest of a stored upload next to it
+func writeChecksum(location string, sum string) error {
+	line := checksumLine(sum, filepath.Base(location))
+	return ioutil.WriteFile(location+checksumSuffix, []byte(line), 0644)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+// startChecksumsServer starts a server allowing the sha256 option, serving
+// the digests of the files and recording those of uploads. prepare, when
+// set, is called before the server starts
+func startChecksumsServer(t *testing.T, prepare func(s *Server)) (*Server, *net.UDPAddr) {
+	return startServer(t, func(s *Server) {
+		cfg := *s.Config()
+		cfg.Options = append(append([]string(nil), cfg.Options...), packets.OptionSHA256)
+		cfg.Checksums.Files = true
+		cfg.Checksums.Uploads = true
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+		if prepare != nil {
+			prepare(s)
+		}
+	})
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// TestSHA256Option expects the sha256 option to be acknowledged with the
+// digest of a file, and declined for the content of a read handler
+func TestSHA256Option(t *testing.T) {
+	expected := content(1500)
+	tests := []struct {
+		name string
+		// serve provides the content before the server starts
+		serve func(t *testing.T, s *Server)
+		oack  map[string]string
+	}{
+		{
+			name:  "file",
+			serve: func(t *testing.T, s *Server) { writeFile(t, s.Config().Root, "image.bin", expected) },
+			oack:  map[string]string{packets.OptionSHA256: sha256Hex(expected), packets.OptionTsize: "1500"},
+		},
+		{
+			name: "read handler",
+			serve: func(t *testing.T, s *Server) {
+				s.Router.HandleReadFunc("image.bin", func(req *Request) (io.Reader, int64, error) {
+					return bytes.NewReader(expected), int64(len(expected)), nil
+				})
+			},
+			oack: map[string]string{packets.OptionTsize: "1500"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, serverAddr := startChecksumsServer(t, func(s *Server) { test.serve(t, s) })
+
+			p := newPeer(t, serverAddr)
+			request := packets.NewRRQPacket("image.bin", packets.Octet)
+			request.Options = map[string]string{packets.OptionSHA256: "0", packets.OptionTsize: "0"}
+			p.Send(request)
+			p.ExpectOACK(test.oack)
+			p.Send(packets.NewAckPacket(0))
+			if received := receiveBlocks(p, 512, 512, 476); !bytes.Equal(received, expected) {
+				t.Errorf("received %d bytes differing from the content", len(received))
+			}
+			expectResult(t, s, "image.bin", ResultSuccess)
+		})
+	}
+}
+
+// TestChecksumFile expects a missing <file>.sha256 to be served with the
+// digest of the file in the format of sha256sum
+func TestChecksumFile(t *testing.T) {
+	s, serverAddr := startChecksumsServer(t, nil)
+	expected := content(1500)
+	writeFile(t, s.Config().Root, "image.bin", expected)
+
+	c := newClient()
+	var received bytes.Buffer
+	if err := c.ReceiveFile(serverAddr, "image.bin.sha256", &received); err != nil {
+		t.Fatal(err)
+	}
+	if line := sha256Hex(expected) + "  image.bin\n"; received.String() != line {
+		t.Errorf("got %q, expected %q", received.String(), line)
+	}
+}
+
+// TestUploadChecksum expects the digest of an upload to be recorded next
+// to it
+func TestUploadChecksum(t *testing.T) {
+	s, serverAddr := startChecksumsServer(t, nil)
+	expected := content(1500)
+
+	c := newClient()
+	if err := c.SendFile(serverAddr, "upload.bin", bytes.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, s, "upload.bin", ResultSuccess)
+	expectFile(t, s.Config().Root, "upload.bin.sha256", []byte(sha256Hex(expected)+"  upload.bin\n"))
+}
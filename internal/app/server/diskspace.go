@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package server
+
+import "syscall"
+
+// freeSpace returns the number of bytes available on the disk holding the
+// directory, and whether it could be measured
+func freeSpace(directory string) (int64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(directory, &stat); err != nil {
+		return 0, false
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
@@ -0,0 +1,510 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/templates"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrFileNotFound is answered to the client with ERROR 1
+	ErrFileNotFound = errors.New("file not found")
+	// ErrAccessViolation is answered to the client with ERROR 2
+	ErrAccessViolation = errors.New("access violation")
+	// ErrAllocationExceeded is answered to the client with ERROR 3
+	ErrAllocationExceeded = errors.New("disk full or allocation exceeded")
+)
+
+// Request describes the request of a client to the handlers
+type Request struct {
+	ClientAddr *net.UDPAddr
+	// Filename is the requested path, after the rewrite rules
+	Filename string
+	// RequestedFilename is the path as sent by the client
+	RequestedFilename string
+	Mode              packets.Mode
+	// Options are the options requested by the client
+	Options map[string]string
+}
+
+// ReadHandler produces the content of the files requested by the clients
+type ReadHandler interface {
+	// ServeRead returns the content of the requested file and its size,
+	// or -1 if the size is unknown in which case the tsize option is
+	// declined. The reader is closed at the end of the transfer if it
+	// is an io.Closer. ErrFileNotFound and ErrAccessViolation, as well
+	// as the errors of the os package, are answered with the matching
+	// ERROR code, the other errors with ERROR 0
+	ServeRead(req *Request) (io.Reader, int64, error)
+}
+
+// ReadHandlerFunc allows the use of a function as a ReadHandler
+type ReadHandlerFunc func(req *Request) (io.Reader, int64, error)
+
+// ServeRead calls f(req)
+func (f ReadHandlerFunc) ServeRead(req *Request) (io.Reader, int64, error) {
+	return f(req)
+}
+
+// WriteHandler stores the files uploaded by the clients
+type WriteHandler interface {
+	// ServeWrite consumes the uploaded content, which is read from r as
+	// the blocks arrive, and returns the location of the stored file if
+	// any, which is passed to the hooks. The reader fails if the transfer
+	// is interrupted, in which case nothing should be kept. The errors are
+	// answered to the client as those of ServeRead, before the final ACK,
+	// and ErrAllocationExceeded with ERROR 3
+	ServeWrite(req *Request, r io.Reader) (string, error)
+}
+
+// WriteHandlerFunc allows the use of a function as a WriteHandler
+type WriteHandlerFunc func(req *Request, r io.Reader) (string, error)
+
+// ServeWrite calls f(req, r)
+func (f WriteHandlerFunc) ServeWrite(req *Request, r io.Reader) (string, error) {
+	return f(req, r)
+}
+
+// Router dispatches the requests to the handlers registered for the
+// patterns matching the requested path. The patterns are those of
+// path.Match, and a pattern ending with a slash matches every path in
+// that directory. Patterns are tried in the order they have been
+// registered. Requests matching no pattern are served from the root
+// directory of the configuration
+type Router struct {
+	mu          sync.RWMutex
+	readRoutes  []route
+	writeRoutes []route
+	hooks       []route
+}
+
+// route associates a pattern to a ReadHandler, a WriteHandler or a Hook
+type route struct {
+	pattern string
+	handler interface{}
+}
+
+func NewRouter() *Router {
+	return new(Router)
+}
+
+// HandleRead registers the handler of the read requests matching the pattern.
+// It panics if the pattern is malformed
+func (r *Router) HandleRead(pattern string, handler ReadHandler) {
+	r.add(&r.readRoutes, pattern, handler)
+}
+
+// HandleReadFunc registers the handler function of the read requests
+// matching the pattern
+func (r *Router) HandleReadFunc(pattern string, handler func(req *Request) (io.Reader, int64, error)) {
+	r.HandleRead(pattern, ReadHandlerFunc(handler))
+}
+
+// HandleWrite registers the handler of the write requests matching the
+// pattern. It panics if the pattern is malformed
+func (r *Router) HandleWrite(pattern string, handler WriteHandler) {
+	r.add(&r.writeRoutes, pattern, handler)
+}
+
+// HandleWriteFunc registers the handler function of the write requests
+// matching the pattern
+func (r *Router) HandleWriteFunc(pattern string, handler func(req *Request, r io.Reader) (string, error)) {
+	r.HandleWrite(pattern, WriteHandlerFunc(handler))
+}
+
+// AfterWrite registers a hook called once an upload matching the pattern
+// has been stored. Every matching hook is called, in the order they have
+// been registered. It panics if the pattern is malformed
+func (r *Router) AfterWrite(pattern string, hook Hook) {
+	r.add(&r.hooks, pattern, hook)
+}
+
+func (r *Router) add(routes *[]route, pattern string, handler interface{}) {
+	pattern = cleanPattern(pattern)
+	if err := validPattern(pattern); err != nil {
+		panic(fmt.Sprintf("server: %v", err))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	*routes = append(*routes, route{pattern: pattern, handler: handler})
+}
+
+// match returns the handlers of the routes matching the requested path
+func (r *Router) match(routes []route, filename string) []interface{} {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var handlers []interface{}
+	filename = cleanPath(filename)
+	for _, route := range routes {
+		if matchPattern(route.pattern, filename) {
+			handlers = append(handlers, route.handler)
+		}
+	}
+	return handlers
+}
+
+// readHandler returns the handler of the requested path, if any
+func (r *Router) readHandler(filename string) (ReadHandler, bool) {
+	if r == nil {
+		return nil, false
+	}
+	handlers := r.match(r.readRoutes, filename)
+	if len(handlers) == 0 {
+		return nil, false
+	}
+	return handlers[0].(ReadHandler), true
+}
+
+// writeHandler returns the handler of the uploaded path, if any
+func (r *Router) writeHandler(filename string) (WriteHandler, bool) {
+	if r == nil {
+		return nil, false
+	}
+	handlers := r.match(r.writeRoutes, filename)
+	if len(handlers) == 0 {
+		return nil, false
+	}
+	return handlers[0].(WriteHandler), true
+}
+
+// cleanPath returns the path without leading slash and without dot segments
+func cleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// cleanPattern is cleanPath keeping the trailing slash of directory patterns
+func cleanPattern(pattern string) string {
+	if strings.HasSuffix(pattern, "/") {
+		return cleanPath(pattern) + "/"
+	}
+	return cleanPath(pattern)
+}
+
+// validPattern checks the syntax of a pattern
+func validPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+func matchPattern(pattern string, name string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(name, pattern)
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// staticFiles serves the files of a directory
+type staticFiles struct {
+	root string
+	// caseInsensitive looks for a file differing only by case
+	// when the requested one does not exist
+	caseInsensitive bool
+	// templates renders the missing files from their template, if any
+	templates *templates.Renderer
+	// pxe serves the missing pxelinux.cfg files as PXELINUX falls back
+	pxe bool
+	// checksums serves the digest of the files as <file>.sha256 when set
+	checksums *checksumCache
+}
+
+// staticFiles returns the backend serving the root directory of the configuration
+func (s *Server) staticFiles(cfg *config.Config) staticFiles {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := staticFiles{
+		root:            cfg.Root,
+		caseInsensitive: cfg.Paths.CaseInsensitive,
+		templates:       s.templates,
+		pxe:             cfg.Profile == config.ProfilePXE,
+	}
+	if cfg.Checksums.Files {
+		files.checksums = s.checksums
+	}
+	return files
+}
+
+func (files staticFiles) ServeRead(req *Request) (io.Reader, int64, error) {
+	content, size, err := files.serve(req, req.Filename)
+	if !os.IsNotExist(errors.Cause(err)) || !files.pxe {
+		return content, size, err
+	}
+
+	for _, fallback := range pxeFallbacks(req.Filename, req.ClientAddr.IP) {
+		content, size, fallbackErr := files.serve(req, fallback)
+		if fallbackErr == nil {
+			return content, size, nil
+		}
+		if !os.IsNotExist(errors.Cause(fallbackErr)) {
+			return nil, 0, fallbackErr
+		}
+	}
+	return nil, 0, err
+}
+
+// serve returns the content of the file, or renders its template if it is
+// missing. A missing <file>.sha256 gives the digest of <file> if enabled
+func (files staticFiles) serve(req *Request, filename string) (io.Reader, int64, error) {
+	file, err := files.open(filename)
+	if os.IsNotExist(errors.Cause(err)) && files.templates != nil {
+		if template, templateErr := files.open(filename + files.templates.Suffix); templateErr == nil {
+			template.Close()
+			return files.render(req, template.Name())
+		}
+	}
+	if os.IsNotExist(errors.Cause(err)) && files.checksums != nil && strings.HasSuffix(filename, checksumSuffix) {
+		return files.checksum(req, filename)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, 0, errors.Wrapf(ErrFileNotFound, "%s is a directory", filename)
+	}
+
+	return file, info.Size(), nil
+}
+
+// open opens the requested file, ignoring its case if needed
+func (files staticFiles) open(filename string) (*os.File, error) {
+	file, err := os.Open(resolvePath(files.root, filename))
+	if os.IsNotExist(err) && files.caseInsensitive {
+		var name string
+		if name, err = findFold(files.root, filename); err == nil {
+			file, err = os.Open(name)
+		}
+	}
+
+	return file, err
+}
+
+// render renders the template of the requested file. The whole content is
+// rendered before the transfer starts, so that its size is known
+func (files staticFiles) render(req *Request, template string) (io.Reader, int64, error) {
+	data, err := files.templates.NewData(req.ClientAddr.IP, req.Filename, req.RequestedFilename)
+	if err != nil {
+		return nil, 0, err
+	}
+	rendered, err := files.templates.Render(template, data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return bytes.NewReader(rendered), int64(len(rendered)), nil
+}
+
+// findFold returns the location in the root directory of the file whose
+// path only differs by case from the requested one. Exact matches are
+// preferred at each level of the path
+func findFold(root string, filename string) (string, error) {
+	location := root
+	for _, element := range strings.Split(cleanPath(filename), "/") {
+		entries, err := os.ReadDir(location)
+		if err != nil {
+			return "", err
+		}
+
+		var found string
+		for _, entry := range entries {
+			if entry.Name() == element {
+				found = element
+				break
+			}
+			if found == "" && strings.EqualFold(entry.Name(), element) {
+				found = entry.Name()
+			}
+		}
+		if found == "" {
+			return "", errors.Wrapf(os.ErrNotExist, "no file matching %s", filename)
+		}
+		location = filepath.Join(location, found)
+	}
+
+	return location, nil
+}
+
+// ServeWrite stores the uploaded file at the top of the directory, under
+// the last element of the requested path. The content is written to a
+// temporary file first, renamed once the upload is complete
+func (files staticFiles) ServeWrite(req *Request, r io.Reader) (string, error) {
+	name := filepath.Join(files.root, path.Base(cleanPath(req.Filename)))
+	file, err := ioutil.TempFile(files.root, "."+filepath.Base(name)+".*"+partialSuffix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(file.Name(), name); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// newRequest describes a request to the handlers, applying the rewrite
+// rules of the configuration to the requested path
+func (s *Server) newRequest(sess *session, clientAddr *net.UDPAddr, filename string, mode packets.Mode, options map[string]string, cfg *config.Config) *Request {
+	rewritten := cfg.RewritePath(filename)
+	if rewritten != filename {
+		s.sessionLogger(sess).Info("The requested path %s has been rewritten to %s", filename, rewritten)
+	}
+
+	return &Request{
+		ClientAddr:        clientAddr,
+		Filename:          rewritten,
+		RequestedFilename: filename,
+		Mode:              mode,
+		Options:           options,
+	}
+}
+
+// openRead returns the content of the file requested by a read request,
+// either from the handler registered for its path or from the root directory
+func (s *Server) openRead(req *Request, cfg *config.Config) (io.Reader, int64, error) {
+	handler, ok := s.Router.readHandler(req.Filename)
+	if !ok {
+		handler = s.staticFiles(cfg)
+	}
+
+	return handler.ServeRead(req)
+}
+
+// seekContent moves the content of a resumed read to the offset, which
+// requires it to be seekable
+func seekContent(content io.Reader, offset int64) error {
+	seeker, ok := content.(io.Seeker)
+	if !ok {
+		return errors.Errorf("the content cannot be read from byte %d", offset)
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "cannot read the content from byte %d", offset)
+	}
+	return nil
+}
+
+// errorPacketFor returns the ERROR packet answering a request that
+// cannot be served because of err
+func errorPacketFor(filename string, err error) packets.ErrorPacket {
+	switch {
+	case errors.Is(err, ErrFileNotFound) || os.IsNotExist(errors.Cause(err)):
+		return packets.NewErrorPacket(1, fmt.Sprintf("File %s has not been found in the server", filename))
+	case errors.Is(err, ErrAccessViolation) || os.IsPermission(errors.Cause(err)):
+		return packets.NewErrorPacket(2, "Access violation")
+	case errors.Is(err, ErrAllocationExceeded) || errors.Is(err, syscall.ENOSPC):
+		return packets.NewErrorPacket(3, "Disk full or allocation exceeded")
+	default:
+		return packets.NewErrorPacket(0, err.Error())
+	}
+}
+
+// writeStream passes the blocks of an upload to its write handler,
+// which runs in its own goroutine
+type writeStream struct {
+	pipe   *io.PipeWriter
+	digest hash.Hash
+	size   int64
+	done   chan writeResult
+	result *writeResult
+}
+
+type writeResult struct {
+	path string
+	err  error
+}
+
+// openWrite starts the handler storing the file uploaded by a write request,
+// either the one registered for its path or the root directory
+func (s *Server) openWrite(req *Request, cfg *config.Config) *writeStream {
+	handler, ok := s.Router.writeHandler(req.Filename)
+	if !ok {
+		handler = s.staticFiles(cfg)
+	}
+
+	reader, writer := io.Pipe()
+	stream := &writeStream{pipe: writer, digest: sha256.New(), done: make(chan writeResult, 1)}
+	go func() {
+		path, err := handler.ServeWrite(req, reader)
+		// Blocks the handler has not read make the transfer fail
+		reader.Close()
+		stream.done <- writeResult{path: path, err: err}
+	}()
+
+	return stream
+}
+
+// write passes a block to the handler
+func (w *writeStream) write(block []byte) error {
+	w.digest.Write(block)
+	w.size += int64(len(block))
+	if _, err := w.pipe.Write(block); err != nil {
+		result := w.wait()
+		if result.err != nil {
+			return result.err
+		}
+		return errors.New("the upload has not been entirely consumed")
+	}
+	return nil
+}
+
+// close marks the end of the upload and returns the outcome of the handler
+func (w *writeStream) close() (string, error) {
+	w.pipe.Close()
+	result := w.wait()
+	return result.path, result.err
+}
+
+// abort interrupts the handler of an upload that has failed
+func (w *writeStream) abort(err error) {
+	w.pipe.CloseWithError(err)
+	w.wait()
+}
+
+func (w *writeStream) wait() writeResult {
+	if w.result == nil {
+		result := <-w.done
+		w.result = &result
+	}
+	return *w.result
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/pkg/errors"
+)
+
+// serveName registers a read handler answering with its name
+func serveName(router *Router, pattern string, name string) {
+	router.HandleReadFunc(pattern, func(req *Request) (io.Reader, int64, error) {
+		return strings.NewReader(name), int64(len(name)), nil
+	})
+}
+
+// expectRemoteError checks that err is the ERROR of the server with the code
+func expectRemoteError(t *testing.T, err error, code uint16) {
+	t.Helper()
+	if remoteErr, ok := err.(*client.RemoteError); !ok || remoteErr.Code != code {
+		t.Errorf("expected ERROR %d, got %v", code, err)
+	}
+}
+
+// TestReadRouting expects a request to be served by the first handler
+// whose pattern matches its path, and by the root directory otherwise
+func TestReadRouting(t *testing.T) {
+	s, serverAddr := startServer(t, func(s *Server) {
+		serveName(s.Router, "generated/*", "generated")
+		serveName(s.Router, "boot/", "boot")
+		serveName(s.Router, "*.cfg", "cfg")
+	})
+	writeFile(t, s.Config().Root, "static.bin", []byte("static"))
+
+	tests := []struct {
+		filename string
+		// served is empty when the file is expected not to be found
+		served string
+	}{
+		{"generated/boot.cfg", "generated"},
+		{"/generated/../generated/boot.cfg", "generated"},
+		{"boot/x86/wdsnbp.com", "boot"},
+		{"switch.cfg", "cfg"},
+		{"static.bin", "static"},
+		{"generated/sub/file", ""},
+	}
+
+	c := newClient()
+	for _, test := range tests {
+		var received bytes.Buffer
+		err := c.ReceiveFile(serverAddr, test.filename, &received)
+		if test.served == "" {
+			expectRemoteError(t, err, 1)
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.filename, err)
+		} else if received.String() != test.served {
+			t.Errorf("%s has been served by %q, expected %q", test.filename, received.String(), test.served)
+		}
+	}
+}
+
+// TestReadHandlerOfUnknownSize expects content of unknown size to be sent
+// without acknowledging the tsize option
+func TestReadHandlerOfUnknownSize(t *testing.T) {
+	s, serverAddr := startServer(t, func(s *Server) {
+		s.Router.HandleReadFunc("generated/*", func(req *Request) (io.Reader, int64, error) {
+			return strings.NewReader("client " + req.ClientAddr.IP.String() + " file " + req.Filename), -1, nil
+		})
+	})
+
+	p := newPeer(t, serverAddr)
+	request := packets.NewRRQPacket("generated/boot.cfg", packets.Octet)
+	request.Options = map[string]string{packets.OptionTsize: "0"}
+	p.Send(request)
+	expected := "client 127.0.0.1 file generated/boot.cfg"
+	if data := p.ExpectData(1, len(expected)); string(data.Data) != expected {
+		t.Errorf("received %q, expected %q", data.Data, expected)
+	}
+	p.Send(packets.NewAckPacket(1))
+	expectResult(t, s, "generated/boot.cfg", ResultSuccess)
+}
+
+// TestReadHandlerErrors expects the errors of a read handler to be
+// answered with the ERROR code matching them
+func TestReadHandlerErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		code uint16
+	}{
+		{ErrFileNotFound, 1},
+		{errors.Wrap(ErrAccessViolation, "private"), 2},
+		{errors.New("backend unavailable"), 0},
+	}
+
+	_, serverAddr := startServer(t, func(s *Server) {
+		for i, test := range tests {
+			err := test.err
+			s.Router.HandleReadFunc("failing/"+string(rune('a'+i)), func(req *Request) (io.Reader, int64, error) {
+				return nil, 0, err
+			})
+		}
+	})
+
+	c := newClient()
+	for i, test := range tests {
+		expectRemoteError(t, c.ReceiveFile(serverAddr, "failing/"+string(rune('a'+i)), &bytes.Buffer{}), test.code)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{"boot/", "boot/x86/wdsnbp.com", true},
+		{"boot/", "bootx64.efi", false},
+		{"/boot/../boot/", "/boot/pxelinux.0", true},
+		{"*.cfg", "switch.cfg", true},
+		{"*.cfg", "generated/switch.cfg", false},
+		{"generated/*", "generated/boot.cfg", true},
+		{"generated/*", "generated/sub/file", false},
+	}
+
+	for _, test := range tests {
+		if matched := matchPattern(cleanPattern(test.pattern), cleanPath(test.name)); matched != test.matched {
+			t.Errorf("%q matched by %q: %v, expected %v", test.name, test.pattern, matched, test.matched)
+		}
+	}
+}
+
+// TestPathRewrite expects the requested paths to be rewritten before being
+// looked up, ignoring the case of the files when needed
+func TestPathRewrite(t *testing.T) {
+	s, serverAddr := startServer(t, func(s *Server) {
+		cfg := *s.Config()
+		cfg.Paths.CaseInsensitive = true
+		cfg.Paths.Rewrites = []config.Rewrite{
+			{Match: `^pxelinux\.cfg/01-([0-9a-f-]+)$`, Replace: "hosts/$1.cfg"},
+		}
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+	})
+	root := s.Config().Root
+	for _, directory := range []string{"boot/x86", "hosts"} {
+		if err := os.MkdirAll(filepath.Join(root, directory), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, root, "boot/x86/wdsnbp.com", []byte("loader"))
+	writeFile(t, root, "hosts/aa-bb-cc-dd-ee-ff.cfg", []byte("host"))
+
+	tests := []struct {
+		requested string
+		served    string
+	}{
+		{`\Boot\x86\WDSNBP.COM`, "loader"},
+		{"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", "host"},
+		{"HOSTS/AA-BB-CC-DD-EE-FF.CFG", "host"},
+	}
+
+	c := newClient()
+	for _, test := range tests {
+		var received bytes.Buffer
+		if err := c.ReceiveFile(serverAddr, test.requested, &received); err != nil {
+			t.Errorf("%s: %v", test.requested, err)
+		} else if received.String() != test.served {
+			t.Errorf("%s: got %q, expected %q", test.requested, received.String(), test.served)
+		}
+	}
+	expectRemoteError(t, c.ReceiveFile(serverAddr, "pxelinux.cfg/01-11-22-33-44-55-66", &bytes.Buffer{}), 1)
+}
+
+// TestTemplate expects a missing file to be rendered from its template with
+// the values of the inventory for the client, announcing its size
+func TestTemplate(t *testing.T) {
+	_, serverAddr := startServer(t, func(s *Server) {
+		root := s.Config().Root
+		if err := os.Mkdir(filepath.Join(root, "pxelinux.cfg"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, root, "inventory.csv", []byte("ip,mac,hostname\n127.0.0.1,,local\n,aa-bb-cc-dd-ee-ff,node1\n"))
+		writeFile(t, root, "pxelinux.cfg/host.tmpl", []byte("host {{.Vars.hostname}} mac {{.MAC}} ip {{.IP}}\n"))
+
+		cfg := *s.Config()
+		cfg.Templates = config.Templates{Suffix: ".tmpl", Inventory: filepath.Join(root, "inventory.csv")}
+		cfg.Paths.Rewrites = []config.Rewrite{{Match: `^pxelinux\.cfg/01-[0-9a-f-]+$`, Replace: "pxelinux.cfg/host"}}
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	p := newPeer(t, serverAddr)
+	expected := "host node1 mac aa:bb:cc:dd:ee:ff ip 127.0.0.1\n"
+	request := packets.NewRRQPacket("pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", packets.Octet)
+	request.Options = map[string]string{packets.OptionTsize: "0"}
+	p.Send(request)
+	p.ExpectOACK(map[string]string{packets.OptionTsize: strconv.Itoa(len(expected))})
+	p.Send(packets.NewAckPacket(0))
+	if data := p.ExpectData(1, len(expected)); string(data.Data) != expected {
+		t.Errorf("got %q, expected %q", data.Data, expected)
+	}
+	p.Send(packets.NewAckPacket(1))
+
+	// A client missing from the inventory by MAC is found by IP
+	c := newClient()
+	var received bytes.Buffer
+	if err := c.ReceiveFile(serverAddr, "pxelinux.cfg/01-11-22-33-44-55-66", &received); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "host local mac 11:22:33:44:55:66 ip 127.0.0.1\n"; received.String() != expected {
+		t.Errorf("got %q, expected %q", received.String(), expected)
+	}
+}
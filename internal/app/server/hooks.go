@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/pkg/errors"
+)
+
+// Upload describes a file received from a client, passed to the hooks
+type Upload struct {
+	Request *Request
+	// Path is the location of the stored file returned by the write
+	// handler, empty if the content has not been stored in a file
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// Hook is called once an upload has been stored and acknowledged.
+// Its error is logged, as the transfer has already succeeded
+type Hook func(upload *Upload) error
+
+// runHooks calls the hooks registered on the router and runs the commands
+// of the configuration whose pattern matches the uploaded path
+func (s *Server) runHooks(sess *session, upload *Upload, cfg *config.Config) {
+	log := s.sessionLogger(sess)
+
+	for _, hook := range s.Router.match(s.Router.hooks, upload.Request.Filename) {
+		if err := hook.(Hook)(upload); err != nil {
+			log.Error("The hook of the upload has failed: %v", err)
+		}
+	}
+
+	filename := cleanPath(upload.Request.Filename)
+	for _, hook := range cfg.Hooks {
+		if !matchPattern(cleanPattern(hook.Pattern), filename) {
+			continue
+		}
+		log.Debug("Running hook %s", strings.Join(hook.Command, " "))
+		if err := runCommand(hook, upload, cfg.Root); err != nil {
+			log.Error("The hook %s has failed: %v", hook.Command[0], err)
+		}
+	}
+}
+
+// runCommand runs the command of a hook in the root directory, describing
+// the upload with TFTP_ environment variables
+func runCommand(hook config.Hook, upload *Upload, root string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Dir = root
+	cmd.Env = append(os.Environ(),
+		"TFTP_PATH="+upload.Path,
+		"TFTP_FILENAME="+upload.Request.Filename,
+		"TFTP_MODE="+string(upload.Request.Mode),
+		"TFTP_CLIENT_IP="+upload.Request.ClientAddr.IP.String(),
+		"TFTP_CLIENT_PORT="+strconv.Itoa(upload.Request.ClientAddr.Port),
+		"TFTP_SIZE="+strconv.FormatInt(upload.Size, 10),
+		"TFTP_SHA256="+upload.SHA256,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("killed after %v", hook.Timeout)
+	}
+	if err != nil && len(output) > 0 {
+		return errors.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+// TestWriteHandler expects an upload to be passed to the handler of its
+// path, and the hooks to be called once the transfer has completed
+func TestWriteHandler(t *testing.T) {
+	expected := content(1500)
+	var stored bytes.Buffer
+	uploads := make(chan *Upload, 1)
+	s, serverAddr := startServer(t, func(s *Server) {
+		s.Router.HandleWriteFunc("backups/", func(req *Request, r io.Reader) (string, error) {
+			_, err := io.Copy(&stored, r)
+			return "", err
+		})
+		s.Router.AfterWrite("backups/*.cfg", func(upload *Upload) error {
+			uploads <- upload
+			return nil
+		})
+	})
+
+	c := newClient()
+	if err := c.SendFile(serverAddr, "backups/switch.cfg", bytes.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, s, "backups/switch.cfg", ResultSuccess)
+	if !bytes.Equal(stored.Bytes(), expected) {
+		t.Errorf("the handler has stored %d bytes, expected %d", stored.Len(), len(expected))
+	}
+
+	sum := sha256.Sum256(expected)
+	select {
+	case upload := <-uploads:
+		if upload.Size != int64(len(expected)) || upload.Request.Filename != "backups/switch.cfg" || upload.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("unexpected upload passed to the hook: %+v", upload)
+		}
+	default:
+		t.Error("the hook has not been called")
+	}
+	if _, err := os.Stat(filepath.Join(s.Config().Root, "switch.cfg")); !os.IsNotExist(err) {
+		t.Error("the upload has also been stored in the root directory")
+	}
+}
+
+// TestWriteHandlerError expects the error of the write handler to be
+// answered with an ERROR packet instead of the final ACK, without calling
+// the hooks
+func TestWriteHandlerError(t *testing.T) {
+	hooked := make(chan *Upload, 1)
+	s, serverAddr := startServer(t, func(s *Server) {
+		s.Router.HandleWriteFunc("readonly/*", func(req *Request, r io.Reader) (string, error) {
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				return "", err
+			}
+			return "", ErrAccessViolation
+		})
+		s.Router.AfterWrite("readonly/*", func(upload *Upload) error {
+			hooked <- upload
+			return nil
+		})
+	})
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewWRQPacket("readonly/file", packets.Octet))
+	p.ExpectAck(0)
+	p.Send(packets.NewDataPacket(1, content(100)))
+	p.ExpectError(2)
+	expectResult(t, s, "readonly/file", ResultFailure)
+	if len(hooked) > 0 {
+		t.Error("the hook of a failed upload has been called")
+	}
+}
+
+// TestHookCommand expects the command of a hook to run in the root
+// directory with the upload described by its environment
+func TestHookCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to run the hook")
+	}
+	s, serverAddr := startServer(t, func(s *Server) {
+		cfg := *s.Config()
+		cfg.Hooks = []config.Hook{{
+			Pattern: "*.cfg",
+			Command: []string{"sh", "-c", `echo "$TFTP_FILENAME $TFTP_SIZE $TFTP_CLIENT_IP" > hook.out`},
+			Timeout: 10 * time.Second,
+		}}
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	c := newClient()
+	for _, filename := range []string{"image.bin", "switch.cfg"} {
+		if err := c.SendFile(serverAddr, filename, bytes.NewReader(content(700))); err != nil {
+			t.Fatal(err)
+		}
+		expectResult(t, s, filename, ResultSuccess)
+	}
+
+	output, err := ioutil.ReadFile(filepath.Join(s.Config().Root, "hook.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "switch.cfg 700 127.0.0.1\n" {
+		t.Errorf("the hook has written %q", output)
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/metrics"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+// TestMetrics expects the metrics scraped after a few transfers to count
+// their outcomes, their bytes and the ERROR packets sent
+func TestMetrics(t *testing.T) {
+	s, serverAddr := startServer(t, func(s *Server) {
+		s.Metrics = metrics.NewMetrics()
+		cfg := *s.Config()
+		cfg.ACL = []config.Rule{{Network: "127.0.0.1", Read: true}}
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+	})
+	writeFile(t, s.Config().Root, "read.bin", content(1500))
+
+	reader := newPeer(t, serverAddr)
+	reader.Send(packets.NewRRQPacket("read.bin", packets.Octet))
+	for block, size := range []int{512, 512, 476} {
+		reader.ExpectData(uint16(block+1), size)
+		reader.Send(packets.NewAckPacket(uint16(block + 1)))
+	}
+	missing := newPeer(t, serverAddr)
+	missing.Send(packets.NewRRQPacket("missing.bin", packets.Octet))
+	missing.ExpectError(1)
+	writer := newPeer(t, serverAddr)
+	writer.Send(packets.NewWRQPacket("write.bin", packets.Octet))
+	writer.ExpectError(2)
+	s.Stop()
+
+	recorder := httptest.NewRecorder()
+	s.Metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	scraped := recorder.Body.String()
+	for _, line := range []string{
+		`tftp_requests_total{opcode="RRQ",outcome="success"} 1`,
+		`tftp_requests_total{opcode="RRQ",outcome="failure"} 1`,
+		`tftp_requests_total{opcode="WRQ",outcome="denied"} 1`,
+		`tftp_bytes_sent_total 1500`,
+		`tftp_active_sessions 0`,
+		`tftp_errors_sent_total{code="1"} 1`,
+		`tftp_errors_sent_total{code="2"} 1`,
+		`tftp_transfer_duration_seconds_count{opcode="RRQ"} 1`,
+	} {
+		if !strings.Contains(scraped, line+"\n") {
+			t.Errorf("the metrics do not hold %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(scraped)
+	}
+}
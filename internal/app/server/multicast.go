@@ -0,0 +1,507 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"github.com/mirkoschicchi/TFTP/internal/app/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxMulticastBlocks is the number of blocks a multicast transfer can
+	// send. The block numbers cannot wrap around, as the late joiners
+	// acknowledging them would be ambiguous, so the larger files are sent
+	// with unicast transfers, which wrap around
+	maxMulticastBlocks = 65535
+	// multicastJoinQueueSize is the number of clients which can be waiting
+	// to join a multicast transfer
+	multicastJoinQueueSize = 256
+)
+
+// multicastTransfer sends a file to the clients having requested it with the
+// multicast option, following RFC 2090. The DATA packets are sent to the
+// group from the port of the transfer, which is the TID of the server for
+// every member. The first member is the master client, acknowledging the
+// blocks one at a time while the others listen. Once the master has received
+// the whole file or has left, the next member becomes master and acknowledges
+// the last block it has received in sequence, so that the blocks it has
+// missed after joining late are sent again. The timeout of the transfer is
+// the one negotiated by its master
+type multicastTransfer struct {
+	key       string
+	content   io.ReaderAt
+	size      int64
+	blocks    int
+	blockSize int
+	timeout   time.Duration
+	group     *net.UDPAddr
+	conn      net.PacketConn
+	joins     chan *multicastMember
+	received  chan multicastPacket
+	stopped   chan struct{}
+	timer     *time.Timer
+	digest    hash.Hash
+	hashed    int
+	sum       []byte
+	buf       []byte
+	members   []*multicastMember
+	master    *multicastMember
+	pending   packets.Packet
+	pendingTo *net.UDPAddr
+	// throttled is the block waiting for the bandwidth limits of the
+	// master, sent once the release timer fires
+	throttled *packets.DataPacket
+	release   *time.Timer
+	// expected is the lowest block the master can acknowledge
+	expected        int
+	retransmissions int
+}
+
+// multicastMember is a client taking part in a multicast transfer
+type multicastMember struct {
+	sess *session
+	// accepted are the options negotiated with the client, acknowledged
+	// together with the multicast option
+	accepted map[string]string
+	timeout  time.Duration
+	// acked is the last block acknowledged by the client
+	acked int
+	// done receives the outcome of the transfer for the client
+	done chan error
+}
+
+type multicastPacket struct {
+	from   *net.UDPAddr
+	packet interface{}
+}
+
+// multicastContent returns the content of a read negotiating the multicast
+// option, which must be allowed and requested, and cannot be combined with
+// a resumed read. The content needs to be read at any offset, as the blocks
+// are sent again to the clients joining late. The content is nil when the
+// option has not been requested, and the error tells why it is declined
+func multicastContent(requested map[string]string, reader io.Reader, size int64, options sessionOptions, group *net.UDPAddr) (io.ReaderAt, error) {
+	if _, ok := requested[packets.OptionMulticast]; !ok {
+		return nil, nil
+	}
+	if group == nil {
+		return nil, errors.New("no multicast group is configured")
+	}
+	if size < 0 || options.offset > 0 {
+		return nil, errors.New("the content is not sent from its start with a known size")
+	}
+	content, ok := reader.(io.ReaderAt)
+	if !ok {
+		return nil, errors.New("the content cannot be read at any offset")
+	}
+	if blocks := multicastBlocks(size, options.blockSize); blocks > maxMulticastBlocks {
+		return nil, errors.Errorf("the file has %d blocks of %d bytes, more than the %d block numbers of a multicast transfer", blocks, options.blockSize, maxMulticastBlocks)
+	}
+	return content, nil
+}
+
+// multicastBlocks returns the number of blocks of a file, the last one
+// being shorter than the others and possibly empty
+func multicastBlocks(size int64, blockSize int) int64 {
+	return size/int64(blockSize) + 1
+}
+
+// serveMulticast makes the client of the session a member of the multicast
+// transfer of the file, starting it if needed, and waits for the outcome.
+// The content is closed once it is not needed anymore
+func (s *Server) serveMulticast(sess *session, filename string, content io.ReaderAt, size int64, accepted map[string]string, options sessionOptions, group *net.UDPAddr) error {
+	key := fmt.Sprintf("%s:%d", filename, options.blockSize)
+	member := &multicastMember{sess: sess, accepted: accepted, timeout: options.timeout, done: make(chan error, 1)}
+	sess.tracker.SetTotal(size)
+
+	s.multicastMu.Lock()
+	transfer, ok := s.multicasts[key]
+	if ok {
+		if closer, ok := content.(io.Closer); ok {
+			closer.Close()
+		}
+	} else {
+		conn, err := s.Network.ListenPacket(fmt.Sprintf(":%d", utils.GetRandomTID()))
+		if err != nil {
+			s.multicastMu.Unlock()
+			if closer, ok := content.(io.Closer); ok {
+				closer.Close()
+			}
+			return errors.Wrap(err, "cannot open the connection of the multicast transfer")
+		}
+		transfer = newMulticastTransfer(key, content, size, options.blockSize, group, conn)
+		s.multicasts[key] = transfer
+		go s.runMulticast(transfer)
+	}
+	select {
+	case transfer.joins <- member:
+	default:
+		s.multicastMu.Unlock()
+		return errors.New("too many clients are joining the multicast transfer")
+	}
+	s.multicastMu.Unlock()
+
+	sess.attach(transfer.conn)
+	s.sessionLogger(sess).Info("Client %+v has joined the multicast transfer of %s", sess.peer, filename)
+	return <-member.done
+}
+
+func newMulticastTransfer(key string, content io.ReaderAt, size int64, blockSize int, group *net.UDPAddr, conn net.PacketConn) *multicastTransfer {
+	timer := time.NewTimer(time.Second)
+	timer.Stop()
+	release := time.NewTimer(time.Second)
+	release.Stop()
+
+	return &multicastTransfer{
+		key:       key,
+		content:   content,
+		size:      size,
+		blocks:    int(multicastBlocks(size, blockSize)),
+		blockSize: blockSize,
+		group:     group,
+		conn:      conn,
+		joins:     make(chan *multicastMember, multicastJoinQueueSize),
+		received:  make(chan multicastPacket),
+		stopped:   make(chan struct{}),
+		timer:     timer,
+		release:   release,
+		digest:    sha256.New(),
+		buf:       make([]byte, blockSize),
+	}
+}
+
+// runMulticast handles the members of a transfer until none is left
+func (s *Server) runMulticast(t *multicastTransfer) {
+	defer func() {
+		close(t.stopped)
+		t.timer.Stop()
+		t.release.Stop()
+		t.conn.Close()
+		if closer, ok := t.content.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+	go s.readMulticast(t)
+
+	for {
+		select {
+		case member := <-t.joins:
+			s.joinMulticast(t, member)
+		case received := <-t.received:
+			s.handleMulticast(t, received)
+		case <-t.timer.C:
+			s.multicastTimeout(t)
+		case <-t.release.C:
+			s.releaseBlock(t)
+		}
+
+		for _, member := range t.members {
+			if member.sess.isCanceled() {
+				s.leaveMulticast(t, member, errCanceled)
+			}
+		}
+		if len(t.members) == 0 && s.endMulticast(t) {
+			return
+		}
+	}
+}
+
+// endMulticast removes a transfer without members from the registry,
+// unless a client is about to join it
+func (s *Server) endMulticast(t *multicastTransfer) bool {
+	s.multicastMu.Lock()
+	defer s.multicastMu.Unlock()
+
+	if len(t.joins) > 0 {
+		return false
+	}
+	delete(s.multicasts, t.key)
+	return true
+}
+
+// readMulticast passes the packets received by the transfer to its loop
+func (s *Server) readMulticast(t *multicastTransfer) {
+	buf := make([]byte, packets.TftpMaxPacketSize)
+	for {
+		n, addr, err := t.conn.ReadFrom(buf)
+		if isTimeout(err) {
+			// Canceling a session interrupts the reads of its connection
+			t.conn.SetReadDeadline(time.Time{})
+			continue
+		}
+		if err != nil {
+			return
+		}
+		remoteAddr := transport.UDPAddr(addr)
+		s.Tracer.Received(t.conn.LocalAddr(), remoteAddr, buf[:n])
+
+		packet, err := packets.ParsePacket(buf[:n])
+		if err != nil {
+			s.Logger.Warning("Cannot parse the packet received from %+v: %v", remoteAddr, err)
+			continue
+		}
+		select {
+		case t.received <- multicastPacket{from: remoteAddr, packet: packet}:
+		case <-t.stopped:
+			return
+		}
+	}
+}
+
+// joinMulticast adds a member, making it master if there is none. A client
+// requesting the file again has not received its OACK, which is sent again
+func (s *Server) joinMulticast(t *multicastTransfer, member *multicastMember) {
+	for _, other := range t.members {
+		if transport.SameAddr(other.sess.peer, member.sess.peer) {
+			s.sendMulticastOACK(t, other, other == t.master)
+			member.done <- errors.New("the client is already a member of the multicast transfer")
+			return
+		}
+	}
+
+	t.members = append(t.members, member)
+	if t.master != nil {
+		s.sendMulticastOACK(t, member, false)
+		return
+	}
+	s.electMaster(t)
+}
+
+// electMaster makes the first member master, which is told so by an OACK
+func (s *Server) electMaster(t *multicastTransfer) {
+	t.master = nil
+	t.pending = nil
+	t.throttled = nil
+	stopTimer(t.timer)
+	stopTimer(t.release)
+	if len(t.members) == 0 {
+		return
+	}
+
+	t.master = t.members[0]
+	t.timeout = t.master.timeout
+	t.expected = 0
+	t.retransmissions = 0
+	s.sendMulticastOACK(t, t.master, true)
+	s.sessionLogger(t.master.sess).Debug("Client %+v is the master client of the multicast transfer", t.master.sess.peer)
+}
+
+func (s *Server) sendMulticastOACK(t *multicastTransfer, member *multicastMember, master bool) {
+	options := map[string]string{packets.OptionMulticast: packets.Multicast{Group: t.group, Master: master}.String()}
+	for name, value := range member.accepted {
+		options[name] = value
+	}
+	member.sess.setOptions(options)
+
+	oackPacket := packets.NewOACKPacket(options)
+	if _, err := s.send(member.sess, t.conn, oackPacket); err != nil {
+		s.sessionLogger(member.sess).Error("Cannot send OACK packet to client %+v: %v", member.sess.peer, err)
+	}
+	if master {
+		t.pending, t.pendingTo = oackPacket, member.sess.peer
+		resetTimer(t.timer, t.timeout)
+	}
+}
+
+// handleMulticast handles a packet sent by a client to the transfer
+func (s *Server) handleMulticast(t *multicastTransfer, received multicastPacket) {
+	var member *multicastMember
+	for _, m := range t.members {
+		if transport.SameAddr(m.sess.peer, received.from) {
+			member = m
+		}
+	}
+	if member == nil {
+		s.Logger.Warning("Ignoring packet of unknown transfer ID from %+v", received.from)
+		s.refuse(t.conn, received.from, packets.NewErrorPacket(5, "Unknown transfer ID"))
+		return
+	}
+
+	switch packet := received.packet.(type) {
+	case packets.ErrorPacket:
+		s.leaveMulticast(t, member, &abortError{code: packet.ErrorCode, message: packet.ErrMsg})
+	case packets.AckPacket:
+		block := int(packet.BlockNumber)
+		s.acknowledge(t, member, block)
+		if block >= t.blocks {
+			s.leaveMulticast(t, member, nil)
+			return
+		}
+		if member != t.master || block < t.expected {
+			// Only the master acknowledges the blocks, and stale ACKs
+			// are ignored rather than answered
+			return
+		}
+		t.retransmissions = 0
+		s.sendBlock(t, block+1)
+	}
+}
+
+// acknowledge records the progress of a member
+func (s *Server) acknowledge(t *multicastTransfer, member *multicastMember, block int) {
+	if block <= member.acked || block > t.blocks {
+		return
+	}
+	member.sess.tracker.Add(int(t.offset(block) - t.offset(member.acked)))
+	member.acked = block
+}
+
+// offset returns the number of bytes of the file up to the end of a block
+func (t *multicastTransfer) offset(block int) int64 {
+	offset := int64(block) * int64(t.blockSize)
+	if offset > t.size {
+		return t.size
+	}
+	return offset
+}
+
+// sendBlock sends a block to the group, the master being expected to
+// acknowledge it. The limits of the master apply to the transfer: a block
+// they hold back is sent by releaseBlock, so that the loop keeps handling
+// the other members meanwhile
+func (s *Server) sendBlock(t *multicastTransfer, block int) {
+	start := t.offset(block - 1)
+	n, err := t.content.ReadAt(t.buf[:t.offset(block)-start], start)
+	if err != nil && !(err == io.EOF && int64(n) == t.offset(block)-start) {
+		s.failMulticast(t, errors.Wrapf(err, "cannot read block %d", block))
+		return
+	}
+	if block == t.hashed+1 {
+		// The blocks are first sent in sequence
+		t.digest.Write(t.buf[:n])
+		t.hashed++
+		if t.hashed == t.blocks {
+			t.sum = t.digest.Sum(nil)
+		}
+	}
+
+	dataPacket := packets.NewDataPacket(uint16(block), t.buf[:n])
+	t.expected = block
+	if t.master != nil {
+		if delay := s.reserve(t.master.sess, n); delay > 0 {
+			t.pending, t.throttled = nil, &dataPacket
+			stopTimer(t.timer)
+			resetTimer(t.release, delay)
+			return
+		}
+	}
+	s.transmitBlock(t, dataPacket)
+}
+
+// releaseBlock sends the block held back by the bandwidth limits
+func (s *Server) releaseBlock(t *multicastTransfer) {
+	if t.throttled == nil {
+		return
+	}
+	dataPacket := *t.throttled
+	t.throttled = nil
+	s.transmitBlock(t, dataPacket)
+}
+
+func (s *Server) transmitBlock(t *multicastTransfer, dataPacket packets.DataPacket) {
+	if err := s.sendToGroup(t, dataPacket); err != nil {
+		s.failMulticast(t, errors.Wrapf(err, "cannot send block %d to the group", dataPacket.BlockNumber))
+		return
+	}
+	s.Metrics.BytesSent(len(dataPacket.Data))
+	t.pending, t.pendingTo = dataPacket, t.group
+	resetTimer(t.timer, t.timeout)
+}
+
+func (s *Server) sendToGroup(t *multicastTransfer, packet packets.Packet) error {
+	datagram := packet.Bytes()
+	if _, err := t.conn.WriteTo(datagram, t.group); err != nil {
+		return err
+	}
+	s.Tracer.Sent(t.conn.LocalAddr(), t.group, datagram)
+	return nil
+}
+
+// multicastTimeout sends the last packet again when the master is silent,
+// and gives the role to the next member once it has been sent too often
+func (s *Server) multicastTimeout(t *multicastTransfer) {
+	if t.master == nil || t.pending == nil {
+		return
+	}
+	if t.retransmissions >= maxRetransmissions {
+		s.Metrics.Timeout()
+		s.leaveMulticast(t, t.master, errors.Errorf("the master client has not acknowledged block %d", t.expected))
+		return
+	}
+
+	t.retransmissions++
+	s.sessionLogger(t.master.sess).Debug("No ACK received from the master client, sending %v again", t.pending)
+	t.master.sess.tracker.Retransmit()
+	s.Metrics.Retransmission()
+	var err error
+	if transport.SameAddr(t.pendingTo, t.group) {
+		err = s.sendToGroup(t, t.pending)
+	} else {
+		_, err = s.send(t.master.sess, t.conn, t.pending)
+	}
+	if err != nil {
+		s.Logger.Error("Cannot send %v again: %v", t.pending, err)
+	}
+	resetTimer(t.timer, t.timeout)
+}
+
+// leaveMulticast removes a member, which has received the whole file when
+// err is nil, and elects another master if it was the master
+func (s *Server) leaveMulticast(t *multicastTransfer, member *multicastMember, err error) {
+	for i, m := range t.members {
+		if m == member {
+			t.members = append(t.members[:i:i], t.members[i+1:]...)
+			break
+		}
+	}
+	if err == nil {
+		if t.sum != nil {
+			member.sess.setDigest(t.sum)
+		}
+		member.sess.tracker.Finish()
+	}
+	member.done <- err
+
+	if member == t.master {
+		s.electMaster(t)
+	}
+}
+
+// failMulticast ends the transfer for every member with an ERROR packet
+func (s *Server) failMulticast(t *multicastTransfer, err error) {
+	s.Logger.Error("The multicast transfer of %s has failed: %v", t.key, err)
+	members := t.members
+	t.members = nil
+	t.master = nil
+	t.throttled = nil
+	stopTimer(t.timer)
+	stopTimer(t.release)
+	for _, member := range members {
+		if sendErr := s.sendError(member.sess, t.conn, packets.NewErrorPacket(0, "Cannot read the requested file")); sendErr != nil {
+			s.sessionLogger(member.sess).Error("%+v", sendErr)
+		}
+		member.done <- err
+	}
+}
+
+// resetTimer makes the timer fire after d, discarding a pending expiration
+func resetTimer(timer *time.Timer, d time.Duration) {
+	stopTimer(timer)
+	timer.Reset(d)
+}
+
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
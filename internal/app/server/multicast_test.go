@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/progress"
+	"github.com/mirkoschicchi/TFTP/internal/app/tftptest"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// multicastGroup is the group of the multicast tests, on the port
+// registered for multicast TFTP
+const multicastGroup = "239.255.42.69:1758"
+
+// startMulticastServer starts a server allowing the multicast option on a
+// memory network, which the returned peers and clients are attached to.
+// prepare, when not nil, changes the server before it starts
+func startMulticastServer(t *testing.T, prepare func(s *Server)) (*Server, *net.UDPAddr, transport.Network) {
+	t.Helper()
+	memory := transport.NewMemory(transport.Conditions{}, 1)
+	s, serverAddr := startServer(t, func(s *Server) {
+		s.Network = memory
+		cfg := *s.Config()
+		cfg.Options = append(append([]string(nil), cfg.Options...), packets.OptionMulticast)
+		cfg.Multicast.Group = multicastGroup
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+		if prepare != nil {
+			prepare(s)
+		}
+	})
+	return s, serverAddr, memory
+}
+
+// multicastRequest returns a read request of the file with the multicast
+// option and the other options given
+func multicastRequest(filename string, options map[string]string) packets.RRQPacket {
+	request := packets.NewRRQPacket(filename, packets.Octet)
+	request.Options = map[string]string{packets.OptionMulticast: ""}
+	for name, value := range options {
+		request.Options[name] = value
+	}
+	return request
+}
+
+// expectPeerResult is like expectResult for the transfer of the client at
+// addr, when several clients transfer the same file
+func expectPeerResult(t *testing.T, s *Server, filename string, addr *net.UDPAddr, result string) {
+	t.Helper()
+	session, ok := waitSession(s, func(session SessionInfo) bool {
+		return session.Filename == filename && session.Peer == addr.String()
+	})
+	if !ok {
+		t.Fatalf("the transfer of %s to %v has not completed", filename, addr)
+	}
+	if session.Result != result {
+		t.Fatalf("the transfer of %s to %v has ended with result %s (%s), expected %s",
+			filename, addr, session.Result, session.Error, result)
+	}
+}
+
+// waitMulticastMembers waits for n clients to be members of the multicast
+// transfer of the file
+func waitMulticastMembers(s *Server, filename string, n int) {
+	deadline := time.Now().Add(5 * tftptest.Timeout)
+	for time.Now().Before(deadline) {
+		members := 0
+		for _, session := range s.Sessions() {
+			if session.Filename == filename && session.Options[packets.OptionMulticast] != "" {
+				members++
+			}
+		}
+		if members >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestMulticastMasterHandover expects the first client to be made master
+// and the next one to take over when it leaves, acknowledging the last
+// block it has received in sequence
+func TestMulticastMasterHandover(t *testing.T) {
+	s, serverAddr, network := startMulticastServer(t, nil)
+	writeFile(t, s.Config().Root, "image.bin", content(700))
+	first, second := tftptest.NewPeer(t, network, serverAddr), tftptest.NewPeer(t, network, serverAddr)
+
+	first.Send(multicastRequest("image.bin", nil))
+	first.ExpectOACK(map[string]string{packets.OptionMulticast: "239.255.42.69,1758,1"})
+	second.Send(multicastRequest("image.bin", nil))
+	second.ExpectOACK(map[string]string{packets.OptionMulticast: "239.255.42.69,1758,0"})
+	if !transport.SameAddr(first.Remote, second.Remote) {
+		t.Fatalf("the members have different transfer IDs %v and %v", first.Remote, second.Remote)
+	}
+
+	first.Send(packets.NewAckPacket(0))
+	first.Send(packets.NewErrorPacket(0, "Leaving the group"))
+	second.ExpectOACK(map[string]string{packets.OptionMulticast: "239.255.42.69,1758,1"})
+	second.Send(packets.NewAckPacket(2))
+	expectPeerResult(t, s, "image.bin", first.Addr(), ResultFailure)
+	expectPeerResult(t, s, "image.bin", second.Addr(), ResultSuccess)
+}
+
+// TestMulticastJoinerOptions expects each member to be acknowledged the
+// options it has requested, a different block size starting another
+// transfer of which the client is master
+func TestMulticastJoinerOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		oack    map[string]string
+	}{
+		{
+			name:    "tsize and timeout",
+			options: map[string]string{packets.OptionTsize: "0", packets.OptionTimeout: "3"},
+			oack: map[string]string{
+				packets.OptionMulticast: "239.255.42.69,1758,0",
+				packets.OptionTsize:     "700",
+				packets.OptionTimeout:   "3",
+			},
+		},
+		{
+			name:    "blksize",
+			options: map[string]string{packets.OptionBlksize: "1024"},
+			oack: map[string]string{
+				packets.OptionMulticast: "239.255.42.69,1758,1",
+				packets.OptionBlksize:   "1024",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		s, serverAddr, network := startMulticastServer(t, nil)
+		writeFile(t, s.Config().Root, "image.bin", content(700))
+		first, joiner := tftptest.NewPeer(t, network, serverAddr), tftptest.NewPeer(t, network, serverAddr)
+
+		first.Send(multicastRequest("image.bin", nil))
+		first.ExpectOACK(map[string]string{packets.OptionMulticast: "239.255.42.69,1758,1"})
+		joiner.Send(multicastRequest("image.bin", test.options))
+		joiner.ExpectOACK(test.oack)
+		for _, p := range []*tftptest.Peer{first, joiner} {
+			p.Send(packets.NewErrorPacket(0, "Leaving the group"))
+		}
+		expectPeerResult(t, s, "image.bin", first.Addr(), ResultFailure)
+		expectPeerResult(t, s, "image.bin", joiner.Addr(), ResultFailure)
+	}
+}
+
+// TestMulticastThrottled expects a client joining while the bandwidth
+// limits of the master hold a block back to be answered at once
+func TestMulticastThrottled(t *testing.T) {
+	s, serverAddr, network := startMulticastServer(t, configureLimits(t, func(limits *config.Limits) {
+		limits.MaxSessionBandwidth = packets.DefaultBlockSize
+	}))
+	writeFile(t, s.Config().Root, "image.bin", content(2000))
+	master, joiner := tftptest.NewPeer(t, network, serverAddr), tftptest.NewPeer(t, network, serverAddr)
+
+	master.Send(multicastRequest("image.bin", nil))
+	master.ExpectOACK(map[string]string{packets.OptionMulticast: "239.255.42.69,1758,1"})
+	// The first block empties the bucket, which holds the second one back
+	// for a second
+	master.Send(packets.NewAckPacket(0))
+	master.Send(packets.NewAckPacket(1))
+
+	start := time.Now()
+	joiner.Send(multicastRequest("image.bin", nil))
+	joiner.ExpectOACK(map[string]string{packets.OptionMulticast: "239.255.42.69,1758,0"})
+	if elapsed := time.Since(start); elapsed > tftptest.Timeout/2 {
+		t.Errorf("the joiner has waited %v for its OACK", elapsed)
+	}
+
+	master.Send(packets.NewAckPacket(4))
+	expectPeerResult(t, s, "image.bin", master.Addr(), ResultSuccess)
+}
+
+// TestMulticastLateJoiner expects a client joining a multicast transfer in
+// progress to get the blocks sent before it has joined once it becomes
+// master
+func TestMulticastLateJoiner(t *testing.T) {
+	s, serverAddr, network := startMulticastServer(t, nil)
+	expected := content(20*512 + 100)
+	writeFile(t, s.Config().Root, "image.bin", expected)
+
+	early, late := newClient(), newClient()
+	early.Network, late.Network = network, network
+	early.Multicast, late.Multicast = true, true
+	var earlyReceived, lateReceived bytes.Buffer
+	lateDone := make(chan error, 1)
+	var joined bool
+	early.OnProgress = func(report progress.Report) {
+		if joined || report.Transferred < 5*512 {
+			return
+		}
+		// The transfer waits for the early client while the late one joins
+		joined = true
+		go func() { lateDone <- late.ReceiveFile(serverAddr, "image.bin", &lateReceived) }()
+		waitMulticastMembers(s, "image.bin", 2)
+	}
+	if err := early.ReceiveFile(serverAddr, "image.bin", &earlyReceived); err != nil {
+		t.Fatalf("early client: %v", err)
+	}
+	if !joined {
+		t.Fatal("the late client has not been started")
+	}
+	select {
+	case err := <-lateDone:
+		if err != nil {
+			t.Fatalf("late client: %v", err)
+		}
+	case <-time.After(10 * tftptest.Timeout):
+		t.Fatal("the late client has not completed")
+	}
+
+	for _, received := range []*bytes.Buffer{&earlyReceived, &lateReceived} {
+		if !bytes.Equal(received.Bytes(), expected) {
+			t.Errorf("received %d bytes differing from the file", received.Len())
+		}
+	}
+	for _, c := range []client.Client{early, late} {
+		expectPeerResult(t, s, "image.bin", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.TID}, ResultSuccess)
+	}
+}
+
+// TestMulticastDeclined expects a client requesting the multicast option to
+// receive the file alone when the server cannot send it to a group
+func TestMulticastDeclined(t *testing.T) {
+	expected := content(1500)
+	tests := []struct {
+		name  string
+		start func(t *testing.T) (*Server, *net.UDPAddr, transport.Network)
+	}{
+		{"not allowed", func(t *testing.T) (*Server, *net.UDPAddr, transport.Network) {
+			s, serverAddr, c := startMemoryServer(t, transport.Conditions{})
+			return s, serverAddr, c.Network
+		}},
+		{"content of unknown size", func(t *testing.T) (*Server, *net.UDPAddr, transport.Network) {
+			return startMulticastServer(t, func(s *Server) {
+				s.Router.HandleReadFunc("image.bin", func(req *Request) (io.Reader, int64, error) {
+					return strings.NewReader(string(expected)), -1, nil
+				})
+			})
+		}},
+	}
+
+	for _, test := range tests {
+		s, serverAddr, network := test.start(t)
+		writeFile(t, s.Config().Root, "image.bin", expected)
+
+		c := newClient()
+		c.Network = network
+		c.Multicast = true
+		var received bytes.Buffer
+		if err := c.ReceiveFile(serverAddr, "image.bin", &received); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(received.Bytes(), expected) {
+			t.Errorf("%s: received %d bytes differing from the file", test.name, received.Len())
+		}
+		session, ok := waitSession(s, func(session SessionInfo) bool { return session.Filename == "image.bin" })
+		if !ok {
+			t.Fatalf("%s: the transfer has not completed", test.name)
+		}
+		if session.Options[packets.OptionMulticast] != "" {
+			t.Errorf("%s: the multicast option has been acknowledged", test.name)
+		}
+	}
+}
+
+// TestMulticastLargeFile expects the multicast option to be declined for a
+// file with more blocks than the block numbers of a multicast transfer, the
+// file being sent by a unicast transfer wrapping around them instead
+func TestMulticastLargeFile(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	s, serverAddr, network := startMulticastServer(t, func(s *Server) {
+		s.Logger = logger.New(zap.New(core))
+		cfg := *s.Config()
+		cfg.Logging.Level = "info"
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+	})
+	blockSize := config.MinBlockSize
+	expected := content(maxMulticastBlocks * blockSize)
+	writeFile(t, s.Config().Root, "large.bin", expected)
+
+	c := newClient()
+	c.Network = network
+	c.Multicast = true
+	c.BlockSize = blockSize
+	var received bytes.Buffer
+	if err := c.ReceiveFile(serverAddr, "large.bin", &received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received.Bytes(), expected) {
+		t.Errorf("received %d bytes differing from the file", received.Len())
+	}
+	session := expectSomeResult(t, s, "large.bin", ResultSuccess)
+	if session.Options[packets.OptionMulticast] != "" {
+		t.Error("the multicast option has been acknowledged")
+	}
+	if declined := logs.FilterMessageSnippet("more than the 65535 block numbers").Len(); declined != 1 {
+		t.Errorf("the multicast option has been declined %d times in the logs, expected once", declined)
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+const minTimeout = 1
+
+const (
+	// sizeFromClient makes negotiateOptions acknowledge the transfer size
+	// announced by the client, as done for WRQ
+	sizeFromClient int64 = -1
+	// sizeUnknown makes negotiateOptions decline the tsize option of a RRQ
+	// whose content is generated without knowing its size in advance
+	sizeUnknown int64 = -2
+)
+
+// sessionOptions holds the transfer parameters of a session
+// after the option negotiation has taken place
+type sessionOptions struct {
+	blockSize int
+	timeout   time.Duration
+	// transferSize is zero when the size has not been announced
+	transferSize int64
+	// offset is the byte of the file a resumed read starts at
+	offset int64
+}
+
+// negotiateOptions returns the options accepted by the server, which must be
+// sent back in an OACK packet, together with the resulting session parameters.
+// transferSize is the size of the requested file for RRQ, sizeUnknown if it is
+// not known, or sizeFromClient for WRQ.
+// Options not allowed by the configuration are ignored
+func negotiateOptions(requested map[string]string, transferSize int64, cfg *config.Config) (map[string]string, sessionOptions) {
+	accepted := make(map[string]string)
+	options := sessionOptions{blockSize: packets.DefaultBlockSize, timeout: cfg.Timeouts.Default}
+
+	if value, ok := requested[packets.OptionBlksize]; ok && cfg.OptionAllowed(packets.OptionBlksize) {
+		blockSize, err := strconv.Atoi(value)
+		if err == nil && blockSize >= config.MinBlockSize {
+			if blockSize > cfg.Limits.MaxBlockSize {
+				blockSize = cfg.Limits.MaxBlockSize
+			}
+			options.blockSize = blockSize
+			accepted[packets.OptionBlksize] = strconv.Itoa(blockSize)
+		}
+	}
+
+	if value, ok := requested[packets.OptionTimeout]; ok && cfg.OptionAllowed(packets.OptionTimeout) {
+		seconds, err := strconv.Atoi(value)
+		if err == nil && seconds >= minTimeout && time.Duration(seconds)*time.Second <= cfg.Timeouts.Max {
+			options.timeout = time.Duration(seconds) * time.Second
+			accepted[packets.OptionTimeout] = value
+		}
+	}
+
+	if value, ok := requested[packets.OptionTsize]; ok && cfg.OptionAllowed(packets.OptionTsize) {
+		if transferSize >= 0 {
+			accepted[packets.OptionTsize] = strconv.FormatInt(transferSize, 10)
+			options.transferSize = transferSize
+		} else if size, err := strconv.ParseInt(value, 10, 64); err == nil && transferSize == sizeFromClient {
+			accepted[packets.OptionTsize] = value
+			options.transferSize = size
+		}
+	}
+
+	// A read can be resumed anywhere within the file, whose size is needed
+	if value, ok := requested[packets.OptionOffset]; ok && cfg.OptionAllowed(packets.OptionOffset) {
+		offset, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && offset >= 0 && transferSize >= 0 && offset <= transferSize {
+			accepted[packets.OptionOffset] = value
+			options.offset = offset
+		}
+	}
+
+	return accepted, options
+}
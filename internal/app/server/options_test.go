@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+func TestNegotiateOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		requested    map[string]string
+		transferSize int64
+		// configure changes the default configuration when set
+		configure func(cfg *config.Config)
+		accepted  map[string]string
+		options   sessionOptions
+	}{
+		{
+			name:         "no options",
+			requested:    map[string]string{},
+			transferSize: 100,
+			accepted:     map[string]string{},
+			options:      sessionOptions{blockSize: 512, timeout: 5 * time.Second},
+		},
+		{
+			name:         "blksize",
+			requested:    map[string]string{packets.OptionBlksize: "1428"},
+			transferSize: 100,
+			accepted:     map[string]string{packets.OptionBlksize: "1428"},
+			options:      sessionOptions{blockSize: 1428, timeout: 5 * time.Second},
+		},
+		{
+			name:         "blksize above the maximum",
+			requested:    map[string]string{packets.OptionBlksize: "70000"},
+			transferSize: 100,
+			accepted:     map[string]string{packets.OptionBlksize: "65464"},
+			options:      sessionOptions{blockSize: 65464, timeout: 5 * time.Second},
+		},
+		{
+			name:         "invalid blksize and timeout",
+			requested:    map[string]string{packets.OptionBlksize: "4", packets.OptionTimeout: "256"},
+			transferSize: 100,
+			accepted:     map[string]string{},
+			options:      sessionOptions{blockSize: 512, timeout: 5 * time.Second},
+		},
+		{
+			name:         "timeout",
+			requested:    map[string]string{packets.OptionTimeout: "3"},
+			transferSize: 100,
+			accepted:     map[string]string{packets.OptionTimeout: "3"},
+			options:      sessionOptions{blockSize: 512, timeout: 3 * time.Second},
+		},
+		{
+			name:         "tsize of a read request",
+			requested:    map[string]string{packets.OptionTsize: "0"},
+			transferSize: 2048,
+			accepted:     map[string]string{packets.OptionTsize: "2048"},
+			options:      sessionOptions{blockSize: 512, timeout: 5 * time.Second, transferSize: 2048},
+		},
+		{
+			name:         "tsize of a write request",
+			requested:    map[string]string{packets.OptionTsize: "4096"},
+			transferSize: -1,
+			accepted:     map[string]string{packets.OptionTsize: "4096"},
+			options:      sessionOptions{blockSize: 512, timeout: 5 * time.Second, transferSize: 4096},
+		},
+		{
+			name:         "blksize above the configured maximum",
+			requested:    map[string]string{packets.OptionBlksize: "1428"},
+			transferSize: 100,
+			configure:    func(cfg *config.Config) { cfg.Limits.MaxBlockSize = 1024 },
+			accepted:     map[string]string{packets.OptionBlksize: "1024"},
+			options:      sessionOptions{blockSize: 1024, timeout: 5 * time.Second},
+		},
+		{
+			name:         "timeout above the configured maximum",
+			requested:    map[string]string{packets.OptionTimeout: "10"},
+			transferSize: 100,
+			configure:    func(cfg *config.Config) { cfg.Timeouts.Max = 5 * time.Second },
+			accepted:     map[string]string{},
+			options:      sessionOptions{blockSize: 512, timeout: 5 * time.Second},
+		},
+		{
+			name:         "configured default timeout",
+			requested:    map[string]string{},
+			transferSize: 100,
+			configure:    func(cfg *config.Config) { cfg.Timeouts.Default = 2 * time.Second },
+			accepted:     map[string]string{},
+			options:      sessionOptions{blockSize: 512, timeout: 2 * time.Second},
+		},
+		{
+			name:         "option not allowed",
+			requested:    map[string]string{packets.OptionBlksize: "1024", packets.OptionTsize: "0"},
+			transferSize: 100,
+			configure:    func(cfg *config.Config) { cfg.Options = []string{packets.OptionTsize} },
+			accepted:     map[string]string{packets.OptionTsize: "100"},
+			options:      sessionOptions{blockSize: 512, timeout: 5 * time.Second, transferSize: 100},
+		},
+		{
+			name:         "offset",
+			requested:    map[string]string{packets.OptionOffset: "1000"},
+			transferSize: 1500,
+			accepted:     map[string]string{packets.OptionOffset: "1000"},
+			options:      sessionOptions{blockSize: 512, timeout: 5 * time.Second, offset: 1000},
+		},
+		{
+			name:         "offset of a content of unknown size",
+			requested:    map[string]string{packets.OptionOffset: "1000"},
+			transferSize: -1,
+			accepted:     map[string]string{},
+			options:      sessionOptions{blockSize: 512, timeout: 5 * time.Second},
+		},
+		{
+			name:         "unknown option",
+			requested:    map[string]string{"windowsize": "4"},
+			transferSize: 100,
+			accepted:     map[string]string{},
+			options:      sessionOptions{blockSize: 512, timeout: 5 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		cfg := config.Default()
+		if test.configure != nil {
+			test.configure(cfg)
+		}
+		accepted, options := negotiateOptions(test.requested, test.transferSize, cfg)
+		if !reflect.DeepEqual(accepted, test.accepted) {
+			t.Errorf("%s: accepted %v, expected %v", test.name, accepted, test.accepted)
+		}
+		if options != test.options {
+			t.Errorf("%s: the session options are %+v, expected %+v", test.name, options, test.options)
+		}
+	}
+}
+
+// TestReadOptions expects the options of a read request to be acknowledged
+// by an OACK holding those the server supports, and the transfer to follow
+// them. A request without any supported option is answered with DATA
+func TestReadOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		options map[string]string
+		// oack is nil when no OACK is expected
+		oack   map[string]string
+		blocks []int
+	}{
+		{
+			name:    "blksize",
+			size:    2500,
+			options: map[string]string{packets.OptionBlksize: "1024"},
+			oack:    map[string]string{packets.OptionBlksize: "1024"},
+			blocks:  []int{1024, 1024, 452},
+		},
+		{
+			name:    "tsize",
+			size:    300,
+			options: map[string]string{packets.OptionTsize: "0"},
+			oack:    map[string]string{packets.OptionTsize: "300"},
+			blocks:  []int{300},
+		},
+		{
+			// The windowsize option of RFC 7440 is not implemented
+			name:    "windowsize declined",
+			size:    100,
+			options: map[string]string{packets.OptionBlksize: "1024", "windowsize": "4"},
+			oack:    map[string]string{packets.OptionBlksize: "1024"},
+			blocks:  []int{100},
+		},
+		{
+			name:    "unknown options only",
+			size:    100,
+			options: map[string]string{"unknown": "1"},
+			blocks:  []int{100},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, serverAddr := startServer(t, nil)
+			expected := content(test.size)
+			writeFile(t, s.Config().Root, "file.bin", expected)
+
+			p := newPeer(t, serverAddr)
+			request := packets.NewRRQPacket("file.bin", packets.Octet)
+			request.Options = test.options
+			p.Send(request)
+			if test.oack != nil {
+				p.ExpectOACK(test.oack)
+				p.Send(packets.NewAckPacket(0))
+			}
+			if received := receiveBlocks(p, test.blocks...); !bytes.Equal(received, expected) {
+				t.Errorf("received %d bytes, expected %d", len(received), len(expected))
+			}
+			expectResult(t, s, "file.bin", ResultSuccess)
+		})
+	}
+}
+
+// TestReadOffset expects a read to start at the offset requested by the
+// client, and the option to be declined when the offset is beyond the end
+// of the file
+func TestReadOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset string
+		oack   map[string]string
+		// sent is the offset of the first byte sent
+		sent   int
+		blocks []int
+	}{
+		{
+			name:   "within the file",
+			offset: "1000",
+			oack:   map[string]string{packets.OptionOffset: "1000", packets.OptionTsize: "1500"},
+			sent:   1000,
+			blocks: []int{500},
+		},
+		{
+			name:   "beyond the end",
+			offset: "2000",
+			oack:   map[string]string{packets.OptionTsize: "1500"},
+			blocks: []int{512, 512, 476},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, serverAddr := startServer(t, nil)
+			expected := content(1500)
+			writeFile(t, s.Config().Root, "offset.bin", expected)
+
+			p := newPeer(t, serverAddr)
+			request := packets.NewRRQPacket("offset.bin", packets.Octet)
+			request.Options = map[string]string{packets.OptionOffset: test.offset, packets.OptionTsize: "0"}
+			p.Send(request)
+			p.ExpectOACK(test.oack)
+			p.Send(packets.NewAckPacket(0))
+			if received := receiveBlocks(p, test.blocks...); !bytes.Equal(received, expected[test.sent:]) {
+				t.Errorf("received %d bytes, expected the %d from %d", len(received), len(expected)-test.sent, test.sent)
+			}
+			expectResult(t, s, "offset.bin", ResultSuccess)
+		})
+	}
+}
+
+// TestOptionRefused expects the server to abort when the client answers
+// the OACK with an ERROR 8
+func TestOptionRefused(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+	writeFile(t, s.Config().Root, "small.bin", content(100))
+
+	p := newPeer(t, serverAddr)
+	request := packets.NewRRQPacket("small.bin", packets.Octet)
+	request.Options = map[string]string{packets.OptionBlksize: "1024"}
+	p.Send(request)
+	p.ExpectOACK(map[string]string{packets.OptionBlksize: "1024"})
+	p.Send(packets.NewErrorPacket(8, "option refused"))
+	p.ExpectNothing()
+	expectResult(t, s, "small.bin", ResultFailure)
+}
+
+// TestWriteTsize expects the server to echo the size of the uploaded file
+func TestWriteTsize(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+	expected := content(700)
+
+	p := newPeer(t, serverAddr)
+	request := packets.NewWRQPacket("tsize.bin", packets.Octet)
+	request.Options = map[string]string{packets.OptionTsize: "700"}
+	p.Send(request)
+	p.ExpectOACK(map[string]string{packets.OptionTsize: "700"})
+	sendBlocks(p, expected[:512], expected[512:])
+	expectResult(t, s, "tsize.bin", ResultSuccess)
+	expectFile(t, s.Config().Root, "tsize.bin", expected)
+}
+
+// TestTimeoutOption expects the negotiated timeout to be used before
+// sending a DATA again
+func TestTimeoutOption(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+	writeFile(t, s.Config().Root, "small.bin", content(100))
+
+	p := newPeer(t, serverAddr)
+	request := packets.NewRRQPacket("small.bin", packets.Octet)
+	request.Options = map[string]string{packets.OptionTimeout: "2"}
+	p.Send(request)
+	p.ExpectOACK(map[string]string{packets.OptionTimeout: "2"})
+	p.Send(packets.NewAckPacket(0))
+	p.ExpectData(1, 100)
+
+	start := time.Now()
+	p.ExpectData(1, 100)
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("the DATA has been sent again after %v, before the negotiated timeout", elapsed)
+	}
+	p.Send(packets.NewAckPacket(1))
+	expectResult(t, s, "small.bin", ResultSuccess)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const pxelinuxConfigDir = "pxelinux.cfg"
+
+var (
+	// pxeMACName is the name of the configuration of a client by MAC address,
+	// prefixed by the ARP type of Ethernet
+	pxeMACName = regexp.MustCompile(`(?i)^01(-[0-9a-f]{2}){6}$`)
+	// pxeUUIDName is the name of the configuration of a client by UUID
+	pxeUUIDName = regexp.MustCompile(`(?i)^[0-9a-f]{8}(-[0-9a-f]{4}){3}-[0-9a-f]{12}$`)
+	// pxeIPName is the name of the configuration of a client by IP address
+	// written in hexadecimal, or of a range of clients by a prefix of it
+	pxeIPName = regexp.MustCompile(`(?i)^[0-9a-f]{1,8}$`)
+)
+
+// pxeFallbacks returns the files PXELINUX would request after the missing
+// pxelinux.cfg file, in order: the shorter hexadecimal prefixes of the IP
+// address of the client, then default. The UUID of the client is followed
+// by its MAC address, which is unknown to the server and skipped. Nothing
+// is returned for the other files
+func pxeFallbacks(filename string, clientIP net.IP) []string {
+	dir, name := path.Split(cleanPath(filename))
+	if !strings.EqualFold(path.Base(dir), pxelinuxConfigDir) {
+		return nil
+	}
+
+	var prefixes string
+	switch {
+	case pxeUUIDName.MatchString(name), pxeMACName.MatchString(name):
+		// The MAC address is followed by the whole IP address
+		if ip := clientIP.To4(); ip != nil {
+			prefixes = fmt.Sprintf("%02X%02X%02X%02X", ip[0], ip[1], ip[2], ip[3])
+		}
+	case pxeIPName.MatchString(name):
+		// A prefix is followed by the shorter ones
+		prefixes = strings.ToUpper(name[:len(name)-1])
+	default:
+		return nil
+	}
+
+	var fallbacks []string
+	for n := len(prefixes); n > 0; n-- {
+		fallbacks = append(fallbacks, dir+prefixes[:n])
+	}
+	return append(fallbacks, dir+"default")
+}
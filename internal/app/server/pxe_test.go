@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+// startPXEServer starts a server using the pxe profile, with an empty
+// pxelinux.cfg directory
+func startPXEServer(t *testing.T) (*Server, *net.UDPAddr) {
+	return startServer(t, func(s *Server) {
+		cfg := *s.Config()
+		cfg.Profile = config.ProfilePXE
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(filepath.Join(cfg.Root, "pxelinux.cfg"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestPXEFallbacks expects a missing pxelinux.cfg file to be served from
+// the next one PXELINUX would request, down to default. The tests connect
+// from 127.0.0.1, 7F000001 in hexadecimal
+func TestPXEFallbacks(t *testing.T) {
+	s, serverAddr := startPXEServer(t)
+	root := s.Config().Root
+	writeFile(t, root, "pxelinux.cfg/7F00", []byte("7F00"))
+	writeFile(t, root, "pxelinux.cfg/default", []byte("default"))
+
+	tests := []struct {
+		requested string
+		// served is empty when the file is expected not to be found
+		served string
+	}{
+		{"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", "7F00"},
+		{"pxelinux.cfg/7F000001", "7F00"},
+		{"pxelinux.cfg/7f00", "7F00"},
+		{"pxelinux.cfg/7F0", "default"},
+		{"pxelinux.cfg/C0A80001", "default"},
+		// The MAC address following the UUID is unknown to the server
+		{"pxelinux.cfg/b8945908-d6a6-41a9-611d-74a6ab80b83d", "7F00"},
+		{"pxelinux.cfg/b8945908-d6a6-41a9-611d", ""},
+		{"boot/01-aa-bb-cc-dd-ee-ff", ""},
+	}
+
+	c := newClient()
+	for _, test := range tests {
+		var received bytes.Buffer
+		err := c.ReceiveFile(serverAddr, test.requested, &received)
+		if test.served == "" {
+			expectRemoteError(t, err, 1)
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.requested, err)
+		} else if received.String() != test.served {
+			t.Errorf("%s: got %q, expected %q", test.requested, received.String(), test.served)
+		}
+	}
+}
+
+// TestPXEROMBoot emulates the requests of a PXE ROM loading PXELINUX: the
+// size of the boot loader is probed and the transfer aborted with ERROR 8,
+// then the boot loader is downloaded with a large block size
+func TestPXEROMBoot(t *testing.T) {
+	s, serverAddr := startPXEServer(t)
+	loader := content(3000)
+	writeFile(t, s.Config().Root, "pxelinux.0", loader)
+
+	// The ROM only asks for the size first, regardless of case
+	probe := newPeer(t, serverAddr)
+	request := packets.NewRRQPacket("PXELINUX.0", packets.Octet)
+	request.Options = map[string]string{packets.OptionTsize: "0", packets.OptionBlksize: "1456"}
+	probe.Send(request)
+	probe.ExpectOACK(map[string]string{packets.OptionTsize: "3000", packets.OptionBlksize: "1456"})
+	probe.Send(packets.NewErrorPacket(8, "tsize probe"))
+	expectResult(t, s, "PXELINUX.0", ResultProbed)
+
+	// The block size is capped so that DATA packets fit an Ethernet frame
+	download := newPeer(t, serverAddr)
+	request = packets.NewRRQPacket("pxelinux.0", packets.Octet)
+	request.Options = map[string]string{packets.OptionBlksize: "8192"}
+	download.Send(request)
+	download.ExpectOACK(map[string]string{packets.OptionBlksize: strconv.Itoa(config.PXEMaxBlockSize)})
+	download.Send(packets.NewAckPacket(0))
+	received := receiveBlocks(download, config.PXEMaxBlockSize, config.PXEMaxBlockSize, 3000-2*config.PXEMaxBlockSize)
+	if !bytes.Equal(received, loader) {
+		t.Errorf("received %d bytes differing from the boot loader", len(received))
+	}
+	expectResult(t, s, "pxelinux.0", ResultSuccess)
+}
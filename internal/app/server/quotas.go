@@ -0,0 +1,257 @@
+package server
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/pkg/errors"
+)
+
+// unlimitedUpload is the space of an upload no limit applies to
+const unlimitedUpload int64 = -1
+
+// partialSuffix ends the name of the temporary file an upload stored by the
+// server is written to, before it is renamed
+const partialSuffix = ".part"
+
+// diskReservations is the key of the bytes reserved on the disk of the root
+// directory by the uploads in progress
+const diskReservations = ""
+
+// uploadReservations holds the bytes reserved by the uploads in progress in
+// each directory having a quota and on the disk, so that concurrent uploads
+// share the space left rather than each being allowed all of it. It keeps
+// the usage of the directories having a quota, measured once and then
+// updated as the uploads are stored, and counts the bytes stored since the
+// server has started, which the uploads measuring the free space of the
+// disk before they were stored must add to it
+type uploadReservations struct {
+	mu     sync.Mutex
+	bytes  map[string]int64
+	usage  map[string]int64
+	stored int64
+}
+
+func newUploadReservations() *uploadReservations {
+	return &uploadReservations{bytes: make(map[string]int64), usage: make(map[string]int64)}
+}
+
+// measure returns the usage of a directory having a quota, walking it the
+// first time only. It must be called with the lock held
+func (r *uploadReservations) measure(directory string) (int64, error) {
+	if usage, ok := r.usage[directory]; ok {
+		return usage, nil
+	}
+	usage, err := directorySize(directory)
+	if err != nil {
+		return 0, err
+	}
+	r.usage[directory] = usage
+	return usage, nil
+}
+
+// forget drops the usage of the directories, which are measured again by
+// the next uploads so that the files changed by others are counted
+func (r *uploadReservations) forget() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.usage = make(map[string]int64)
+}
+
+// used returns the bytes taken in the directory of a quota, the file the
+// upload replaces being counted as free. It must be called with the lock held
+func (r *uploadReservations) used(quota directoryQuota) int64 {
+	return r.usage[quota.directory] + r.bytes[quota.directory] - quota.replaced
+}
+
+// uploadSpace bounds the size of an upload, reserving the bytes it receives
+// until it ends
+type uploadSpace struct {
+	reservations *uploadReservations
+	maxSize      int64
+	quotas       []directoryQuota
+	// free is the space the uploads can use on the disk when the upload
+	// has started, unlimitedUpload when it is not checked. The bytes the
+	// other uploads have written by then are counted by their reservations
+	// too, which errs on the safe side
+	free int64
+	// freeStored is the count of stored bytes when free was measured
+	freeStored int64
+	// reserved is the number of bytes reserved by the upload
+	reserved int64
+}
+
+// directoryQuota is a directory containing the location of an upload,
+// whose size is bounded
+type directoryQuota struct {
+	directory string
+	maxSize   int64
+	// replaced is the size of the file the upload replaces when it starts
+	replaced int64
+}
+
+// uploadLocation returns where an upload is expected to be stored: in the
+// root directory under the last element of the path for the uploads stored
+// by the server, and at the requested path for those routed to a handler
+func (s *Server) uploadLocation(req *Request, cfg *config.Config) string {
+	if _, ok := s.Router.writeHandler(req.Filename); ok {
+		return resolvePath(cfg.Root, req.Filename)
+	}
+	return filepath.Join(cfg.Root, path.Base(cleanPath(req.Filename)))
+}
+
+// uploadSpace returns the space of an upload given the maximum upload size,
+// the quotas of the directories containing its location and the free space
+// of the disk. The upload is refused with ErrAllocationExceeded when nothing
+// can be stored. The space must be released once the upload has ended
+func (s *Server) uploadSpace(req *Request, cfg *config.Config) (*uploadSpace, error) {
+	space := &uploadSpace{reservations: s.uploads, maxSize: unlimitedUpload, free: unlimitedUpload}
+	if cfg.Limits.MaxUploadSize > 0 {
+		space.maxSize = cfg.Limits.MaxUploadSize
+	}
+
+	location := s.uploadLocation(req, cfg)
+	var replaced int64
+	if info, err := os.Stat(location); err == nil && info.Mode().IsRegular() {
+		replaced = info.Size()
+	}
+
+	s.uploads.mu.Lock()
+	defer s.uploads.mu.Unlock()
+	for _, quota := range cfg.Quotas {
+		directory := quota.Directory
+		if !filepath.IsAbs(directory) {
+			directory = filepath.Join(cfg.Root, directory)
+		}
+		if !within(location, directory) {
+			continue
+		}
+		if _, err := s.uploads.measure(directory); err != nil {
+			return nil, errors.Wrapf(err, "cannot measure the size of %s", directory)
+		}
+		space.quotas = append(space.quotas, directoryQuota{directory: directory, maxSize: quota.MaxSize, replaced: replaced})
+	}
+
+	if cfg.Limits.MinFreeSpace > 0 {
+		if free, ok := freeSpace(cfg.Root); ok {
+			if free <= cfg.Limits.MinFreeSpace {
+				return nil, errors.Wrapf(ErrAllocationExceeded, "only %d bytes are free on the disk", free)
+			}
+			space.free = free - cfg.Limits.MinFreeSpace
+			space.freeStored = s.uploads.stored
+		}
+	}
+
+	for _, quota := range space.quotas {
+		if s.uploads.used(quota) >= quota.maxSize {
+			return nil, errors.Wrapf(ErrAllocationExceeded, "the quota of %s is exhausted", quota.directory)
+		}
+	}
+	return space, nil
+}
+
+// reserve makes room for the upload to hold size bytes, failing with
+// ErrAllocationExceeded when they do not fit
+func (u *uploadSpace) reserve(size int64) error {
+	if size <= u.reserved {
+		return nil
+	}
+	if u.maxSize != unlimitedUpload && size > u.maxSize {
+		return errors.Wrapf(ErrAllocationExceeded, "the upload of %d bytes exceeds the %d bytes allowed", size, u.maxSize)
+	}
+
+	r := u.reservations
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	added := size - u.reserved
+	for _, quota := range u.quotas {
+		if r.used(quota)+added > quota.maxSize {
+			return errors.Wrapf(ErrAllocationExceeded, "the upload of %d bytes exceeds the quota of %s", size, quota.directory)
+		}
+	}
+	if u.free != unlimitedUpload && r.bytes[diskReservations]+r.stored-u.freeStored+added > u.free {
+		return errors.Wrapf(ErrAllocationExceeded, "the upload of %d bytes exceeds the free space of the disk", size)
+	}
+
+	for _, quota := range u.quotas {
+		r.bytes[quota.directory] += added
+	}
+	r.bytes[diskReservations] += added
+	u.reserved = size
+	return nil
+}
+
+// commit records that the upload has been stored with the given size in
+// place of the file it replaces, giving back its reservation
+func (u *uploadSpace) commit(size int64) {
+	r := u.reservations
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, quota := range u.quotas {
+		// A directory forgotten meanwhile is measured again with the upload
+		if usage, ok := r.usage[quota.directory]; ok {
+			r.usage[quota.directory] = usage + size - quota.replaced
+		}
+	}
+	r.stored += size
+	u.unreserve()
+}
+
+// release gives back the bytes reserved by the upload once it has ended,
+// unless they have been committed
+func (u *uploadSpace) release() {
+	u.reservations.mu.Lock()
+	defer u.reservations.mu.Unlock()
+
+	u.unreserve()
+}
+
+// unreserve gives back the bytes reserved by the upload. It must be called
+// with the lock of the reservations held
+func (u *uploadSpace) unreserve() {
+	r := u.reservations
+	for _, quota := range u.quotas {
+		r.bytes[quota.directory] -= u.reserved
+	}
+	r.bytes[diskReservations] -= u.reserved
+	u.reserved = 0
+}
+
+// within reports whether location is inside directory
+func within(location string, directory string) bool {
+	rel, err := filepath.Rel(directory, location)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// directorySize returns the total size of the regular files of a directory
+// and its subdirectories, zero if it does not exist. The temporary files of
+// the uploads in progress are left out, as their bytes are reserved
+func directorySize(directory string) (int64, error) {
+	var size int64
+	err := filepath.Walk(directory, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && !isPartialUpload(info.Name()) {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// isPartialUpload reports whether name is the one of the temporary file of
+// an upload in progress
+func isPartialUpload(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, partialSuffix)
+}
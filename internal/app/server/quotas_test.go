@@ -0,0 +1,161 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/pkg/errors"
+)
+
+// quotaServer returns a server storing the uploads in a new root directory
+// holding up to 100 bytes
+func quotaServer(t *testing.T) (*Server, *config.Config) {
+	cfg := config.Default()
+	cfg.Root = t.TempDir()
+	cfg.Quotas = []config.Quota{{Directory: ".", MaxSize: 100}}
+	return NewServer(), cfg
+}
+
+func openSpace(t *testing.T, s *Server, cfg *config.Config, filename string) *uploadSpace {
+	t.Helper()
+	space, err := s.uploadSpace(&Request{Filename: filename}, cfg)
+	if err != nil {
+		t.Fatalf("cannot open the space of %s: %v", filename, err)
+	}
+	return space
+}
+
+func expectExceeded(t *testing.T, err error) {
+	t.Helper()
+	if errors.Cause(err) != ErrAllocationExceeded {
+		t.Errorf("got %v, expected the allocation to be exceeded", err)
+	}
+}
+
+func TestConcurrentUploadsShareTheQuota(t *testing.T) {
+	s, cfg := quotaServer(t)
+	first := openSpace(t, s, cfg, "first")
+	second := openSpace(t, s, cfg, "second")
+
+	if err := first.reserve(60); err != nil {
+		t.Fatal(err)
+	}
+	expectExceeded(t, second.reserve(60))
+	if err := second.reserve(40); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is left for a third upload
+	_, err := s.uploadSpace(&Request{Filename: "third"}, cfg)
+	expectExceeded(t, err)
+
+	first.release()
+	if err := second.reserve(100); err != nil {
+		t.Errorf("the bytes of a failed upload have not been given back: %v", err)
+	}
+}
+
+func TestStoredUploadCountsAgainstTheQuota(t *testing.T) {
+	s, cfg := quotaServer(t)
+	first := openSpace(t, s, cfg, "first")
+	second := openSpace(t, s, cfg, "second")
+
+	if err := first.reserve(60); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cfg.Root, "first"), make([]byte, 60), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first.commit(60)
+	first.release()
+
+	// The second upload has measured the directory before the first one
+	// was stored
+	expectExceeded(t, second.reserve(60))
+	second.release()
+
+	third := openSpace(t, s, cfg, "third")
+	expectExceeded(t, third.reserve(60))
+	if err := third.reserve(40); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplacedFileIsNotCounted(t *testing.T) {
+	s, cfg := quotaServer(t)
+	if err := ioutil.WriteFile(filepath.Join(cfg.Root, "image"), make([]byte, 80), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := openSpace(t, s, cfg, "image")
+	if err := replacement.reserve(80); err != nil {
+		t.Errorf("a file of the same size cannot replace it: %v", err)
+	}
+	replacement.release()
+	expectExceeded(t, openSpace(t, s, cfg, "other").reserve(80))
+}
+
+// TestQuotaUsageIsKept expects a directory to be measured by the first
+// upload only, its usage being updated as the uploads are stored and
+// measured again once the configuration is reloaded
+func TestQuotaUsageIsKept(t *testing.T) {
+	s, cfg := quotaServer(t)
+	if err := ioutil.WriteFile(filepath.Join(cfg.Root, "image"), make([]byte, 50), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replacement := openSpace(t, s, cfg, "image")
+	if err := replacement.reserve(30); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cfg.Root, "image"), make([]byte, 30), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replacement.commit(30)
+	replacement.release()
+
+	// The file written behind the back of the server is not measured
+	if err := ioutil.WriteFile(filepath.Join(cfg.Root, "other"), make([]byte, 60), 0644); err != nil {
+		t.Fatal(err)
+	}
+	space := openSpace(t, s, cfg, "next")
+	if err := space.reserve(70); err != nil {
+		t.Errorf("the directory has been measured again: %v", err)
+	}
+	space.release()
+
+	if err := s.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	expectExceeded(t, openSpace(t, s, cfg, "next").reserve(70))
+}
+
+func TestPartialUploadsAreNotMeasured(t *testing.T) {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, ".image.123"+partialSuffix), make([]byte, 50), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "kernel"), make([]byte, 30), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := directorySize(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 30 {
+		t.Errorf("measured %d bytes, expected 30", size)
+	}
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	s, cfg := quotaServer(t)
+	cfg.Quotas = nil
+	cfg.Limits.MaxUploadSize = 10
+	space := openSpace(t, s, cfg, "file")
+
+	if err := space.reserve(10); err != nil {
+		t.Fatal(err)
+	}
+	expectExceeded(t, space.reserve(11))
+}
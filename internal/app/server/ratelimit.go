@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/ratelimit"
+)
+
+// throttleStep is how often a session waiting for the bandwidth limits
+// checks whether it has been canceled
+const throttleStep = 100 * time.Millisecond
+
+// shaper holds the buckets limiting the bandwidth of every session and
+// of the sessions of each client
+type shaper struct {
+	mu      sync.Mutex
+	global  *ratelimit.Bucket
+	clients map[string]*clientBandwidth
+}
+
+// clientBandwidth is the bucket shared by the sessions of a client
+type clientBandwidth struct {
+	bucket   *ratelimit.Bucket
+	sessions int
+}
+
+func newShaper() *shaper {
+	return &shaper{global: ratelimit.NewBucket(0, 0), clients: make(map[string]*clientBandwidth)}
+}
+
+// requestBurst is the number of requests a bucket of the given rate holds,
+// letting a second of requests arrive at once
+func requestBurst(rate int64) int64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// apply updates the limits shared by the sessions to the configuration
+func (sh *shaper) apply(cfg *config.Config) {
+	sh.global.SetRate(cfg.Limits.MaxBandwidth, ratelimit.BandwidthBurst(cfg.Limits.MaxBandwidth))
+}
+
+// acquire returns the buckets limiting a new session of the client, which
+// must be released once it has ended
+func (sh *shaper) acquire(ip net.IP, cfg *config.Config) []*ratelimit.Bucket {
+	buckets := []*ratelimit.Bucket{sh.global}
+	if rate := cfg.Limits.MaxSessionBandwidth; rate > 0 {
+		buckets = append(buckets, ratelimit.NewBucket(rate, ratelimit.BandwidthBurst(rate)))
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	client, ok := sh.clients[ip.String()]
+	if !ok {
+		client = &clientBandwidth{bucket: ratelimit.NewBucket(0, 0)}
+		sh.clients[ip.String()] = client
+	}
+	client.sessions++
+	rate := cfg.Limits.MaxClientBandwidth
+	client.bucket.SetRate(rate, ratelimit.BandwidthBurst(rate))
+	return append(buckets, client.bucket)
+}
+
+// release forgets the bucket of a client once its last session has ended
+func (sh *shaper) release(ip net.IP) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	client, ok := sh.clients[ip.String()]
+	if !ok {
+		return
+	}
+	client.sessions--
+	if client.sessions <= 0 {
+		delete(sh.clients, ip.String())
+	}
+}
+
+// reserve takes n bytes from the bandwidth limits of the session, and
+// returns how long to wait before sending them
+func (s *Server) reserve(sess *session, n int) time.Duration {
+	var delay time.Duration
+	for _, bucket := range sess.buckets {
+		if wait := bucket.Reserve(n); wait > delay {
+			delay = wait
+		}
+	}
+	if delay > 0 {
+		s.Metrics.Throttled(delay)
+	}
+	return delay
+}
+
+// throttle waits for the bandwidth limits of the session to let n more
+// bytes through, returning errCanceled if the session is canceled meanwhile
+func (s *Server) throttle(sess *session, n int) error {
+	delay := s.reserve(sess, n)
+	if delay <= 0 {
+		return nil
+	}
+
+	if !ratelimit.Wait(delay, throttleStep, sess.isCanceled) {
+		return errCanceled
+	}
+	return nil
+}
+
+// applyRateLimits updates the buckets shared by the sessions and the rate
+// of the requests to the configuration
+func (s *Server) applyRateLimits(cfg *config.Config) {
+	s.shaper.apply(cfg)
+	rate := cfg.Limits.MaxRequestsPerSecond
+	s.requests.SetRate(rate, requestBurst(rate))
+	s.Metrics.SetRateLimits(cfg.Limits.MaxBandwidth, cfg.Limits.MaxClientBandwidth,
+		cfg.Limits.MaxSessionBandwidth, cfg.Limits.MaxRequestsPerSecond)
+}
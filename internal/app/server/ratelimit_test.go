@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/tftptest"
+	"github.com/pkg/errors"
+)
+
+// configureLimits returns a prepare function of startServer changing the
+// limits of the server
+func configureLimits(t *testing.T, change func(limits *config.Limits)) func(s *Server) {
+	return func(s *Server) {
+		cfg := *s.Config()
+		change(&cfg.Limits)
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestBandwidthLimits expects the reads limited to 10000 bytes per second to
+// take at least 300ms for 5000 bytes, a tenth of a second of data going
+// through at once, whether the limit applies to each session, to the
+// sessions of a client together or to all of them
+func TestBandwidthLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit func(limits *config.Limits)
+		reads int
+	}{
+		{"session", func(limits *config.Limits) { limits.MaxSessionBandwidth = 10000 }, 1},
+		{"client", func(limits *config.Limits) { limits.MaxClientBandwidth = 10000 }, 2},
+		{"server", func(limits *config.Limits) { limits.MaxBandwidth = 10000 }, 2},
+	}
+	minimum := 300 * time.Millisecond
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, serverAddr := startServer(t, configureLimits(t, test.limit))
+			expected := content(5000 / test.reads)
+			writeFile(t, s.Config().Root, "slow.bin", expected)
+
+			started := time.Now()
+			done := make(chan error, test.reads)
+			for i := 0; i < test.reads; i++ {
+				c := newClient()
+				go func() {
+					var received bytes.Buffer
+					err := c.ReceiveFile(serverAddr, "slow.bin", &received)
+					if err == nil && !bytes.Equal(received.Bytes(), expected) {
+						err = errors.Errorf("received %d bytes, expected %d", received.Len(), len(expected))
+					}
+					done <- err
+				}()
+			}
+			for i := 0; i < test.reads; i++ {
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Fatal(err)
+					}
+				case <-time.After(10 * tftptest.Timeout):
+					t.Fatal("the reads have not completed")
+				}
+			}
+			if elapsed := time.Since(started); elapsed < minimum {
+				t.Errorf("the reads have taken %v, expected at least %v", elapsed, minimum)
+			}
+		})
+	}
+}
+
+// TestRequestRate expects the requests beyond the limit to be dropped
+// without an answer
+func TestRequestRate(t *testing.T) {
+	s, serverAddr := startServer(t, configureLimits(t, func(limits *config.Limits) { limits.MaxRequestsPerSecond = 2 }))
+	writeFile(t, s.Config().Root, "small.bin", content(100))
+
+	var peers []*tftptest.Peer
+	for i := 0; i < 3; i++ {
+		p := newPeer(t, serverAddr)
+		p.Send(packets.NewRRQPacket("small.bin", packets.Octet))
+		peers = append(peers, p)
+	}
+	for _, p := range peers[:2] {
+		p.ExpectData(1, 100)
+		p.Send(packets.NewAckPacket(1))
+	}
+	peers[2].ExpectNothing()
+}
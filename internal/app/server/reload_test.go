@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"go.uber.org/zap"
+)
+
+// TestReload expects the configuration file to be applied when it is
+// valid, and the current configuration to be kept otherwise. The files
+// set the root directory to ROOT
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		applied bool
+	}{
+		{"valid", "root: ROOT\nlimits:\n  max_sessions: 10\nlogging:\n  level: error\n", true},
+		{"unknown setting", "root: ROOT\nroots: ROOT\n", false},
+		{"invalid value", "root: ROOT\nlimits:\n  max_block_size: 4\n", false},
+		{"not YAML", "root: [ROOT", false},
+	}
+
+	for _, test := range tests {
+		root := t.TempDir()
+		path := filepath.Join(root, "tftp.yaml")
+		if err := ioutil.WriteFile(path, []byte(strings.Replace(test.content, "ROOT", root, -1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s := NewServer()
+		s.Logger = logger.New(zap.NewNop())
+		s.ConfigPath = path
+
+		s.reload()
+		if applied := s.Config().Root == root; applied != test.applied {
+			t.Errorf("%s: the root is %q after the reload", test.name, s.Config().Root)
+		}
+	}
+
+	s := NewServer()
+	s.Logger = logger.New(zap.NewNop())
+	s.ConfigPath = filepath.Join(t.TempDir(), "missing.yaml")
+	s.reload()
+	if root := s.Config().Root; root != "." {
+		t.Errorf("missing file: the root is %q after the reload", root)
+	}
+}
+
+// TestSetConfigDuringTransfer expects the transfers in progress to go on
+// with the root directory they have started with once the configuration
+// has changed, and the new requests to follow the new configuration
+func TestSetConfigDuringTransfer(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+	previousRoot := s.Config().Root
+	previous := content(1100)
+	writeFile(t, previousRoot, "image.bin", previous)
+	reader, writer := newPeer(t, serverAddr), newPeer(t, serverAddr)
+
+	reader.Send(packets.NewRRQPacket("image.bin", packets.Octet))
+	received := reader.ExpectData(1, 512).Data
+	writer.Send(packets.NewWRQPacket("upload.bin", packets.Octet))
+	writer.ExpectAck(0)
+
+	cfg := *s.Config()
+	cfg.Root = t.TempDir()
+	added := freeAddr(t)
+	cfg.Listen = []string{serverAddr.String(), added.String()}
+	if err := s.SetConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	current := content(300)
+	writeFile(t, cfg.Root, "image.bin", current)
+
+	for block, size := range []int{512, 76} {
+		reader.Send(packets.NewAckPacket(uint16(block + 1)))
+		received = append(received, reader.ExpectData(uint16(block+2), size).Data...)
+	}
+	reader.Send(packets.NewAckPacket(3))
+	if !bytes.Equal(received, previous) {
+		t.Errorf("received %d bytes of the previous root, expected %d", len(received), len(previous))
+	}
+	writer.Send(packets.NewDataPacket(1, content(100)))
+	writer.ExpectAck(1)
+
+	for _, addr := range []*net.UDPAddr{serverAddr, added} {
+		p := newPeer(t, addr)
+		p.Send(packets.NewRRQPacket("image.bin", packets.Octet))
+		if data := p.ExpectData(1, len(current)).Data; !bytes.Equal(data, current) {
+			t.Errorf("%v has sent %d bytes, expected those of the new root", addr, len(data))
+		}
+		p.Send(packets.NewAckPacket(1))
+	}
+
+	s.Stop()
+	if uploaded, err := ioutil.ReadFile(filepath.Join(previousRoot, "upload.bin")); err != nil || !bytes.Equal(uploaded, content(100)) {
+		t.Errorf("the upload has not been written to the previous root: %v", err)
+	}
+}
@@ -1,228 +1,808 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
-	"strings"
+	"path"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/mirkoschicchi/TFTP/internal/app/audit"
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
 	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/metrics"
 	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/progress"
+	"github.com/mirkoschicchi/TFTP/internal/app/ratelimit"
+	"github.com/mirkoschicchi/TFTP/internal/app/templates"
+	"github.com/mirkoschicchi/TFTP/internal/app/trace"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
 	"github.com/mirkoschicchi/TFTP/internal/app/utils"
 	"github.com/pkg/errors"
 )
 
 type Server struct {
 	Wg *sync.WaitGroup
+	// Logger receives the messages of the server and of its sessions
+	Logger *logger.Logger
+	// OnProgress is called every time a session makes progress
+	OnProgress func(clientAddr *net.UDPAddr, report progress.Report)
+	// ConfigPath is the file the configuration is reloaded from on SIGHUP
+	ConfigPath string
+	// Metrics collects the statistics of the server when set
+	Metrics *metrics.Metrics
+	// Audit receives a record for every completed transfer when set
+	Audit *audit.Log
+	// Tracer records every packet sent or received when set
+	Tracer *trace.Tracer
+	// Network opens the sockets of the server, which are UDP sockets by default
+	Network transport.Network
+	// Router routes the requests to the handlers serving them, falling
+	// back to the files of the root directory
+	Router *Router
+
+	sessions       *registry
+	mu             sync.RWMutex
+	config         *config.Config
+	templates      *templates.Renderer
+	checksums      *checksumCache
+	shaper         *shaper
+	requests       *ratelimit.Bucket
+	uploads        *uploadReservations
+	listening      bool
+	listeners      map[string]net.PacketConn
+	activeSessions int32
+
+	multicastMu sync.Mutex
+	multicasts  map[string]*multicastTransfer
 }
 
 func NewServer() *Server {
 	server := new(Server)
 	server.Wg = new(sync.WaitGroup)
+	// The level of the configuration applies to the server only
+	server.Logger = logger.Default().Fork()
+	server.config = config.Default()
+	server.listeners = make(map[string]net.PacketConn)
+	server.Network = transport.UDP{}
+	server.Router = NewRouter()
+	server.sessions = newRegistry()
+	server.multicasts = make(map[string]*multicastTransfer)
+	server.checksums = newChecksumCache()
+	server.shaper = newShaper()
+	server.requests = ratelimit.NewBucket(0, 0)
+	server.uploads = newUploadReservations()
 
 	return server
 }
 
+// Config returns the configuration currently in use
+func (s *Server) Config() *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.config
+}
+
+// SetConfig replaces the configuration of the server. Sessions already running
+// keep the configuration they have been started with, while new requests use
+// the new one. When the server is listening, listeners are opened and closed
+// to match the new list of addresses. The directories having a quota are
+// measured again by the next uploads
+func (s *Server) SetConfig(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return errors.Wrap(err, "invalid configuration")
+	}
+	if err := s.setLogLevel(cfg); err != nil {
+		return err
+	}
+	var renderer *templates.Renderer
+	if cfg.Templates.Suffix != "" {
+		var err error
+		if renderer, err = templates.NewRenderer(cfg.Templates.Suffix, cfg.Templates.Inventory); err != nil {
+			return errors.Wrap(err, "invalid configuration")
+		}
+	}
+
+	s.mu.Lock()
+	s.config = cfg
+	s.templates = renderer
+	listening := s.listening
+	s.mu.Unlock()
+	s.applyRateLimits(cfg)
+	s.uploads.forget()
+
+	if listening {
+		return s.updateListeners()
+	}
+	return nil
+}
+
+// Listen serves the requests until SIGINT or SIGTERM is received,
+// reloading the configuration on SIGHUP
 func (s *Server) Listen() error {
-	localAddr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:69")
-	if err != nil {
-		return errors.Wrap(err, "cannot resolve the local UDP address")
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signalChannel)
+
+	for sig := range signalChannel {
+		if sig == syscall.SIGHUP {
+			s.reload()
+			continue
+		}
+		s.Logger.Warning("CTRL-C has been pressed. Shutting down the server")
+		break
+	}
+
+	s.Stop()
+	s.Logger.Info("The server and related go-routines has been shutted down")
+	return nil
+}
+
+// Start opens the listeners and serves the requests in the background
+func (s *Server) Start() error {
+	s.mu.Lock()
+	s.listening = true
+	s.mu.Unlock()
+
+	if err := s.setLogLevel(s.Config()); err != nil {
+		return err
+	}
+	s.applyRateLimits(s.Config())
+	if err := s.updateListeners(); err != nil {
+		s.closeListeners()
+		return err
 	}
 
-	initialConnection, err := net.ListenUDP("udp4", localAddr)
+	return nil
+}
+
+// Stop closes the listeners and waits for the running sessions to end
+func (s *Server) Stop() {
+	s.mu.Lock()
+	s.listening = false
+	s.mu.Unlock()
+
+	s.closeListeners()
+	s.Wg.Wait()
+}
+
+// setLogLevel applies the logging level of the configuration, if any, to
+// the logger of the server
+func (s *Server) setLogLevel(cfg *config.Config) error {
+	if cfg.Logging.Level == "" {
+		return nil
+	}
+	if err := s.Logger.SetLevel(cfg.Logging.Level); err != nil {
+		return errors.Wrap(err, "invalid logging level")
+	}
+
+	return nil
+}
+
+// reload loads the configuration file again. The current configuration
+// is kept if the file is not valid
+func (s *Server) reload() {
+	if s.ConfigPath == "" {
+		s.Logger.Warning("SIGHUP received but the server has no configuration file to reload")
+		return
+	}
+
+	cfg, err := config.Load(s.ConfigPath)
 	if err != nil {
-		return errors.Wrap(err, "error while listening for incoming UDP connections")
+		s.Logger.Error("Cannot reload the configuration, keeping the current one: %v", err)
+		return
 	}
-	defer initialConnection.Close()
+	if err := s.SetConfig(cfg); err != nil {
+		s.Logger.Error("Cannot apply the reloaded configuration: %v", err)
+		return
+	}
+	s.Logger.Info("The configuration has been reloaded from %s", s.ConfigPath)
+}
 
-	logger.Info("Server listening on %s", initialConnection.LocalAddr().String())
+// updateListeners opens a listener for every configured address
+// and closes the ones that are not configured anymore
+func (s *Server) updateListeners() error {
+	cfg := s.Config()
 
-	signalChannel := make(chan os.Signal)
-	quitChannel := make(chan bool)
-	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-signalChannel
-		logger.Warning("CTRL-C has been pressed. Shutting down the server")
-		initialConnection.Close()
-		quitChannel <- true
-	}()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	configured := make(map[string]bool)
+	for _, address := range cfg.Listen {
+		configured[address] = true
+		if _, ok := s.listeners[address]; ok {
+			continue
+		}
+
+		conn, err := s.Network.ListenPacket(address)
+		if err != nil {
+			return errors.Wrap(err, "error while listening for incoming UDP connections")
+		}
+		listener := transport.NewDemux(conn)
+		s.listeners[address] = listener
+
+		s.Logger.Info("Server listening on %s", listener.LocalAddr().String())
+		go s.serve(listener)
+	}
+
+	for address, listener := range s.listeners {
+		if !configured[address] {
+			listener.Close()
+			delete(s.listeners, address)
+			s.Logger.Info("Server stopped listening on %s", address)
+		}
+	}
+
+	return nil
+}
 
-LOOP:
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for address, listener := range s.listeners {
+		listener.Close()
+		delete(s.listeners, address)
+	}
+}
+
+// serve reads the requests arriving to the listener and
+// starts a session for each of them
+func (s *Server) serve(listener net.PacketConn) {
 	for {
-		select {
-		case <-quitChannel:
-			break LOOP
-		default:
-			logger.Info("Server is waiting to receive packets from clients")
-			var buf []byte = make([]byte, packets.TftpMaxPacketSize)
-			_, remoteAddr, err := initialConnection.ReadFromUDP(buf)
-			if err != nil {
-				return errors.Wrap(err, "cannot read client request")
+		s.Logger.Debug("Server is waiting to receive packets from clients")
+		var buf []byte = make([]byte, packets.TftpMaxPacketSize)
+		bytesReceived, addr, err := listener.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.Logger.Error("Cannot read client request: %+v", err)
 			}
+			return
+		}
+		remoteAddr := transport.UDPAddr(addr)
+		s.Tracer.Received(listener.LocalAddr(), remoteAddr, buf[:bytesReceived])
 
-			parsedPacket, err := packets.ParsePacket(buf)
-			if err != nil {
-				return errors.Wrap(err, "cannot parse incoming packet")
-			}
+		parsedPacket, err := packets.ParsePacket(buf[:bytesReceived])
+		if err != nil {
+			s.Logger.Warning("Cannot parse the packet received from %+v: %v", remoteAddr, err)
+			continue
+		}
 
-			switch parsedPacket := parsedPacket.(type) {
-			case packets.RRQPacket:
-				s.Wg.Add(1)
-				go s.handleRRQRequest(remoteAddr, parsedPacket)
-			case packets.WRQPacket:
-				s.Wg.Add(1)
-				go s.handleWRQRequest(remoteAddr, parsedPacket)
-			default:
-				logger.Warning("Unexpected packet received. Ignoring it")
+		switch parsedPacket := parsedPacket.(type) {
+		case packets.RRQPacket:
+			if conn, ok := s.accept(listener, remoteAddr, opcodeRRQ); ok {
+				go s.handleRRQRequest(conn, remoteAddr, parsedPacket)
 			}
+		case packets.WRQPacket:
+			if conn, ok := s.accept(listener, remoteAddr, opcodeWRQ); ok {
+				go s.handleWRQRequest(conn, remoteAddr, parsedPacket)
+			}
+		default:
+			if s.Config().SinglePort {
+				// The listening port is the TID of every session
+				s.Logger.Warning("Packet received from %+v which has no session", remoteAddr)
+				s.refuse(listener, remoteAddr, packets.NewErrorPacket(5, "Unknown transfer ID"))
+				continue
+			}
+			s.Logger.Warning("Unexpected packet received. Ignoring it")
 		}
 	}
+}
 
-	s.Wg.Wait()
-	logger.Info("The server and related go-routines has been shutted down")
-	return nil
+// accept opens the connection of a new session with the client, if it can be
+// admitted. The connection is opened before the session starts, so that the
+// next datagrams of the client are delivered to it in single-port mode
+func (s *Server) accept(listener net.PacketConn, clientAddr *net.UDPAddr, opcode string) (net.PacketConn, bool) {
+	// Requests beyond the limit are dropped without an answer, which
+	// would add to the flood
+	if !s.requests.Allow(1) {
+		s.Logger.Debug("Dropping the request of client %+v: too many requests", clientAddr)
+		s.Metrics.RequestRefused(opcode, metrics.OutcomeRateLimited)
+		return nil, false
+	}
+	conn, err := s.openConn(listener, clientAddr)
+	if err != nil {
+		s.Logger.Error("Cannot open a connection to client %+v: %v", clientAddr, err)
+		return nil, false
+	}
+	if !s.admit(listener, clientAddr, opcode) {
+		conn.Close()
+		return nil, false
+	}
+
+	return conn, true
 }
 
-func (s *Server) handleRRQRequest(clientAddr *net.UDPAddr, rrqPacket packets.RRQPacket) error {
-	defer s.Wg.Done()
-	logger.Info(">>> Client having address %+v has requested to read file %s", clientAddr, rrqPacket.Filename)
+// openConn opens the connection of a session with the client. In single-port
+// mode, it shares the listener, which routes the datagrams of the client to
+// it. Otherwise it is a new socket on a random port, the TID of the server
+func (s *Server) openConn(listener net.PacketConn, clientAddr *net.UDPAddr) (net.PacketConn, error) {
+	if demux, ok := listener.(*transport.Demux); ok && s.Config().SinglePort {
+		return demux.Conn(clientAddr)
+	}
 
 	randomTID := utils.GetRandomTID()
-	localAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf(":%d", randomTID))
+	conn, err := s.Network.ListenPacket(fmt.Sprintf(":%d", randomTID))
 	if err != nil {
-		return errors.Wrap(err, "cannot resolve the local UDP address")
+		return nil, errors.Wrapf(err, "cannot instantiate new connection to machine %+v", clientAddr)
 	}
+	return conn, nil
+}
 
-	logger.Debug(">>> Server has generated a random TID: %d", randomTID)
+// admit checks whether a new session can be started for the client, and
+// registers it if so. Refused clients are answered with an ERROR packet
+func (s *Server) admit(listener net.PacketConn, clientAddr *net.UDPAddr, opcode string) bool {
+	cfg := s.Config()
+
+	canRead, canWrite := cfg.Permissions(clientAddr.IP)
+	if (opcode == opcodeWRQ && !canWrite) || (opcode == opcodeRRQ && !canRead) {
+		s.Logger.Warning("Client %+v is not allowed to perform the request", clientAddr)
+		s.Metrics.RequestRefused(opcode, metrics.OutcomeDenied)
+		s.refuse(listener, clientAddr, packets.NewErrorPacket(2, "Access violation"))
+		return false
+	}
 
-	logger.Debug(">>> Server is creating a new connection to the client using local port %d", randomTID)
-	newConnection, err := net.DialUDP("udp4", localAddr, clientAddr)
-	if err != nil {
-		return errors.Wrapf(err, "cannot instantiate new connection to machine %+v", clientAddr)
+	maxSessions := int32(cfg.Limits.MaxSessions)
+	if maxSessions > 0 && atomic.LoadInt32(&s.activeSessions) >= maxSessions {
+		s.Logger.Warning("Refusing request of client %+v: too many active sessions", clientAddr)
+		s.Metrics.RequestRefused(opcode, metrics.OutcomeBusy)
+		s.refuse(listener, clientAddr, packets.NewErrorPacket(0, "Too many active sessions, try again later"))
+		return false
 	}
-	defer newConnection.Close()
 
-	logger.Debug(">>> Reading requested file from the file-system: %s", rrqPacket.Filename)
-	requestedFileContent, err := utils.ReadFileFromFS(rrqPacket.Filename)
+	atomic.AddInt32(&s.activeSessions, 1)
+	s.Metrics.SessionStarted()
+	s.Wg.Add(1)
+	return true
+}
+
+// refuse answers a datagram that does not belong to a session with an ERROR packet
+func (s *Server) refuse(conn net.PacketConn, clientAddr *net.UDPAddr, errorPacket packets.ErrorPacket) {
+	datagram := errorPacket.Bytes()
+	_, err := conn.WriteTo(datagram, clientAddr)
 	if err != nil {
-		logger.Error("Cannot read file %s", rrqPacket.Filename)
-		errorPacket := packets.NewErrorPacket(1, fmt.Sprintf("File %s has not been found in the server. Err: %v", rrqPacket.Filename, err))
-		_, err = newConnection.Write(errorPacket.Bytes())
-		if err != nil {
-			logger.Error("%+v", err)
+		s.Logger.Error("Cannot send error packet to client %+v: %v", clientAddr, err)
+		return
+	}
+	s.Tracer.Sent(conn.LocalAddr(), clientAddr, datagram)
+	s.Metrics.ErrorSent(errorPacket.ErrorCode)
+}
+
+// sendError sends an ERROR packet to the peer of a session
+func (s *Server) sendError(sess *session, conn net.PacketConn, errorPacket packets.ErrorPacket) error {
+	if _, err := s.send(sess, conn, errorPacket); err != nil {
+		return err
+	}
+	s.Metrics.ErrorSent(errorPacket.ErrorCode)
+	return nil
+}
+
+// startSession adds a session admitted by admit to the registry
+func (s *Server) startSession(clientAddr *net.UDPAddr, operation string, filename string, mode packets.Mode) *session {
+	tracker := progress.NewTracker(filename, 0, s.sessionProgress(clientAddr))
+	sess := newSession(clientAddr, operation, filename, string(mode), tracker)
+	sess.buckets = s.shaper.acquire(clientAddr.IP, s.Config())
+	s.sessions.add(sess)
+
+	return sess
+}
+
+// endSession releases the resources of a session started by admit
+// and records its outcome, given by the error returned by the handler
+func (s *Server) endSession(sess *session, err *error) {
+	report := sess.tracker.Report()
+	s.Metrics.SessionEnded(sess.operation, *err == nil || *err == errProbed, report.Transferred, report.Elapsed)
+	info := s.sessions.remove(sess, *err)
+	s.audit(sess, info, report.Elapsed)
+	s.shaper.release(sess.peer.IP)
+	atomic.AddInt32(&s.activeSessions, -1)
+	s.Wg.Done()
+}
+
+// audit writes the record of a completed session to the audit log, if any
+func (s *Server) audit(sess *session, info SessionInfo, elapsed time.Duration) {
+	if s.Audit == nil {
+		return
+	}
+
+	record := audit.Record{
+		Time:       *info.FinishedAt,
+		ClientIP:   sess.peer.IP.String(),
+		ClientPort: sess.peer.Port,
+		Operation:  info.Operation,
+		Path:       info.Filename,
+		Mode:       info.Mode,
+		Options:    info.Options,
+		Bytes:      info.Transferred,
+		Duration:   elapsed.Seconds(),
+		Result:     info.Result,
+		Error:      info.Error,
+		SHA256:     info.SHA256,
+	}
+	if err := s.Audit.Write(record); err != nil {
+		s.Logger.Error("Cannot write the audit record of session %s: %v", sess.id, err)
+	}
+}
+
+// readFailed returns the error ending a session whose handler could not
+// read the next packet of the peer, recording timeouts in the metrics
+func (s *Server) readFailed(sess *session, err error, message string) error {
+	if sess.isCanceled() {
+		return errCanceled
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		s.Metrics.Timeout()
+	}
+
+	return errors.Wrap(err, message)
+}
+
+const (
+	opcodeRRQ = "RRQ"
+	opcodeWRQ = "WRQ"
+)
+
+// resolvePath returns the location in the root directory of the requested
+// file. The file name is cleaned so that it cannot point outside the root
+func resolvePath(root string, filename string) string {
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+filename)))
+}
+
+func (s *Server) handleRRQRequest(newConnection net.PacketConn, clientAddr *net.UDPAddr, rrqPacket packets.RRQPacket) (err error) {
+	sess := s.startSession(clientAddr, opcodeRRQ, rrqPacket.Filename, rrqPacket.Mode)
+	defer s.endSession(sess, &err)
+	tracker := sess.tracker
+	cfg := s.Config()
+	log := s.sessionLogger(sess)
+	log.Info(">>> Client having address %+v has requested to read file %s", clientAddr, rrqPacket.Filename)
+
+	log.Debug(">>> Server is using local address %s for the connection to the client", newConnection.LocalAddr())
+	defer newConnection.Close()
+	sess.attach(newConnection)
+
+	request := s.newRequest(sess, clientAddr, rrqPacket.Filename, rrqPacket.Mode, rrqPacket.Options, cfg)
+	log.Debug(">>> Opening requested file: %s", request.Filename)
+	requestedFile, size, readErr := s.openRead(request, cfg)
+	if readErr != nil {
+		log.Error("Cannot read file %s: %v", rrqPacket.Filename, readErr)
+		if err := s.sendError(sess, newConnection, errorPacketFor(rrqPacket.Filename, readErr)); err != nil {
+			log.Error("%+v", err)
 			return errors.Wrapf(err, "cannot send error packet to client %+v", clientAddr)
 		}
-		return errors.Wrap(err, "cannot read requested file from server FS")
+		return errors.Wrap(readErr, "cannot read requested file")
 	}
 
-	// Split the file in blocks of max length 512 bytes
-	fileDataBlocks, numberOfBlocks := utils.CreateDataBlocks(requestedFileContent)
-	logger.Debug(">>> The file has been splitted into %d blocks", numberOfBlocks)
-
-	for blockCounter, dataBlock := range fileDataBlocks {
-		dataPacket := packets.NewDataPacket(uint16(blockCounter+1), dataBlock)
-		bytesWritten, err := newConnection.Write(dataPacket.Bytes())
+	transferSize := size
+	if size < 0 {
+		transferSize = sizeUnknown
+	}
+	acceptedOptions, options := negotiateOptions(rrqPacket.Options, transferSize, cfg)
+	if _, ok := rrqPacket.Options[packets.OptionSHA256]; ok && cfg.OptionAllowed(packets.OptionSHA256) {
+		if sum, sumErr := s.checksums.digest(requestedFile); sumErr != nil {
+			log.Debug(">>> Declining the sha256 option: %v", sumErr)
+		} else {
+			acceptedOptions[packets.OptionSHA256] = sum
+		}
+	}
+	if content, declined := multicastContent(rrqPacket.Options, requestedFile, size, options, cfg.MulticastGroup()); declined != nil {
+		log.Info(">>> Declining the multicast option: %v", declined)
+	} else if content != nil {
+		newConnection.Close()
+		return s.serveMulticast(sess, request.Filename, content, size, acceptedOptions, options, cfg.MulticastGroup())
+	}
+	if closer, ok := requestedFile.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if options.offset > 0 {
+		if seekErr := seekContent(requestedFile, options.offset); seekErr != nil {
+			log.Debug(">>> Declining the offset option: %v", seekErr)
+			delete(acceptedOptions, packets.OptionOffset)
+			options.offset = 0
+		} else {
+			log.Info(">>> Resuming the read of file %s at byte %d", rrqPacket.Filename, options.offset)
+		}
+	}
+	sess.setOptions(acceptedOptions)
+	if len(acceptedOptions) > 0 {
+		oackPacket := packets.NewOACKPacket(acceptedOptions)
+		_, err = s.send(sess, newConnection, oackPacket)
 		if err != nil {
-			logger.Error("%+v", err)
-			return errors.Wrapf(err, "cannot send data to machine %+v", clientAddr)
+			log.Error("%+v", err)
+			return errors.Wrapf(err, "cannot send OACK packet to client %+v", clientAddr)
+		}
+		log.Debug(">>> The server has acknowledged the options %+v", acceptedOptions)
+
+		// The client confirms the options with an ACK for block 0. PXE ROMs
+		// only ask for the size at first, answering the OACK with ERROR 8
+		if err := s.awaitAck(sess, newConnection, oackPacket, 0, options.timeout); err != nil {
+			if abort, ok := errors.Cause(err).(*abortError); ok && abort.code == 8 && acceptedOptions[packets.OptionTsize] != "" {
+				log.Info("Client %+v has read the size of file %s", clientAddr, rrqPacket.Filename)
+				return errProbed
+			}
+			log.Warning("Client %+v has not confirmed the options: %v", clientAddr, err)
+			return err
 		}
-		logger.Debug(">>> The server has sent %d bytes to the client", bytesWritten)
+	}
 
-		var buf []byte = make([]byte, packets.TftpMaxPacketSize)
-		newConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
-		bytesReceived, _, err := newConnection.ReadFromUDP(buf)
-		if err != nil {
-			logger.Error("%+v", err)
-			return errors.Wrap(err, "cannot read client request")
+	// Read the file one block of the negotiated size at a time. The last
+	// block is always shorter than the others, possibly empty
+	if size >= 0 {
+		tracker.SetTotal(size - options.offset)
+	}
+	digest := sha256.New()
+	content := io.TeeReader(requestedFile, digest)
+	buf := make([]byte, options.blockSize)
+
+	for blockNumber := uint16(1); ; blockNumber++ {
+		if sess.isCanceled() {
+			return errCanceled
+		}
+		n, readErr := io.ReadFull(content, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			log.Error("Cannot read file %s: %v", rrqPacket.Filename, readErr)
+			if err := s.sendError(sess, newConnection, errorPacketFor(rrqPacket.Filename, readErr)); err != nil {
+				log.Error("%+v", err)
+			}
+			return errors.Wrap(readErr, "cannot read requested file")
 		}
-		logger.Debug("The server has received %d bytes from the client", bytesReceived)
 
-		_, err = packets.ParsePacket(buf)
+		if err := s.throttle(sess, n); err != nil {
+			return err
+		}
+		dataPacket := packets.NewDataPacket(blockNumber, buf[:n])
+		bytesWritten, err := s.send(sess, newConnection, dataPacket)
 		if err != nil {
-			logger.Error("%+v", err)
-			return errors.Wrap(err, "cannot parse incoming packet")
+			log.Error("%+v", err)
+			return errors.Wrapf(err, "cannot send data to machine %+v", clientAddr)
+		}
+		log.With(packets.LogFields(dataPacket)...).Debug(">>> The server has sent %d bytes to the client", bytesWritten)
+		tracker.Add(n)
+		s.Metrics.BytesSent(n)
+
+		// The next block is only sent once this one is acknowledged
+		if err := s.awaitAck(sess, newConnection, dataPacket, dataPacket.BlockNumber, options.timeout); err != nil {
+			log.Error("%+v", err)
+			return err
+		}
+		if n < options.blockSize {
+			break
 		}
 	}
+	// The digest of a resumed read would only cover the end of the file
+	if options.offset == 0 {
+		sess.setDigest(digest.Sum(nil))
+	}
+	tracker.Finish()
 	return nil
 }
 
-func (s *Server) handleWRQRequest(clientAddr *net.UDPAddr, wrqPacket packets.WRQPacket) error {
-	defer s.Wg.Done()
-	logger.Info(">>> Client having address %+v has requested to write file %s", clientAddr, wrqPacket.Filename)
+func (s *Server) handleWRQRequest(newConnection net.PacketConn, clientAddr *net.UDPAddr, wrqPacket packets.WRQPacket) (err error) {
+	sess := s.startSession(clientAddr, opcodeWRQ, wrqPacket.Filename, wrqPacket.Mode)
+	defer s.endSession(sess, &err)
+	tracker := sess.tracker
+	cfg := s.Config()
+	log := s.sessionLogger(sess)
+	log.Info(">>> Client having address %+v has requested to write file %s", clientAddr, wrqPacket.Filename)
 
-	randomTID := utils.GetRandomTID()
-	localAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf(":%d", randomTID))
-	if err != nil {
-		return errors.Wrap(err, "cannot resolve the local UDP address")
+	log.Debug("Server is using local address %s for the connection to the client", newConnection.LocalAddr())
+	defer newConnection.Close()
+	sess.attach(newConnection)
+
+	// Acknowledge the request with an OACK if some options have been accepted,
+	// otherwise with the initial ACK packet
+	acceptedOptions, options := negotiateOptions(wrqPacket.Options, sizeFromClient, cfg)
+	sess.setOptions(acceptedOptions)
+
+	// Uploads which cannot fit, given the size announced with the tsize
+	// option, are refused before any block is sent
+	request := s.newRequest(sess, clientAddr, wrqPacket.Filename, wrqPacket.Mode, wrqPacket.Options, cfg)
+	space, limitErr := s.uploadSpace(request, cfg)
+	if limitErr == nil {
+		defer space.release()
+		limitErr = space.reserve(options.transferSize)
 	}
-
-	logger.Info(">>> Server has generated a random TID: %d", randomTID)
-
-	newConnection, err := net.DialUDP("udp4", localAddr, clientAddr)
-	newConnection.SetDeadline(time.Now().Add(5 * time.Second))
-	if err != nil {
-		logger.Error("%+v", err)
-		return errors.Wrapf(err, "cannot instantiate new connection to machine %+v", clientAddr)
+	if limitErr != nil {
+		log.Warning("Refusing the upload of file %s: %v", wrqPacket.Filename, limitErr)
+		if err := s.sendError(sess, newConnection, errorPacketFor(wrqPacket.Filename, limitErr)); err != nil {
+			log.Error("%+v", err)
+		}
+		return limitErr
 	}
-	logger.Debug("Server has initiated a new connection to the client using local port %d", randomTID)
-
-	// Create initial ACK packet
-	ackPacket := packets.NewAckPacket(0)
-	_, err = newConnection.Write(ackPacket.Bytes())
+	var initialPacket packets.Packet = packets.NewAckPacket(0)
+	if len(acceptedOptions) > 0 {
+		initialPacket = packets.NewOACKPacket(acceptedOptions)
+		log.Debug(">>> The server has acknowledged the options %+v", acceptedOptions)
+	}
+	_, err = s.send(sess, newConnection, initialPacket)
 	if err != nil {
-		logger.Error("%+v", err)
+		log.Error("%+v", err)
 		return errors.Wrapf(err, "cannot send initial ACK packet to client %+v", clientAddr)
 	}
 
-	var receivedBytes []byte
-	var isFinalBlock bool = false
-
-	for !isFinalBlock {
-		var buf []byte = make([]byte, packets.TftpMaxPacketSize)
-		newConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
-		_, _, err := newConnection.ReadFromUDP(buf)
+	// The blocks are passed to the write handler as they arrive. It is
+	// interrupted if the transfer fails, so that nothing is stored
+	stream := s.openWrite(request, cfg)
+	defer func() {
 		if err != nil {
-			panic(err)
+			stream.abort(err)
 		}
+	}()
+
+	tracker.SetTotal(options.transferSize)
+	var storedPath string
+	var lastAck packets.Packet = initialPacket
+	var expectedBlock uint16 = 1
+	var retransmissions int
+	bufferSize := options.blockSize + packets.DataHeaderSize
 
-		// Parse the bytes received into a packet
-		parsedPacket, err := packets.ParsePacket(buf)
+	for {
+		parsedPacket, bytesReceived, err := s.receive(sess, newConnection, bufferSize, options.timeout)
+		if isTimeout(err) && retransmissions < maxRetransmissions {
+			// The last ACK may have been lost, send it again
+			retransmissions++
+			log.Debug("No data received, sending %v again", lastAck)
+			if err := s.resend(sess, newConnection, lastAck); err != nil {
+				return errors.Wrapf(err, "cannot send ACK packet to client %+v", clientAddr)
+			}
+			continue
+		}
 		if err != nil {
-			return errors.Wrap(err, "cannot parse incoming packet")
+			log.Error("%+v", err)
+			return err
 		}
+		log.With(packets.LogFields(parsedPacket)...).Debug("The server has received %d bytes from the client", bytesReceived)
 
-		switch parsedPacket := parsedPacket.(type) {
-		case packets.ErrorPacket:
-			logger.Error("Error packet with following content has been received: %+v", parsedPacket)
-			return nil
-		case packets.DataPacket:
-			receivedBytes = append(receivedBytes, parsedPacket.Data...)
-			if len(parsedPacket.Data) < utils.MAX_DATA_FIELD_LENGTH {
-				isFinalBlock = true
+		errorPacket, isError := parsedPacket.(packets.ErrorPacket)
+		if isError {
+			log.Error("Error packet with following content has been received: %+v", errorPacket)
+			return errors.Errorf("the client has aborted the transfer: %s", errorPacket.ErrMsg)
+		}
+		dataPacket, isData := parsedPacket.(packets.DataPacket)
+		if !isData {
+			continue
+		}
+
+		if dataPacket.BlockNumber == expectedBlock-1 {
+			// The client has not received the ACK of the previous block
+			log.Debug("Duplicate block %d received, sending %v again", dataPacket.BlockNumber, lastAck)
+			if _, err := s.send(sess, newConnection, lastAck); err != nil {
+				return errors.Wrapf(err, "cannot send ACK packet to client %+v", clientAddr)
 			}
+			continue
+		}
+		if dataPacket.BlockNumber != expectedBlock {
+			log.Debug("Ignoring unexpected block %d", dataPacket.BlockNumber)
+			continue
+		}
 
-			ackPacket := packets.NewAckPacket(parsedPacket.BlockNumber)
+		retransmissions = 0
+		if limitErr := space.reserve(stream.size + int64(len(dataPacket.Data))); limitErr != nil {
+			log.Warning("Refusing the upload of file %s: %v", wrqPacket.Filename, limitErr)
+			if err := s.sendError(sess, newConnection, errorPacketFor(wrqPacket.Filename, limitErr)); err != nil {
+				log.Error("%+v", err)
+			}
+			return limitErr
+		}
+		tracker.Add(len(dataPacket.Data))
+		s.Metrics.BytesReceived(len(dataPacket.Data))
+		// The client waits for the ACK before sending the next block
+		if err := s.throttle(sess, len(dataPacket.Data)); err != nil {
+			return err
+		}
 
-			_, err := newConnection.Write(ackPacket.Bytes())
-			if err != nil {
-				return errors.Wrap(err, "cannot write to server")
+		// The final ACK is only sent once the file has been stored
+		storeErr := stream.write(dataPacket.Data)
+		lastBlock := len(dataPacket.Data) < options.blockSize
+		if storeErr == nil && lastBlock {
+			if storedPath, storeErr = stream.close(); storeErr == nil {
+				space.commit(stream.size)
+			}
+		}
+		if storeErr != nil {
+			log.Error("Cannot store file %s: %v", wrqPacket.Filename, storeErr)
+			if err := s.sendError(sess, newConnection, errorPacketFor(wrqPacket.Filename, storeErr)); err != nil {
+				log.Error("%+v", err)
 			}
+			return errors.Wrap(storeErr, "cannot store received file")
+		}
+
+		lastAck = packets.NewAckPacket(dataPacket.BlockNumber)
+		if _, err := s.send(sess, newConnection, lastAck); err != nil {
+			return errors.Wrap(err, "cannot write to server")
 		}
+		expectedBlock++
 
+		if lastBlock {
+			break
+		}
 	}
 
-	splittedFilePath := strings.Split(wrqPacket.Filename, "/")
-	receivedFile := splittedFilePath[len(splittedFilePath)-1]
-	logger.Debug("Saving received file to file-system. File location: %s", receivedFile)
-	f, err := os.Create(receivedFile)
-	if err != nil {
-		return errors.Wrap(err, "cannot create file to be received")
+	log.Debug("The received file has been stored. File location: %s", storedPath)
+	digest := stream.digest.Sum(nil)
+	sess.setDigest(digest)
+	tracker.Finish()
+	log.Info("The SHA-256 of the received file is %x", digest)
+	if cfg.Checksums.Uploads && storedPath != "" {
+		if err := writeChecksum(storedPath, hex.EncodeToString(digest)); err != nil {
+			log.Error("Cannot record the SHA-256 of %s: %v", storedPath, err)
+		}
 	}
-	f.WriteString(string(receivedBytes))
 
+	s.dally(sess, newConnection, lastAck, bufferSize, options.timeout)
+
+	upload := &Upload{Request: request, Path: storedPath, Size: stream.size, SHA256: hex.EncodeToString(digest)}
+	s.runHooks(sess, upload, cfg)
 	return nil
 }
+
+// send writes a packet to the peer of a session and records it in the trace
+func (s *Server) send(sess *session, conn net.PacketConn, packet packets.Packet) (int, error) {
+	datagram := packet.Bytes()
+	n, err := conn.WriteTo(datagram, sess.peer)
+	if err != nil {
+		return n, err
+	}
+	s.Tracer.Sent(conn.LocalAddr(), sess.peer, datagram)
+
+	return n, nil
+}
+
+// receive waits up to timeout for the next datagram of the peer of a
+// session, records it in the trace and parses it into a packet. Datagrams
+// coming from other ports are answered with an ERROR packet and ignored,
+// and the unparsable ones are dropped like the network would drop them
+func (s *Server) receive(sess *session, conn net.PacketConn, bufferSize int, timeout time.Duration) (interface{}, int, error) {
+	var buf []byte = make([]byte, bufferSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, 0, s.readFailed(sess, err, "cannot read client packet")
+		}
+		remoteAddr := transport.UDPAddr(addr)
+		s.Tracer.Received(conn.LocalAddr(), remoteAddr, buf[:n])
+		if !transport.SameAddr(remoteAddr, sess.peer) {
+			s.Logger.Warning("Ignoring packet of unknown transfer ID from %+v", remoteAddr)
+			s.refuse(conn, remoteAddr, packets.NewErrorPacket(5, "Unknown transfer ID"))
+			continue
+		}
+
+		parsedPacket, err := packets.ParsePacket(buf[:n])
+		if err != nil {
+			s.sessionLogger(sess).Warning("Dropping unparsable packet: %v", err)
+			continue
+		}
+
+		return parsedPacket, n, nil
+	}
+}
+
+// sessionLogger returns a logger adding the fields identifying the session
+func (s *Server) sessionLogger(sess *session) *logger.Logger {
+	return s.Logger.With("session", sess.id, "peer", sess.peer.String(), "filename", sess.filename)
+}
+
+// sessionProgress returns the progress callback for the session
+// of the given client, or nil if no callback has been registered
+func (s *Server) sessionProgress(clientAddr *net.UDPAddr) progress.Func {
+	if s.OnProgress == nil {
+		return nil
+	}
+	return func(report progress.Report) {
+		s.OnProgress(clientAddr, report)
+	}
+}
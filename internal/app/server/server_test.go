@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/audit"
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/tftptest"
+	"github.com/mirkoschicchi/TFTP/internal/app/trace"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// startServer serves a temporary directory on a free port of 127.0.0.1
+// until the test ends. prepare, when not nil, changes the server before
+// it starts
+func startServer(t *testing.T, prepare func(s *Server)) (*Server, *net.UDPAddr) {
+	t.Helper()
+	addr := freeAddr(t)
+	cfg := config.Default()
+	cfg.Listen = []string{addr.String()}
+	cfg.Root = t.TempDir()
+	cfg.Logging.Level = "error"
+	cfg.Timeouts.Default = tftptest.Timeout
+
+	s := NewServer()
+	s.Logger = logger.New(zap.NewNop())
+	if err := s.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if prepare != nil {
+		prepare(s)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("cannot start the server: %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	return s, addr
+}
+
+func freeAddr(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("cannot find a free port: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func writeFile(t *testing.T, dir string, name string, content []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// content returns size bytes covering every byte value, NUL included
+func content(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	return data
+}
+
+// newPeer returns a scripted client of the server at serverAddr
+func newPeer(t *testing.T, serverAddr *net.UDPAddr) *tftptest.Peer {
+	return tftptest.NewPeer(t, transport.UDP{}, serverAddr)
+}
+
+// newClient returns a client transferring files in octet mode
+func newClient() client.Client {
+	c := client.NewClient()
+	c.Mode = packets.Octet
+	c.Timeout = tftptest.Timeout
+	c.Logger = logger.New(zap.NewNop())
+	return c
+}
+
+// TestSessionFields expects the messages logged during a transfer to
+// identify its session, and those about packets to describe them
+func TestSessionFields(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	s, serverAddr := startServer(t, func(s *Server) {
+		s.Logger = logger.New(zap.New(core))
+		cfg := *s.Config()
+		cfg.Logging.Level = "debug"
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+	})
+	writeFile(t, s.Config().Root, "boot.bin", content(100))
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewRRQPacket("boot.bin", packets.Octet))
+	p.ExpectData(1, 100)
+	p.Send(packets.NewAckPacket(1))
+	s.Stop()
+
+	var session interface{}
+	var blocks int
+	for _, entry := range logs.AllUntimed() {
+		fields := entry.ContextMap()
+		if fields["session"] == nil {
+			continue
+		}
+		if session == nil {
+			session = fields["session"]
+		}
+		if fields["session"] != session || fields["peer"] != p.Addr().String() || fields["filename"] != "boot.bin" {
+			t.Errorf("%q has the fields %v", entry.Message, fields)
+		}
+		if fields["opcode"] == "DATA" && fmt.Sprint(fields["block"]) == "1" {
+			blocks++
+		}
+	}
+	if session == nil || blocks == 0 {
+		t.Errorf("the transfer has not been logged with its session and blocks: %v", logs.AllUntimed())
+	}
+}
+
+// TestAudit expects a record describing each completed transfer
+func TestAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := audit.Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	s, serverAddr := startServer(t, func(s *Server) { s.Audit = log })
+	writeFile(t, s.Config().Root, "boot.bin", content(100))
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewRRQPacket("boot.bin", packets.Octet))
+	p.ExpectData(1, 100)
+	p.Send(packets.NewAckPacket(1))
+	s.Stop()
+
+	logged, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record audit.Record
+	if err := json.Unmarshal(logged, &record); err != nil {
+		t.Fatalf("the audit log holds %q: %v", logged, err)
+	}
+	sum := sha256.Sum256(content(100))
+	clientAddr := p.Addr()
+	if record.ClientIP != "127.0.0.1" || record.ClientPort != clientAddr.Port || record.Operation != "RRQ" ||
+		record.Path != "boot.bin" || record.Mode != "octet" || record.Bytes != 100 ||
+		record.Result != ResultSuccess || record.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("the transfer has been audited as %+v", record)
+	}
+}
+
+// TestTrace expects every datagram of a transfer to be traced
+func TestTrace(t *testing.T) {
+	var traced bytes.Buffer
+	s, serverAddr := startServer(t, func(s *Server) { s.Tracer = trace.NewTracer(&traced) })
+	writeFile(t, s.Config().Root, "boot.bin", content(100))
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewRRQPacket("boot.bin", packets.Octet))
+	p.ExpectData(1, 100)
+	p.Send(packets.NewAckPacket(1))
+	s.Stop()
+
+	lines := strings.Split(strings.TrimSuffix(traced.String(), "\n"), "\n")
+	expected := []string{"received", "RRQ", "sent", "DATA", "received", "ACK"}
+	if len(lines) != len(expected)/2 {
+		t.Fatalf("traced %q", traced.String())
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, " "+expected[2*i]+" ") || !strings.Contains(line, expected[2*i+1]) {
+			t.Errorf("traced %q, expected the %s %s", line, expected[2*i], expected[2*i+1])
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/progress"
+	"github.com/mirkoschicchi/TFTP/internal/app/ratelimit"
+	"github.com/mirkoschicchi/TFTP/internal/app/trace"
+	"github.com/mirkoschicchi/TFTP/internal/app/utils"
+	"github.com/pkg/errors"
+)
+
+// maxCompletedSessions is the number of finished sessions kept in memory
+const maxCompletedSessions = 100
+
+// Results of a finished session
+const (
+	ResultSuccess  = "success"
+	ResultFailure  = "failure"
+	ResultCanceled = "canceled"
+	// ResultProbed is the result of the reads the client has ended with
+	// ERROR 8 once it has learnt the size of the file from the OACK
+	ResultProbed = "probed"
+)
+
+// ErrSessionNotFound is returned when cancelling a session that is not active
+var ErrSessionNotFound = errors.New("session not found")
+
+// errCanceled is returned by the handlers of a canceled session
+var errCanceled = errors.New("the session has been canceled")
+
+// errProbed is returned by the handlers of a read ended by the client
+// once it has learnt the size of the file
+var errProbed = errors.New("the client has only read the size of the file")
+
+// SessionInfo describes an active or a completed transfer
+type SessionInfo struct {
+	ID          string            `json:"id"`
+	Peer        string            `json:"peer"`
+	Operation   string            `json:"operation"`
+	Filename    string            `json:"filename"`
+	Mode        string            `json:"mode"`
+	Options     map[string]string `json:"options,omitempty"`
+	StartedAt   time.Time         `json:"started_at"`
+	Age         string            `json:"age"`
+	Transferred int64             `json:"transferred"`
+	Total       int64             `json:"total,omitempty"`
+	Retransmits int               `json:"retransmits"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	Result      string            `json:"result,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+}
+
+// session is the entry of the registry for a running transfer
+type session struct {
+	id        string
+	peer      *net.UDPAddr
+	operation string
+	filename  string
+	mode      string
+	startedAt time.Time
+	tracker   *progress.Tracker
+	// buckets limit the bandwidth of the session
+	buckets []*ratelimit.Bucket
+
+	mu       sync.Mutex
+	options  map[string]string
+	conn     net.PacketConn
+	canceled bool
+	digest   string
+}
+
+// registry keeps track of the active sessions and of the last completed ones
+type registry struct {
+	mu        sync.Mutex
+	active    map[string]*session
+	completed []SessionInfo
+}
+
+func newRegistry() *registry {
+	return &registry{active: make(map[string]*session)}
+}
+
+func (r *registry) add(sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.active[sess.id] = sess
+}
+
+// remove moves the session to the list of completed sessions
+// and returns its final state
+func (r *registry) remove(sess *session, err error) SessionInfo {
+	info := sess.info()
+	finishedAt := time.Now()
+	info.FinishedAt = &finishedAt
+	switch {
+	case sess.isCanceled():
+		info.Result = ResultCanceled
+	case err == errProbed:
+		info.Result = ResultProbed
+		err = nil
+	case err != nil:
+		info.Result = ResultFailure
+	default:
+		info.Result = ResultSuccess
+	}
+	if err != nil {
+		info.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.active, sess.id)
+	r.completed = append(r.completed, info)
+	if len(r.completed) > maxCompletedSessions {
+		r.completed = r.completed[len(r.completed)-maxCompletedSessions:]
+	}
+
+	return info
+}
+
+func (r *registry) get(id string) (*session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sess, ok := r.active[id]
+	return sess, ok
+}
+
+func newSession(peer *net.UDPAddr, operation string, filename string, mode string, tracker *progress.Tracker) *session {
+	return &session{
+		id:        utils.NewSessionID(),
+		peer:      peer,
+		operation: operation,
+		filename:  filename,
+		mode:      mode,
+		startedAt: time.Now(),
+		tracker:   tracker,
+	}
+}
+
+// attach records the connection used to talk to the peer,
+// which is needed to notify it when the session is canceled
+func (sess *session) attach(conn net.PacketConn) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.conn = conn
+}
+
+func (sess *session) setOptions(options map[string]string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.options = options
+}
+
+// setDigest records the SHA-256 computed while the content was transferred
+func (sess *session) setDigest(sum []byte) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.digest = hex.EncodeToString(sum)
+}
+
+// cancel sends an ERROR packet to the peer and interrupts the
+// handler, which is waiting for a packet or about to send one
+func (sess *session) cancel(tracer *trace.Tracer) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.canceled = true
+	if sess.conn == nil {
+		return nil
+	}
+
+	datagram := packets.NewErrorPacket(0, "Transfer canceled by the server administrator").Bytes()
+	if _, err := sess.conn.WriteTo(datagram, sess.peer); err != nil {
+		return errors.Wrapf(err, "cannot send error packet to client %+v", sess.peer)
+	}
+	tracer.Sent(sess.conn.LocalAddr(), sess.peer, datagram)
+
+	return sess.conn.SetReadDeadline(time.Now())
+}
+
+func (sess *session) isCanceled() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	return sess.canceled
+}
+
+func (sess *session) info() SessionInfo {
+	report := sess.tracker.Report()
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	return SessionInfo{
+		ID:          sess.id,
+		Peer:        sess.peer.String(),
+		Operation:   sess.operation,
+		Filename:    sess.filename,
+		Mode:        sess.mode,
+		Options:     sess.options,
+		StartedAt:   sess.startedAt,
+		Age:         time.Since(sess.startedAt).Round(time.Millisecond).String(),
+		Transferred: report.Transferred,
+		Total:       report.Total,
+		Retransmits: report.Retransmits,
+		SHA256:      sess.digest,
+	}
+}
+
+// Sessions returns the transfers in progress, oldest first
+func (s *Server) Sessions() []SessionInfo {
+	s.sessions.mu.Lock()
+	active := make([]*session, 0, len(s.sessions.active))
+	for _, sess := range s.sessions.active {
+		active = append(active, sess)
+	}
+	s.sessions.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(active))
+	for _, sess := range active {
+		infos = append(infos, sess.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+
+	return infos
+}
+
+// CompletedSessions returns the last finished transfers, most recent first
+func (s *Server) CompletedSessions() []SessionInfo {
+	s.sessions.mu.Lock()
+	defer s.sessions.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(s.sessions.completed))
+	for i := len(s.sessions.completed) - 1; i >= 0; i-- {
+		infos = append(infos, s.sessions.completed[i])
+	}
+
+	return infos
+}
+
+// CancelSession aborts an active transfer, notifying the peer with an ERROR packet
+func (s *Server) CancelSession(id string) error {
+	sess, ok := s.sessions.get(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	s.Logger.Warning("Canceling session %s of client %+v", id, sess.peer)
+	return sess.cancel(s.Tracer)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/progress"
+	"github.com/pkg/errors"
+)
+
+func TestRegistry(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	tests := []struct {
+		canceled bool
+		err      error
+		result   string
+	}{
+		{false, nil, ResultSuccess},
+		{false, errors.New("timeout"), ResultFailure},
+		{true, errCanceled, ResultCanceled},
+	}
+
+	for _, test := range tests {
+		s := NewServer()
+		sess := newSession(peer, opcodeRRQ, "boot.bin", "octet", progress.NewTracker("boot.bin", 0, nil))
+		s.sessions.add(sess)
+		if active := s.Sessions(); len(active) != 1 || active[0].ID != sess.id {
+			t.Fatalf("the active sessions are %+v", active)
+		}
+		if test.canceled {
+			if err := s.CancelSession(sess.id); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s.sessions.remove(sess, test.err)
+		completed := s.CompletedSessions()
+		if len(s.Sessions()) != 0 || len(completed) != 1 {
+			t.Fatalf("%s: %d sessions are active and %d completed", test.result, len(s.Sessions()), len(completed))
+		}
+		if completed[0].Result != test.result || completed[0].FinishedAt == nil {
+			t.Errorf("the session has completed as %+v, expected %s", completed[0], test.result)
+		}
+		if err := s.CancelSession(sess.id); err != ErrSessionNotFound {
+			t.Errorf("a completed session has been canceled: %v", err)
+		}
+	}
+}
+
+// TestCompletedSessions expects the most recent completed sessions to be
+// listed first, and only the last ones to be kept
+func TestCompletedSessions(t *testing.T) {
+	s := NewServer()
+	for i := 0; i < maxCompletedSessions+10; i++ {
+		name := strconv.Itoa(i)
+		sess := newSession(&net.UDPAddr{}, opcodeWRQ, name, "octet", progress.NewTracker(name, 0, nil))
+		s.sessions.add(sess)
+		s.sessions.remove(sess, nil)
+	}
+
+	completed := s.CompletedSessions()
+	if len(completed) != maxCompletedSessions {
+		t.Fatalf("%d completed sessions have been kept", len(completed))
+	}
+	if first, last := completed[0].Filename, completed[len(completed)-1].Filename; first != "109" || last != "10" {
+		t.Errorf("the completed sessions go from %s to %s", first, last)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/tftptest"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"github.com/pkg/errors"
+)
+
+// startSinglePortServer starts a server answering from its listening port
+func startSinglePortServer(t *testing.T) (*Server, *net.UDPAddr) {
+	return startServer(t, func(s *Server) {
+		cfg := *s.Config()
+		cfg.SinglePort = true
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestSinglePort expects concurrent sessions to be served from the
+// listening port, a repeated request to be ignored and the datagrams of
+// clients without a session to be rejected
+func TestSinglePort(t *testing.T) {
+	s, serverAddr := startSinglePortServer(t)
+	root := s.Config().Root
+	writeFile(t, root, "two.bin", content(700))
+	reader, writer, intruder := newPeer(t, serverAddr), newPeer(t, serverAddr), newPeer(t, serverAddr)
+
+	reader.Send(packets.NewRRQPacket("two.bin", packets.Octet))
+	reader.ExpectData(1, 512)
+	writer.Send(packets.NewWRQPacket("single.bin", packets.Octet))
+	writer.ExpectAck(0)
+	for _, p := range []*tftptest.Peer{reader, writer} {
+		if !transport.SameAddr(p.Remote, serverAddr) {
+			t.Fatalf("the session has been served from %v rather than %v", p.Remote, serverAddr)
+		}
+	}
+
+	reader.Send(packets.NewRRQPacket("two.bin", packets.Octet))
+	intruder.Send(packets.NewAckPacket(1))
+	intruder.ExpectError(5)
+
+	reader.Send(packets.NewAckPacket(1))
+	writer.Send(packets.NewDataPacket(1, content(100)))
+	reader.ExpectData(2, 188)
+	writer.ExpectAck(1)
+	reader.Send(packets.NewAckPacket(2))
+	expectResult(t, s, "two.bin", ResultSuccess)
+	expectResult(t, s, "single.bin", ResultSuccess)
+	expectFile(t, root, "single.bin", content(100))
+}
+
+// TestSinglePortClients expects clients to transfer files both ways with a
+// server in single-port mode
+func TestSinglePortClients(t *testing.T) {
+	s, serverAddr := startSinglePortServer(t)
+	root := s.Config().Root
+	expected := content(3000)
+	writeFile(t, root, "image.bin", expected)
+
+	done := make(chan error, 4)
+	for i := 0; i < 2; i++ {
+		c := newClient()
+		go func() {
+			var received bytes.Buffer
+			err := c.ReceiveFile(serverAddr, "image.bin", &received)
+			if err == nil && !bytes.Equal(received.Bytes(), expected) {
+				err = errors.Errorf("received %d bytes, expected %d", received.Len(), len(expected))
+			}
+			done <- err
+		}()
+	}
+	for _, filename := range []string{"first.bin", "second.bin"} {
+		c, filename := newClient(), filename
+		go func() { done <- c.SendFile(serverAddr, filename, bytes.NewReader(expected)) }()
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(10 * tftptest.Timeout):
+			t.Fatal("the transfers have not completed")
+		}
+	}
+	for _, filename := range []string{"first.bin", "second.bin"} {
+		expectResult(t, s, filename, ResultSuccess)
+		expectFile(t, root, filename, expected)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"github.com/pkg/errors"
+)
+
+// maxRetransmissions is how many times a packet is sent again
+// before giving up on a silent client
+const maxRetransmissions = 5
+
+// dallyTimeouts is how many timeouts the server dallies for, so that the
+// last block sent again by a client using the same timeout still arrives
+const dallyTimeouts = 2
+
+// isTimeout reports whether the error is caused by a read timeout
+func isTimeout(err error) bool {
+	netErr, ok := errors.Cause(err).(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// abortError is returned when the client aborts the transfer with an ERROR
+type abortError struct {
+	code    uint16
+	message string
+}
+
+func (e *abortError) Error() string {
+	return fmt.Sprintf("the client has aborted the transfer: %s", e.message)
+}
+
+// resend sends a packet again after a timeout, recording the retransmission
+func (s *Server) resend(sess *session, conn net.PacketConn, packet packets.Packet) error {
+	sess.tracker.Retransmit()
+	s.Metrics.Retransmission()
+	_, err := s.send(sess, conn, packet)
+	return err
+}
+
+// awaitAck waits for the ACK of the given block after sending packet,
+// sending it again when nothing arrives in time. Stale ACKs are ignored
+// rather than answered, which would duplicate every following packet.
+// The transfer fails if the client sends an ERROR or stays silent
+func (s *Server) awaitAck(sess *session, conn net.PacketConn, packet packets.Packet, block uint16, timeout time.Duration) error {
+	var retransmissions int
+	deadline := time.Now().Add(timeout)
+	for {
+		parsedPacket, _, err := s.receive(sess, conn, packets.TftpMaxPacketSize, time.Until(deadline))
+		if isTimeout(err) && retransmissions < maxRetransmissions && !sess.isCanceled() {
+			retransmissions++
+			s.sessionLogger(sess).Debug("No ACK of block %d received, sending %v again", block, packet)
+			if err := s.resend(sess, conn, packet); err != nil {
+				return errors.Wrapf(err, "cannot send %v again", packet)
+			}
+			deadline = time.Now().Add(timeout)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "the ACK of block %d has not been received", block)
+		}
+
+		switch parsedPacket := parsedPacket.(type) {
+		case packets.AckPacket:
+			if parsedPacket.BlockNumber == block {
+				return nil
+			}
+			s.sessionLogger(sess).Debug("Ignoring stale ACK of block %d", parsedPacket.BlockNumber)
+		case packets.ErrorPacket:
+			return &abortError{code: parsedPacket.ErrorCode, message: parsedPacket.ErrMsg}
+		}
+	}
+}
+
+// dally lingers after the final ACK of an upload for dallyTimeouts times
+// the timeout, acknowledging again the last block if the client sends it again
+// because the final ACK has been lost
+func (s *Server) dally(sess *session, conn net.PacketConn, finalAck packets.Packet, bufferSize int, timeout time.Duration) {
+	ack, ok := finalAck.(packets.AckPacket)
+	if !ok {
+		return
+	}
+
+	buf := make([]byte, bufferSize)
+	conn.SetReadDeadline(time.Now().Add(dallyTimeouts * timeout))
+	for !sess.isCanceled() {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		remoteAddr := transport.UDPAddr(addr)
+		s.Tracer.Received(conn.LocalAddr(), remoteAddr, buf[:n])
+		if !transport.SameAddr(remoteAddr, sess.peer) {
+			continue
+		}
+
+		parsedPacket, err := packets.ParsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		if data, ok := parsedPacket.(packets.DataPacket); ok && data.BlockNumber == ack.BlockNumber {
+			s.sessionLogger(sess).Debug("The final block has been sent again, acknowledging it again")
+			if _, err := s.send(sess, conn, ack); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/tftptest"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+)
+
+// expectResult waits for the server to complete the transfer of the file
+// and checks its result
+func expectResult(t *testing.T, s *Server, filename string, result string) {
+	t.Helper()
+	session, ok := waitSession(s, func(session SessionInfo) bool { return session.Filename == filename })
+	if !ok {
+		t.Fatalf("the transfer of %s has not completed", filename)
+	}
+	if session.Result != result {
+		t.Fatalf("the transfer of %s has ended with result %s (%s), expected %s",
+			filename, session.Result, session.Error, result)
+	}
+}
+
+// expectSomeResult waits for a transfer of the file ending with the result,
+// ignoring the other transfers of the same file such as those started by
+// duplicated requests
+func expectSomeResult(t *testing.T, s *Server, filename string, result string) SessionInfo {
+	t.Helper()
+	session, ok := waitSession(s, func(session SessionInfo) bool {
+		return session.Filename == filename && session.Result == result
+	})
+	if !ok {
+		t.Fatalf("no transfer of %s has ended with result %s", filename, result)
+	}
+	return session
+}
+
+func waitSession(s *Server, match func(SessionInfo) bool) (SessionInfo, bool) {
+	deadline := time.Now().Add(10 * tftptest.Timeout)
+	for time.Now().Before(deadline) {
+		for _, session := range s.CompletedSessions() {
+			if match(session) {
+				return session, true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return SessionInfo{}, false
+}
+
+// receiveBlocks acknowledges the DATA of the given sizes one after the
+// other and returns their content
+func receiveBlocks(p *tftptest.Peer, sizes ...int) []byte {
+	var received []byte
+	for i, size := range sizes {
+		data := p.ExpectData(uint16(i+1), size)
+		received = append(received, data.Data...)
+		p.Send(packets.NewAckPacket(uint16(i + 1)))
+	}
+	return received
+}
+
+// sendBlocks sends the blocks one after the other, expecting each of them
+// to be acknowledged
+func sendBlocks(p *tftptest.Peer, blocks ...[]byte) {
+	for i, block := range blocks {
+		p.Send(packets.NewDataPacket(uint16(i+1), block))
+		p.ExpectAck(uint16(i + 1))
+	}
+}
+
+// TestRead expects a file to end with a DATA shorter than the block size,
+// which is empty when the size of the file is a multiple of it
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		blocks []int
+	}{
+		{"zero-length", 0, []int{0}},
+		{"single block", 100, []int{100}},
+		{"multiple of the block size", 2 * packets.DefaultBlockSize, []int{512, 512, 0}},
+		{"several blocks", 1100, []int{512, 512, 76}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, serverAddr := startServer(t, nil)
+			expected := content(test.size)
+			writeFile(t, s.Config().Root, "file.bin", expected)
+
+			p := newPeer(t, serverAddr)
+			p.Send(packets.NewRRQPacket("file.bin", packets.Octet))
+			if received := receiveBlocks(p, test.blocks...); !bytes.Equal(received, expected) {
+				t.Errorf("received %d bytes, expected %d", len(received), len(expected))
+			}
+			expectResult(t, s, "file.bin", ResultSuccess)
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		blocks []int
+	}{
+		{"zero-length", 0, []int{0}},
+		{"multiple of the block size", 2 * packets.DefaultBlockSize, []int{512, 512, 0}},
+		{"several blocks", 700, []int{512, 188}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, serverAddr := startServer(t, nil)
+			expected := content(test.size)
+			var blocks [][]byte
+			offset := 0
+			for _, size := range test.blocks {
+				blocks = append(blocks, expected[offset:offset+size])
+				offset += size
+			}
+
+			p := newPeer(t, serverAddr)
+			p.Send(packets.NewWRQPacket("file.bin", packets.Octet))
+			p.ExpectAck(0)
+			sendBlocks(p, blocks...)
+			expectResult(t, s, "file.bin", ResultSuccess)
+			expectFile(t, s.Config().Root, "file.bin", expected)
+		})
+	}
+}
+
+// expectFile checks the content of a file of dir
+func expectFile(t *testing.T, dir string, name string, expected []byte) {
+	t.Helper()
+	written, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, expected) {
+		t.Errorf("%s holds %d bytes, expected %d", name, len(written), len(expected))
+	}
+}
+
+// TestLostFirstData expects the server to send the first DATA again when
+// it is not acknowledged
+func TestLostFirstData(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+	writeFile(t, s.Config().Root, "small.bin", content(100))
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewRRQPacket("small.bin", packets.Octet))
+	p.ExpectData(1, 100)
+	// The first DATA is considered lost: wait for the retransmission
+	p.ExpectData(1, 100)
+	p.Send(packets.NewAckPacket(1))
+	expectResult(t, s, "small.bin", ResultSuccess)
+}
+
+// TestLostFinalAck expects the server to dally after the final ACK of an
+// upload, acknowledging the last block again when it is sent again
+func TestLostFinalAck(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewWRQPacket("small.bin", packets.Octet))
+	p.ExpectAck(0)
+	p.Send(packets.NewDataPacket(1, content(100)))
+	p.ExpectAck(1)
+	// The final ACK is considered lost: send the last block again
+	p.Send(packets.NewDataPacket(1, content(100)))
+	p.ExpectAck(1)
+	expectResult(t, s, "small.bin", ResultSuccess)
+}
+
+// TestMissingFinalAck expects a download to fail when the last block is
+// never acknowledged, even if a stale ACK arrives
+func TestMissingFinalAck(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+	writeFile(t, s.Config().Root, "three.bin", content(1100))
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewRRQPacket("three.bin", packets.Octet))
+	receiveBlocks(p, 512, 512)
+	p.ExpectData(3, 76)
+	p.Send(packets.NewAckPacket(2))
+	expectResult(t, s, "three.bin", ResultFailure)
+}
+
+// TestDuplicateAck expects a duplicate ACK to be ignored, neither advancing
+// the transfer nor causing a retransmission, which would start the
+// Sorcerer's Apprentice syndrome
+func TestDuplicateAck(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+	writeFile(t, s.Config().Root, "three.bin", content(1100))
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewRRQPacket("three.bin", packets.Octet))
+	p.ExpectData(1, 512)
+	p.Send(packets.NewAckPacket(1))
+	p.ExpectData(2, 512)
+	p.Send(packets.NewAckPacket(1))
+	// The stale ACK is ignored: DATA 2 is only sent again after the timeout
+	sent := time.Now()
+	p.ExpectData(2, 512)
+	if time.Since(sent) < tftptest.Timeout/2 {
+		t.Fatal("DATA 2 has been sent again in answer to the duplicate ACK")
+	}
+	p.Send(packets.NewAckPacket(2))
+	p.ExpectData(3, 76)
+	p.Send(packets.NewAckPacket(3))
+	expectResult(t, s, "three.bin", ResultSuccess)
+}
+
+// TestErrorDuringRead expects the server to stop sending when the client
+// aborts the transfer with an ERROR
+func TestErrorDuringRead(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+	writeFile(t, s.Config().Root, "three.bin", content(1100))
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewRRQPacket("three.bin", packets.Octet))
+	p.ExpectData(1, 512)
+	p.Send(packets.NewErrorPacket(0, "aborted by the client"))
+	p.ExpectNothing()
+	expectResult(t, s, "three.bin", ResultFailure)
+}
+
+// TestErrorDuringWrite expects the server to discard a file whose upload
+// is aborted with an ERROR
+func TestErrorDuringWrite(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewWRQPacket("aborted.bin", packets.Octet))
+	p.ExpectAck(0)
+	p.Send(packets.NewDataPacket(1, content(512)))
+	p.ExpectAck(1)
+	p.Send(packets.NewErrorPacket(0, "aborted by the client"))
+	expectResult(t, s, "aborted.bin", ResultFailure)
+
+	if _, err := os.Stat(filepath.Join(s.Config().Root, "aborted.bin")); !os.IsNotExist(err) {
+		t.Error("the file of the aborted upload has been stored")
+	}
+}
+
+// TestUnknownTransferID expects a packet coming from another port than the
+// one of the session to be answered with ERROR 5, without disturbing the
+// transfer
+func TestUnknownTransferID(t *testing.T) {
+	s, serverAddr := startServer(t, nil)
+	expected := content(1100)
+	writeFile(t, s.Config().Root, "three.bin", expected)
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewRRQPacket("three.bin", packets.Octet))
+	received := p.ExpectData(1, 512).Data
+
+	intruder := newPeer(t, p.Remote)
+	intruder.Send(packets.NewAckPacket(1))
+	intruder.ExpectError(5)
+
+	for block, size := range []int{512, 76} {
+		p.Send(packets.NewAckPacket(uint16(block + 1)))
+		received = append(received, p.ExpectData(uint16(block+2), size).Data...)
+	}
+	p.Send(packets.NewAckPacket(3))
+	if !bytes.Equal(received, expected) {
+		t.Errorf("received %d bytes, expected %d", len(received), len(expected))
+	}
+	expectResult(t, s, "three.bin", ResultSuccess)
+}
+
+// dropOnce returns a Drop condition of the memory network losing the first
+// datagram holding a packet for which match returns true
+func dropOnce(match func(packet interface{}) bool) func(from *net.UDPAddr, to *net.UDPAddr, datagram []byte) bool {
+	dropped := false
+	return func(_ *net.UDPAddr, _ *net.UDPAddr, datagram []byte) bool {
+		if dropped {
+			return false
+		}
+		packet, err := packets.ParsePacket(datagram)
+		dropped = err == nil && match(packet)
+		return dropped
+	}
+}
+
+func isData(block uint16) func(packet interface{}) bool {
+	return func(packet interface{}) bool {
+		data, ok := packet.(packets.DataPacket)
+		return ok && data.BlockNumber == block
+	}
+}
+
+func isAck(block uint16) func(packet interface{}) bool {
+	return func(packet interface{}) bool {
+		ack, ok := packet.(packets.AckPacket)
+		return ok && ack.BlockNumber == block
+	}
+}
+
+// startMemoryServer is like startServer on a memory network losing or
+// duplicating datagrams under the conditions, and returns a client of it
+func startMemoryServer(t *testing.T, conditions transport.Conditions) (*Server, *net.UDPAddr, client.Client) {
+	t.Helper()
+	memory := transport.NewMemory(conditions, 1)
+	s, serverAddr := startServer(t, func(s *Server) { s.Network = memory })
+
+	c := newClient()
+	c.Network = memory
+	return s, serverAddr, c
+}
+
+// TestDownloadRecovery expects a download to recover from the datagrams
+// lost or duplicated by the network, sending a DATA again only when it has
+// not been acknowledged in time
+func TestDownloadRecovery(t *testing.T) {
+	tests := []struct {
+		name        string
+		conditions  transport.Conditions
+		retransmits int
+	}{
+		{"lost DATA", transport.Conditions{Drop: dropOnce(isData(2))}, 1},
+		{"lost ACK", transport.Conditions{Drop: dropOnce(isAck(2))}, 1},
+		{"lost final ACK", transport.Conditions{Drop: dropOnce(isAck(3))}, 1},
+		{"duplicated datagrams", transport.Conditions{Duplicate: 1}, 0},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			s, serverAddr, c := startMemoryServer(t, test.conditions)
+			expected := content(1500)
+			writeFile(t, s.Config().Root, "file.bin", expected)
+
+			var received bytes.Buffer
+			if err := c.ReceiveFile(serverAddr, "file.bin", &received); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received.Bytes(), expected) {
+				t.Errorf("received %d bytes, expected %d", received.Len(), len(expected))
+			}
+			// The transfers started by duplicated requests fail
+			if session := expectSomeResult(t, s, "file.bin", ResultSuccess); session.Retransmits != test.retransmits {
+				t.Errorf("the server has sent %d DATA again, expected %d", session.Retransmits, test.retransmits)
+			}
+		})
+	}
+}
+
+// TestCorruptedAck expects a download to go on after an ACK corrupted by
+// the network, which cannot be parsed and is dropped
+func TestCorruptedAck(t *testing.T) {
+	// The seed flips a bit of the opcode of the first corrupted datagram
+	memory := transport.NewMemory(transport.Conditions{}, 1)
+	s, serverAddr := startServer(t, func(s *Server) { s.Network = memory })
+	writeFile(t, s.Config().Root, "file.bin", content(100))
+
+	p := tftptest.NewPeer(t, memory, serverAddr)
+	p.Send(packets.NewRRQPacket("file.bin", packets.Octet))
+	p.ExpectData(1, 100)
+	memory.SetConditions(transport.Conditions{Corrupt: 1})
+	p.Send(packets.NewAckPacket(1))
+	memory.SetConditions(transport.Conditions{})
+	p.Send(packets.NewAckPacket(1))
+
+	expectResult(t, s, "file.bin", ResultSuccess)
+	if corrupted := memory.Stats().Corrupted; corrupted != 1 {
+		t.Errorf("the network has corrupted %d datagrams, expected 1", corrupted)
+	}
+}
+
+// TestUploadRecovery expects an upload to recover from the datagrams lost
+// or duplicated by the network, storing each block once
+func TestUploadRecovery(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions transport.Conditions
+	}{
+		{"lost DATA", transport.Conditions{Drop: dropOnce(isData(2))}},
+		{"lost ACK", transport.Conditions{Drop: dropOnce(isAck(2))}},
+		{"lost final ACK", transport.Conditions{Drop: dropOnce(isAck(3))}},
+		{"duplicated datagrams", transport.Conditions{Duplicate: 1}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			s, serverAddr, c := startMemoryServer(t, test.conditions)
+			expected := content(1500)
+
+			if err := c.SendFile(serverAddr, "file.bin", bytes.NewReader(expected)); err != nil {
+				t.Fatal(err)
+			}
+			expectSomeResult(t, s, "file.bin", ResultSuccess)
+			expectFile(t, s.Config().Root, "file.bin", expected)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+// configure returns a prepare function of startServer changing the
+// configuration of the server
+func configure(t *testing.T, change func(cfg *config.Config)) func(s *Server) {
+	return func(s *Server) {
+		cfg := *s.Config()
+		change(&cfg)
+		if err := s.SetConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestUploadLimits expects the uploads to be bounded by the maximum size of
+// an upload, the space left by the quota of the directory and the free
+// space of the disk, those beyond them being refused with ERROR 3 and not
+// stored. The client announces the size of the uploads
+func TestUploadLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  func(cfg *config.Config)
+		stored int
+		size   int
+		// refused is set when the upload is expected to be refused
+		refused bool
+		// disk is set when the limit depends on the free space of the disk
+		disk bool
+	}{
+		{
+			name:   "within the quota",
+			limit:  func(cfg *config.Config) { cfg.Quotas = []config.Quota{{Directory: ".", MaxSize: 1500}} },
+			stored: 1000,
+			size:   400,
+		},
+		{
+			name:    "beyond the quota",
+			limit:   func(cfg *config.Config) { cfg.Quotas = []config.Quota{{Directory: ".", MaxSize: 1500}} },
+			stored:  1000,
+			size:    700,
+			refused: true,
+		},
+		{
+			name:    "quota exhausted",
+			limit:   func(cfg *config.Config) { cfg.Quotas = []config.Quota{{Directory: ".", MaxSize: 1500}} },
+			stored:  1500,
+			size:    0,
+			refused: true,
+		},
+		{
+			name:    "beyond the maximum size",
+			limit:   func(cfg *config.Config) { cfg.Limits.MaxUploadSize = 1000 },
+			size:    2000,
+			refused: true,
+		},
+		{
+			name:    "not enough free space",
+			limit:   func(cfg *config.Config) { cfg.Limits.MinFreeSpace = 1 << 62 },
+			size:    10,
+			refused: true,
+			disk:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.disk && runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+				t.Skip("the free space of the disk cannot be measured on", runtime.GOOS)
+			}
+			s, serverAddr := startServer(t, configure(t, test.limit))
+			root := s.Config().Root
+			if test.stored > 0 {
+				writeFile(t, root, "existing.bin", content(test.stored))
+			}
+
+			c := newClient()
+			expected := content(test.size)
+			err := c.SendFile(serverAddr, "upload.bin", bytes.NewReader(expected))
+			if !test.refused {
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectResult(t, s, "upload.bin", ResultSuccess)
+				expectFile(t, root, "upload.bin", expected)
+				return
+			}
+			expectRemoteError(t, err, 3)
+			if _, err := os.Stat(filepath.Join(root, "upload.bin")); !os.IsNotExist(err) {
+				t.Error("the refused upload has been stored")
+			}
+		})
+	}
+}
+
+// TestUploadGrowingBeyondMaximum expects an upload which has not announced
+// its size to be aborted with ERROR 3 once it grows beyond the maximum size
+func TestUploadGrowingBeyondMaximum(t *testing.T) {
+	s, serverAddr := startServer(t, configure(t, func(cfg *config.Config) { cfg.Limits.MaxUploadSize = 1000 }))
+
+	p := newPeer(t, serverAddr)
+	p.Send(packets.NewWRQPacket("large.bin", packets.Octet))
+	p.ExpectAck(0)
+	p.Send(packets.NewDataPacket(1, content(512)))
+	p.ExpectAck(1)
+	p.Send(packets.NewDataPacket(2, content(512)))
+	p.ExpectError(3)
+	expectResult(t, s, "large.bin", ResultFailure)
+	if _, err := os.Stat(filepath.Join(s.Config().Root, "large.bin")); !os.IsNotExist(err) {
+		t.Error("the aborted upload has been stored")
+	}
+}
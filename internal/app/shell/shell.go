@@ -0,0 +1,328 @@
+package shell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/progress"
+	"github.com/mirkoschicchi/TFTP/internal/app/trace"
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+const (
+	prompt      = "tftp> "
+	defaultPort = "69"
+)
+
+// Shell is an interactive prompt driving a TFTP client
+type Shell struct {
+	client     client.Client
+	remoteAddr *net.UDPAddr
+	verbose    bool
+	tracing    bool
+	out        io.Writer
+}
+
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(s *Shell, args []string) error
+}
+
+// errQuit is returned by the quit command to stop the shell
+var errQuit = errors.New("quit")
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"connect", "connect <host> [port]", "set the remote TFTP server", (*Shell).connect},
+		{"get", "get <remote> [local]", "receive a file from the server", (*Shell).get},
+		{"put", "put <local> [remote]", "send a file to the server", (*Shell).put},
+		{"mode", "mode [netascii|octet]", "set the transfer mode", (*Shell).mode},
+		{"blksize", "blksize [size]", "set the block size proposed to the server", (*Shell).blksize},
+		{"timeout", "timeout [seconds]", "set the time to wait for the server", (*Shell).timeout},
+		{"verbose", "verbose", "toggle debug logging", (*Shell).toggleVerbose},
+		{"trace", "trace", "toggle packet tracing", (*Shell).toggleTrace},
+		{"status", "status", "show the current settings", (*Shell).status},
+		{"help", "help", "show this help", (*Shell).help},
+		{"quit", "quit", "exit the shell", (*Shell).quit},
+	}
+}
+
+// NewShell returns a shell using a new client with default settings,
+// verbose when the default logger logs debug messages
+func NewShell() *Shell {
+	s := &Shell{client: client.NewClient(), verbose: logger.Verbose(), out: os.Stdout}
+	if progress.IsTerminal(os.Stdout) {
+		s.client.OnProgress = progress.NewBar(os.Stdout).Update
+	}
+
+	return s
+}
+
+// Connect sets the address of the server used by the following transfers
+func (s *Shell) Connect(address string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, defaultPort)
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return errors.Wrapf(err, "cannot resolve address %s", address)
+	}
+	s.remoteAddr = remoteAddr
+
+	return nil
+}
+
+// Run reads commands from the standard input until quit is
+// entered or the input is closed. It returns once the last download
+// has stopped dallying
+func (s *Shell) Run() error {
+	defer s.client.Wait()
+	readLine := s.lineReader()
+	for {
+		line, err := readLine()
+		if err == io.EOF {
+			fmt.Fprintln(s.out)
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot read command")
+		}
+
+		err = s.execute(line)
+		if err == errQuit {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+		}
+	}
+}
+
+// lineReader returns a function reading one command at a time. On a terminal
+// the line can be edited and previous commands are kept in the history
+func (s *Shell) lineReader() func() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		readLine := func() (string, error) {
+			fmt.Fprint(s.out, prompt)
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}
+		return readLine
+	}
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, prompt)
+
+	// The terminal is in raw mode only while a line is being edited,
+	// so that the output of the transfers is printed as usual
+	readLine := func() (string, error) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return "", err
+		}
+		defer term.Restore(fd, state)
+
+		return terminal.ReadLine()
+	}
+	return readLine
+}
+
+func (s *Shell) execute(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	name := fields[0]
+	if name == "?" {
+		name = "help"
+	}
+	if name == "q" || name == "exit" {
+		name = "quit"
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(s, fields[1:])
+		}
+	}
+
+	return errors.Errorf("unknown command %q, type help for the list of commands", fields[0])
+}
+
+func (s *Shell) connect(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: connect <host> [port]")
+	}
+	address := args[0]
+	if len(args) == 2 {
+		address = net.JoinHostPort(args[0], args[1])
+	}
+
+	return s.Connect(address)
+}
+
+func (s *Shell) get(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: get <remote> [local]")
+	}
+	if s.remoteAddr == nil {
+		return errors.New("not connected, use connect first")
+	}
+	localPath := path.Base(args[0])
+	if len(args) == 2 {
+		localPath = args[1]
+	}
+
+	start := time.Now()
+	if err := s.client.RequestFileTo(s.remoteAddr, args[0], localPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "Received %s in %v\n", args[0], time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
+
+func (s *Shell) put(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: put <local> [remote]")
+	}
+	if s.remoteAddr == nil {
+		return errors.New("not connected, use connect first")
+	}
+	remotePath := filepath.Base(args[0])
+	if len(args) == 2 {
+		remotePath = args[1]
+	}
+
+	start := time.Now()
+	if err := s.client.WriteFileAs(s.remoteAddr, args[0], remotePath); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "Sent %s in %v\n", args[0], time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
+
+func (s *Shell) mode(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(s.out, "Using %s mode to transfer files\n", s.client.Mode)
+		return nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "netascii", "ascii":
+		s.client.Mode = packets.Netascii
+	case "octet", "binary":
+		s.client.Mode = packets.Octet
+	default:
+		return errors.Errorf("unknown mode %q", args[0])
+	}
+
+	return nil
+}
+
+func (s *Shell) blksize(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(s.out, "Block size is %d bytes\n", s.client.BlockSize)
+		return nil
+	}
+
+	size, err := strconv.Atoi(args[0])
+	if err != nil || size < 8 || size > 65464 {
+		return errors.Errorf("invalid block size %q, it must be between 8 and 65464", args[0])
+	}
+	s.client.BlockSize = size
+
+	return nil
+}
+
+func (s *Shell) timeout(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(s.out, "Timeout is %v\n", s.client.Timeout)
+		return nil
+	}
+
+	seconds, err := strconv.Atoi(args[0])
+	if err != nil || seconds <= 0 {
+		return errors.Errorf("invalid timeout %q", args[0])
+	}
+	s.client.Timeout = time.Duration(seconds) * time.Second
+
+	return nil
+}
+
+func (s *Shell) toggleVerbose(args []string) error {
+	s.verbose = !s.verbose
+	logger.SetVerbose(s.verbose)
+	fmt.Fprintf(s.out, "Verbose mode %s\n", onOff(s.verbose))
+
+	return nil
+}
+
+func (s *Shell) toggleTrace(args []string) error {
+	s.tracing = !s.tracing
+	if s.tracing {
+		s.client.Tracer = trace.NewTracer(s.out)
+	} else {
+		s.client.Tracer = nil
+	}
+	fmt.Fprintf(s.out, "Packet tracing %s\n", onOff(s.tracing))
+
+	return nil
+}
+
+func (s *Shell) status(args []string) error {
+	if s.remoteAddr != nil {
+		fmt.Fprintf(s.out, "Connected to %s\n", s.remoteAddr)
+	} else {
+		fmt.Fprintln(s.out, "Not connected")
+	}
+	fmt.Fprintf(s.out, "Mode: %s Verbose: %s Tracing: %s\n", s.client.Mode, onOff(s.verbose), onOff(s.tracing))
+	fmt.Fprintf(s.out, "Block size: %d bytes Timeout: %v\n", s.client.BlockSize, s.client.Timeout)
+
+	return nil
+}
+
+func (s *Shell) help(args []string) error {
+	for _, cmd := range commands {
+		fmt.Fprintf(s.out, "%-24s %s\n", cmd.usage, cmd.help)
+	}
+
+	return nil
+}
+
+func (s *Shell) quit(args []string) error {
+	return errQuit
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
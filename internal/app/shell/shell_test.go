@@ -0,0 +1,164 @@
+package shell
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/client"
+	"github.com/mirkoschicchi/TFTP/internal/app/config"
+	"github.com/mirkoschicchi/TFTP/internal/app/logger"
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/server"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+	"go.uber.org/zap"
+)
+
+func newTestShell() (*Shell, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &Shell{client: client.NewClient(), out: &out}, &out
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		line string
+		// err is part of the expected error, empty when none is expected
+		err string
+		// check returns whether the shell has the expected settings
+		check func(s *Shell) bool
+	}{
+		{line: "  "},
+		{line: "mode netascii", check: func(s *Shell) bool { return s.client.Mode == packets.Netascii }},
+		{line: "mode BINARY", check: func(s *Shell) bool { return s.client.Mode == packets.Octet }},
+		{line: "mode ebcdic", err: `unknown mode "ebcdic"`},
+		{line: "blksize 1024", check: func(s *Shell) bool { return s.client.BlockSize == 1024 }},
+		{line: "blksize 7", err: "invalid block size"},
+		{line: "blksize large", err: "invalid block size"},
+		{line: "timeout 3", check: func(s *Shell) bool { return s.client.Timeout == 3*time.Second }},
+		{line: "timeout 0", err: "invalid timeout"},
+		{line: "connect 127.0.0.1 1069", check: func(s *Shell) bool { return s.remoteAddr.String() == "127.0.0.1:1069" }},
+		{line: "connect 127.0.0.1", check: func(s *Shell) bool { return s.remoteAddr.String() == "127.0.0.1:69" }},
+		{line: "connect 127.0.0.1:1069", check: func(s *Shell) bool { return s.remoteAddr.String() == "127.0.0.1:1069" }},
+		{line: "connect", err: "usage: connect"},
+		{line: "get boot.bin", err: "not connected"},
+		{line: "get a b c", err: "usage: get"},
+		{line: "put", err: "usage: put"},
+		{line: "trace", check: func(s *Shell) bool { return s.tracing && s.client.Tracer != nil }},
+		{line: "frobnicate now", err: `unknown command "frobnicate"`},
+		{line: "quit", err: errQuit.Error()},
+		{line: "q", err: errQuit.Error()},
+		{line: "exit", err: errQuit.Error()},
+	}
+
+	for _, test := range tests {
+		s, _ := newTestShell()
+		err := s.execute(test.line)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: %v", test.line, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%q: got error %v, expected %q", test.line, err, test.err)
+		case test.check != nil && !test.check(s):
+			t.Errorf("%q has not been applied", test.line)
+		}
+	}
+}
+
+func TestHelp(t *testing.T) {
+	s, out := newTestShell()
+	if err := s.execute("?"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range commands {
+		if !strings.Contains(out.String(), cmd.usage) {
+			t.Errorf("the help does not describe %s", cmd.name)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s, out := newTestShell()
+	for _, line := range []string{"connect 127.0.0.1", "mode octet", "blksize 1024", "status"} {
+		if err := s.execute(line); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+	}
+	for _, expected := range []string{"Connected to 127.0.0.1:69", "Mode: octet", "Block size: 1024 bytes"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("the status %q does not show %q", out.String(), expected)
+		}
+	}
+}
+
+// TestNewShellVerbose expects a new shell to keep the configured level of
+// the default logger, being verbose when it logs debug messages
+func TestNewShellVerbose(t *testing.T) {
+	if err := logger.SetLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logger.SetLevel("info") })
+
+	s := NewShell()
+	if !s.verbose || !logger.Verbose() {
+		t.Errorf("the shell is verbose %v with debug messages logged %v, expected both", s.verbose, logger.Verbose())
+	}
+	s.out = ioutil.Discard
+	if err := s.execute("verbose"); err != nil {
+		t.Fatal(err)
+	}
+	if s.verbose || logger.Verbose() {
+		t.Error("toggling the verbose mode has kept the debug messages")
+	}
+}
+
+// TestTransfers uploads a file to a server through the shell and
+// downloads it back
+func TestTransfers(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69}
+	cfg := config.Default()
+	cfg.Listen = []string{serverAddr.String()}
+	cfg.Root = t.TempDir()
+	cfg.Timeouts.Default = time.Second
+	cfg.Logging.Level = "error"
+	srv := server.NewServer()
+	srv.Logger = logger.New(zap.NewNop())
+	srv.Network = network
+	if err := srv.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	s, out := newTestShell()
+	s.client.Network = network
+	s.client.Logger = logger.New(zap.NewNop())
+	dir := t.TempDir()
+	expected := []byte(strings.Repeat("shell transfer\n", 100))
+	local := filepath.Join(dir, "local.bin")
+	if err := ioutil.WriteFile(local, expected, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"connect " + serverAddr.String(), "mode octet", "put " + local, "get local.bin " + filepath.Join(dir, "copy.bin")} {
+		if err := s.execute(line); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+	}
+	received, err := ioutil.ReadFile(filepath.Join(dir, "copy.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, expected) {
+		t.Errorf("received %d bytes, expected %d", len(received), len(expected))
+	}
+	if !strings.Contains(out.String(), "Sent "+local) || !strings.Contains(out.String(), "Received local.bin") {
+		t.Errorf("the shell has printed %q", out.String())
+	}
+}
@@ -0,0 +1,152 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Inventory gives the variables of the clients, keyed by their IP or MAC
+// address. It is read from a CSV file having a header line, or from a JSON
+// file holding an array of objects. The "ip" and "mac" columns identify the
+// clients, every column being available to the templates. The file is read
+// again when it changes
+type Inventory struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	byIP    map[string]map[string]string
+	byMAC   map[string]map[string]string
+}
+
+// LoadInventory reads the inventory at path
+func LoadInventory(path string) (*Inventory, error) {
+	inventory := &Inventory{path: path}
+	if err := inventory.refresh(); err != nil {
+		return nil, err
+	}
+
+	return inventory, nil
+}
+
+// Lookup returns the variables of the client having the MAC address, if
+// given and known, or else of the client having the IP address
+func (inv *Inventory) Lookup(ip net.IP, mac string) (map[string]string, error) {
+	if err := inv.refresh(); err != nil {
+		return nil, err
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if vars, ok := inv.byMAC[mac]; ok && mac != "" {
+		return vars, nil
+	}
+	if ip != nil {
+		if vars, ok := inv.byIP[ip.String()]; ok {
+			return vars, nil
+		}
+	}
+	return map[string]string{}, nil
+}
+
+// refresh reads the file again if it has been modified since the last time
+func (inv *Inventory) refresh() error {
+	info, err := os.Stat(inv.path)
+	if err != nil {
+		return errors.Wrap(err, "cannot read the inventory")
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if info.ModTime().Equal(inv.modTime) && inv.byIP != nil {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(inv.path)
+	if err != nil {
+		return errors.Wrap(err, "cannot read the inventory")
+	}
+	var records []map[string]string
+	if strings.EqualFold(filepath.Ext(inv.path), ".json") {
+		records, err = parseJSON(content)
+	} else {
+		records, err = parseCSV(content)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse the inventory %s", inv.path)
+	}
+
+	inv.byIP = make(map[string]map[string]string)
+	inv.byMAC = make(map[string]map[string]string)
+	for _, record := range records {
+		if ip := net.ParseIP(record["ip"]); ip != nil {
+			inv.byIP[ip.String()] = record
+		}
+		if mac, err := net.ParseMAC(record["mac"]); err == nil {
+			inv.byMAC[mac.String()] = record
+		}
+	}
+	inv.modTime = info.ModTime()
+
+	return nil
+}
+
+func parseCSV(content []byte) ([]map[string]string, error) {
+	lines, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	header := lines[0]
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	var records []map[string]string
+	for _, line := range lines[1:] {
+		record := make(map[string]string, len(header))
+		for i, value := range line {
+			record[header[i]] = strings.TrimSpace(value)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func parseJSON(content []byte) ([]map[string]string, error) {
+	var objects []map[string]interface{}
+	if err := json.Unmarshal(content, &objects); err != nil {
+		return nil, err
+	}
+
+	var records []map[string]string
+	for _, object := range objects {
+		record := make(map[string]string, len(object))
+		for key, value := range object {
+			if s, ok := value.(string); ok {
+				record[key] = s
+				continue
+			}
+			encoded, _ := json.Marshal(value)
+			record[key] = string(encoded)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,116 @@
+package templates
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// Data is given to the templates when they are rendered
+type Data struct {
+	// IP is the address of the client
+	IP string
+	// Filename is the requested path, after the rewrite rules
+	Filename string
+	// RequestedFilename is the path as sent by the client
+	RequestedFilename string
+	// MAC is the MAC address found in the path, either rewritten or as
+	// requested, such as the 01-aa-bb-cc-dd-ee-ff of PXELINUX, in the
+	// aa:bb:cc:dd:ee:ff form. It is empty when the path holds none
+	MAC string
+	// Vars are the values of the inventory for the client
+	Vars map[string]string
+}
+
+// Renderer renders the templates with the data of the requests
+type Renderer struct {
+	// Suffix is appended to the requested path to find its template
+	Suffix    string
+	inventory *Inventory
+}
+
+// NewRenderer returns a renderer using the inventory at inventoryPath,
+// which is optional
+func NewRenderer(suffix string, inventoryPath string) (*Renderer, error) {
+	renderer := &Renderer{Suffix: suffix}
+	if inventoryPath != "" {
+		inventory, err := LoadInventory(inventoryPath)
+		if err != nil {
+			return nil, err
+		}
+		renderer.inventory = inventory
+	}
+
+	return renderer, nil
+}
+
+// NewData returns the data of a request, looking the client up in the inventory
+func (r *Renderer) NewData(ip net.IP, filename string, requestedFilename string) (Data, error) {
+	data := Data{
+		IP:                ip.String(),
+		Filename:          filename,
+		RequestedFilename: requestedFilename,
+		MAC:               ParseMAC(filename),
+		Vars:              map[string]string{},
+	}
+	if data.MAC == "" {
+		data.MAC = ParseMAC(requestedFilename)
+	}
+
+	if r.inventory != nil {
+		vars, err := r.inventory.Lookup(ip, data.MAC)
+		if err != nil {
+			return Data{}, err
+		}
+		data.Vars = vars
+	}
+
+	return data, nil
+}
+
+// Render renders the template file with the data. Referring to a variable
+// missing from the inventory is an error
+func (r *Renderer) Render(file string, data Data) ([]byte, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(path.Base(file)).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse template %s", path.Base(file))
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, errors.Wrapf(err, "cannot render template %s", path.Base(file))
+	}
+
+	return rendered.Bytes(), nil
+}
+
+// macPattern matches six or more hexadecimal pairs separated by dashes or
+// colons, PXELINUX prefixing the MAC address with its ARP type as in
+// 01-aa-bb-cc-dd-ee-ff
+var macPattern = regexp.MustCompile(`(?i)[0-9a-f]{2}(?:[-:][0-9a-f]{2}){5,}`)
+
+// ParseMAC returns the MAC address written in the last element of the
+// path, in the aa:bb:cc:dd:ee:ff form, or an empty string if there is none
+func ParseMAC(filename string) string {
+	match := macPattern.FindString(path.Base(filename))
+	if match == "" {
+		return ""
+	}
+
+	pairs := strings.FieldsFunc(match, func(r rune) bool { return r == '-' || r == ':' })
+	mac, err := net.ParseMAC(strings.Join(pairs[len(pairs)-6:], ":"))
+	if err != nil {
+		return ""
+	}
+	return mac.String()
+}
@@ -0,0 +1,121 @@
+package templates
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseMAC(t *testing.T) {
+	tests := []struct {
+		filename string
+		mac      string
+	}{
+		{"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", "aa:bb:cc:dd:ee:ff"},
+		{"hosts/AA:BB:CC:DD:EE:FF.cfg", "aa:bb:cc:dd:ee:ff"},
+		{"aa-bb-cc-dd-ee-ff/pxelinux.cfg/default", ""},
+		{"pxelinux.cfg/C0A80001", ""},
+		{"pxelinux.cfg/aa-bb-cc-dd-ee", ""},
+	}
+
+	for _, test := range tests {
+		if mac := ParseMAC(test.filename); mac != test.mac {
+			t.Errorf("ParseMAC(%q) = %q, expected %q", test.filename, mac, test.mac)
+		}
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInventoryLookup(t *testing.T) {
+	inventories := map[string]string{
+		"inventory.csv": "ip, mac, hostname\n10.0.0.1,,by-ip\n,AA-BB-CC-DD-EE-FF,by-mac\n",
+		"inventory.json": `[{"ip": "10.0.0.1", "hostname": "by-ip"},
+			{"mac": "aa:bb:cc:dd:ee:ff", "hostname": "by-mac"}]`,
+	}
+	tests := []struct {
+		ip       string
+		mac      string
+		hostname string
+	}{
+		{"10.0.0.1", "aa:bb:cc:dd:ee:ff", "by-mac"},
+		{"10.0.0.1", "11:22:33:44:55:66", "by-ip"},
+		{"10.0.0.1", "", "by-ip"},
+		{"10.0.0.2", "", ""},
+	}
+
+	for name, content := range inventories {
+		inventory, err := LoadInventory(writeFile(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, test := range tests {
+			vars, err := inventory.Lookup(net.ParseIP(test.ip), test.mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vars["hostname"] != test.hostname {
+				t.Errorf("%s: the client %s %s is %q, expected %q", name, test.ip, test.mac, vars["hostname"], test.hostname)
+			}
+		}
+	}
+}
+
+func TestInventoryReloaded(t *testing.T) {
+	path := writeFile(t, "inventory.csv", "ip,hostname\n10.0.0.1,old\n")
+	inventory, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("ip,hostname\n10.0.0.1,new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	vars, err := inventory.Lookup(net.ParseIP("10.0.0.1"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars["hostname"] != "new" {
+		t.Errorf("the inventory has not been read again: got %q", vars["hostname"])
+	}
+}
+
+func TestRender(t *testing.T) {
+	inventory := writeFile(t, "inventory.csv", "mac,hostname\naa-bb-cc-dd-ee-ff,node1\n")
+	renderer, err := NewRenderer(".tmpl", inventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := renderer.NewData(net.ParseIP("10.0.0.1"), "pxelinux.cfg/host", "pxelinux.cfg/01-aa-bb-cc-dd-ee-ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := writeFile(t, "host.tmpl", "{{.Vars.hostname}} {{.MAC}} {{.IP}} {{.Filename}}")
+	rendered, err := renderer.Render(file, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "node1 aa:bb:cc:dd:ee:ff 10.0.0.1 pxelinux.cfg/host"; string(rendered) != expected {
+		t.Errorf("rendered %q, expected %q", rendered, expected)
+	}
+
+	missing := writeFile(t, "missing.tmpl", "{{.Vars.rack}}")
+	if _, err := renderer.Render(missing, data); err == nil {
+		t.Error("a variable missing from the inventory has been rendered")
+	}
+}
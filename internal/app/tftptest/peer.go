@@ -0,0 +1,167 @@
+// Package tftptest provides a scripted TFTP peer reproducing the exchanges
+// described by the RFCs, for the tests of the packages transferring files.
+// It is only imported by tests
+package tftptest
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+)
+
+// Timeout is the retransmission timeout the tests give to the servers and
+// clients exchanging packets with a peer, kept short so that the tests
+// involving losses run quickly
+const Timeout = time.Second
+
+const (
+	// expectTimeout is how long a peer waits for an expected packet,
+	// which leaves room for a retransmission by the other end
+	expectTimeout = 3 * Timeout
+	// quietPeriod is how long a peer waits to check that nothing is sent
+	quietPeriod = Timeout + Timeout/2
+)
+
+// Peer is a scripted TFTP endpoint, sending and expecting the packets one
+// by one. Its methods stop the test when the exchange differs from the
+// script
+type Peer struct {
+	// Remote is where packets are sent. It starts as the address given to
+	// NewPeer and becomes the transfer ID of the other end once it replies
+	Remote *net.UDPAddr
+
+	conn net.PacketConn
+	t    testing.TB
+}
+
+// NewPeer opens the socket of a peer on a free port of the network, closed
+// when the test ends
+func NewPeer(t testing.TB, network transport.Network, remote *net.UDPAddr) *Peer {
+	t.Helper()
+	conn, err := network.ListenPacket("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot open the socket of the peer: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &Peer{Remote: remote, conn: conn, t: t}
+}
+
+func (p *Peer) Addr() *net.UDPAddr {
+	return transport.UDPAddr(p.conn.LocalAddr())
+}
+
+func (p *Peer) Send(packet packets.Packet) {
+	p.t.Helper()
+	if _, err := p.conn.WriteTo(packet.Bytes(), p.Remote); err != nil {
+		p.t.Fatalf("cannot send %v: %v", packet, err)
+	}
+}
+
+// receive waits for the next packet and directs the following ones to its sender
+func (p *Peer) receive(timeout time.Duration) (interface{}, error) {
+	p.t.Helper()
+	buf := make([]byte, 65536)
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := p.conn.ReadFrom(buf)
+	if err != nil {
+		return nil, err
+	}
+	p.Remote = transport.UDPAddr(addr)
+
+	packet, err := packets.ParsePacket(buf[:n])
+	if err != nil {
+		p.t.Fatalf("cannot parse the received packet: %v", err)
+	}
+	return packet, nil
+}
+
+// expect receives the next packet, failing with a message naming
+// what was expected if nothing arrives
+func (p *Peer) expect(expected string) interface{} {
+	p.t.Helper()
+	packet, err := p.receive(expectTimeout)
+	if err != nil {
+		p.t.Fatalf("expected %s: %v", expected, err)
+	}
+	return packet
+}
+
+func (p *Peer) ExpectData(block uint16, size int) packets.DataPacket {
+	p.t.Helper()
+	expected := packets.NewDataPacket(block, make([]byte, size))
+	packet := p.expect(expected.String())
+
+	data, ok := packet.(packets.DataPacket)
+	if !ok || data.BlockNumber != block || len(data.Data) != size {
+		p.t.Fatalf("expected %v, got %v", expected, packet)
+	}
+	return data
+}
+
+func (p *Peer) ExpectAck(block uint16) {
+	p.t.Helper()
+	expected := packets.NewAckPacket(block)
+	packet := p.expect(expected.String())
+
+	if ack, ok := packet.(packets.AckPacket); !ok || ack.BlockNumber != block {
+		p.t.Fatalf("expected %v, got %v", expected, packet)
+	}
+}
+
+func (p *Peer) ExpectOACK(options map[string]string) {
+	p.t.Helper()
+	expected := packets.NewOACKPacket(options)
+	packet := p.expect(expected.String())
+
+	if oack, ok := packet.(packets.OACKPacket); !ok || !reflect.DeepEqual(oack.Options, options) {
+		p.t.Fatalf("expected %v, got %v", expected, packet)
+	}
+}
+
+func (p *Peer) ExpectError(code uint16) {
+	p.t.Helper()
+	packet := p.expect("an ERROR packet")
+
+	if errorPacket, ok := packet.(packets.ErrorPacket); !ok || errorPacket.ErrorCode != code {
+		p.t.Fatalf("expected ERROR with code %d, got %v", code, packet)
+	}
+}
+
+func (p *Peer) ExpectRRQ() packets.RRQPacket {
+	p.t.Helper()
+	packet := p.expect("RRQ")
+
+	request, ok := packet.(packets.RRQPacket)
+	if !ok {
+		p.t.Fatalf("expected RRQ, got %v", packet)
+	}
+	return request
+}
+
+func (p *Peer) ExpectWRQ() packets.WRQPacket {
+	p.t.Helper()
+	packet := p.expect("WRQ")
+
+	request, ok := packet.(packets.WRQPacket)
+	if !ok {
+		p.t.Fatalf("expected WRQ, got %v", packet)
+	}
+	return request
+}
+
+// ExpectNothing checks that no packet arrives for a while
+func (p *Peer) ExpectNothing() {
+	p.t.Helper()
+	packet, err := p.receive(quietPeriod)
+	if err == nil {
+		p.t.Fatalf("expected no packet, got %v", packet)
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		p.t.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+package tftptest
+
+import (
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+	"github.com/mirkoschicchi/TFTP/internal/app/transport"
+)
+
+// TestPeer scripts an exchange between two peers, each one answering the
+// transfer ID of the other
+func TestPeer(t *testing.T) {
+	network := transport.NewMemory(transport.Conditions{}, 1)
+	listener := NewPeer(t, network, nil)
+	client := NewPeer(t, network, listener.Addr())
+	transfer := NewPeer(t, network, nil)
+
+	request := packets.NewRRQPacket("boot.bin", packets.Octet)
+	request.Options = map[string]string{packets.OptionBlksize: "1024"}
+	client.Send(request)
+	if received := listener.ExpectRRQ(); received.Filename != "boot.bin" {
+		t.Errorf("received a request for %q", received.Filename)
+	}
+
+	transfer.Remote = listener.Remote
+	transfer.Send(packets.NewOACKPacket(map[string]string{packets.OptionBlksize: "1024"}))
+	client.ExpectOACK(map[string]string{packets.OptionBlksize: "1024"})
+	if client.Remote.String() != transfer.Addr().String() {
+		t.Errorf("the client sends to %v, expected the transfer ID %v", client.Remote, transfer.Addr())
+	}
+
+	client.Send(packets.NewAckPacket(0))
+	transfer.ExpectAck(0)
+	transfer.Send(packets.NewDataPacket(1, []byte("boot")))
+	if data := client.ExpectData(1, 4); string(data.Data) != "boot" {
+		t.Errorf("received DATA holding %q", data.Data)
+	}
+	client.Send(packets.NewErrorPacket(0, "aborted"))
+	transfer.ExpectError(0)
+	transfer.ExpectNothing()
+}
@@ -0,0 +1,97 @@
+package trace
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	pcapMagic   = 0xa1b2c3d4
+	pcapSnapLen = 65535
+	// linkTypeRaw marks packets starting with the IP header
+	linkTypeRaw = 101
+
+	ipv4HeaderSize = 20
+	udpHeaderSize  = 8
+	protocolUDP    = 17
+)
+
+// pcapWriter writes datagrams in the pcap format, wrapping each of them
+// in synthesized IPv4 and UDP headers
+type pcapWriter struct {
+	w  io.Writer
+	id uint16
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, errors.Wrap(err, "cannot write pcap header")
+	}
+
+	return &pcapWriter{w: w}, nil
+}
+
+func (p *pcapWriter) write(timestamp time.Time, source *net.UDPAddr, destination *net.UDPAddr, payload []byte) error {
+	packet := make([]byte, ipv4HeaderSize+udpHeaderSize+len(payload))
+	p.id++
+
+	ip := packet[:ipv4HeaderSize]
+	ip[0] = 0x45 // version 4, header of 5 words
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(ip[4:], p.id)
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+	ip[8] = 64
+	ip[9] = protocolUDP
+	copy(ip[12:16], ipv4(source.IP))
+	copy(ip[16:20], ipv4(destination.IP))
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+
+	// The UDP checksum is optional over IPv4 and left to zero
+	udp := packet[ipv4HeaderSize : ipv4HeaderSize+udpHeaderSize]
+	binary.BigEndian.PutUint16(udp[0:], uint16(source.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(destination.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderSize+len(payload)))
+	copy(packet[ipv4HeaderSize+udpHeaderSize:], payload)
+
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(timestamp.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(timestamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	if _, err := p.w.Write(append(record, packet...)); err != nil {
+		return errors.Wrap(err, "cannot write pcap record")
+	}
+
+	return nil
+}
+
+// ipv4 returns the 4 bytes form of the address, or 0.0.0.0 when it is not IPv4
+func ipv4(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return net.IPv4zero.To4()
+}
+
+// checksum computes the Internet checksum of the IPv4 header
+func checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,100 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+const (
+	directionSent     = "sent"
+	directionReceived = "received"
+)
+
+// Tracer records every datagram sent or received, as decoded text lines
+// and optionally as a pcap capture. A nil *Tracer is valid and discards
+// everything, so that tracing is optional
+type Tracer struct {
+	mu   sync.Mutex
+	text io.Writer
+	pcap *pcapWriter
+}
+
+// NewTracer returns a tracer writing a line for every datagram to text,
+// which can be nil when only the pcap capture is wanted
+func NewTracer(text io.Writer) *Tracer {
+	return &Tracer{text: text}
+}
+
+// WritePcap makes the tracer write a capture in the pcap format to w as
+// well. The IP and UDP headers of the datagrams are synthesized, so that
+// the capture can be opened with Wireshark
+func (t *Tracer) WritePcap(w io.Writer) error {
+	pcap, err := newPcapWriter(w)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pcap = pcap
+	return nil
+}
+
+// Sent records a datagram sent from local to remote
+func (t *Tracer) Sent(local net.Addr, remote net.Addr, datagram []byte) {
+	t.record(directionSent, local, remote, datagram)
+}
+
+// Received records a datagram received on local from remote
+func (t *Tracer) Received(local net.Addr, remote net.Addr, datagram []byte) {
+	t.record(directionReceived, remote, local, datagram)
+}
+
+func (t *Tracer) record(direction string, source net.Addr, destination net.Addr, datagram []byte) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.text != nil {
+		fmt.Fprintf(t.text, "%s %-8s %s > %s %s\n", now.Format("15:04:05.000000"), direction,
+			source, destination, describe(datagram))
+	}
+	if t.pcap != nil {
+		t.pcap.write(now, udpAddr(source, destination), udpAddr(destination, source), datagram)
+	}
+}
+
+// describe returns the decoded fields of a datagram
+func describe(datagram []byte) string {
+	packet, err := packets.ParsePacket(datagram)
+	if err != nil {
+		return fmt.Sprintf("malformed packet of %d bytes: %v", len(datagram), err)
+	}
+
+	return fmt.Sprintf("%v (%d bytes)", packet, len(datagram))
+}
+
+// udpAddr returns the address of one end of a datagram. Sockets bound to
+// every interface report an unspecified address, which is replaced by the
+// loopback one when the peer is local, so that the conversation is whole
+func udpAddr(addr net.Addr, peer net.Addr) *net.UDPAddr {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || udpAddr == nil {
+		return &net.UDPAddr{IP: net.IPv4zero}
+	}
+	if peerAddr, ok := peer.(*net.UDPAddr); ok && peerAddr != nil &&
+		(udpAddr.IP == nil || udpAddr.IP.IsUnspecified()) && peerAddr.IP.IsLoopback() {
+		return &net.UDPAddr{IP: peerAddr.IP, Port: udpAddr.Port}
+	}
+	return udpAddr
+}
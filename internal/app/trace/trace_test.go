@@ -0,0 +1,108 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mirkoschicchi/TFTP/internal/app/packets"
+)
+
+// TestPcap expects the datagrams to be written as IPv4 packets with valid
+// headers, an unspecified local address standing for the loopback one
+func TestPcap(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4zero, Port: 69}
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	rrq := packets.NewRRQPacket("boot.bin", packets.Octet).Bytes()
+	ack := packets.NewAckPacket(1).Bytes()
+
+	var capture bytes.Buffer
+	tracer := NewTracer(nil)
+	if err := tracer.WritePcap(&capture); err != nil {
+		t.Fatal(err)
+	}
+	tracer.Received(local, remote, rrq)
+	tracer.Sent(local, remote, ack)
+
+	header := capture.Next(24)
+	if magic := binary.LittleEndian.Uint32(header); magic != pcapMagic {
+		t.Fatalf("the capture starts with %#x", magic)
+	}
+	if linkType := binary.LittleEndian.Uint32(header[20:]); linkType != linkTypeRaw {
+		t.Errorf("the link type is %d, expected raw IP", linkType)
+	}
+
+	tests := []struct {
+		source      string
+		destination string
+		payload     []byte
+	}{
+		{"127.0.0.1:5000", "127.0.0.1:69", rrq},
+		{"127.0.0.1:69", "127.0.0.1:5000", ack},
+	}
+	for i, test := range tests {
+		record := capture.Next(16)
+		if len(record) < 16 {
+			t.Fatalf("the record of packet %d is missing", i+1)
+		}
+		size := int(binary.LittleEndian.Uint32(record[8:]))
+		if captured := int(binary.LittleEndian.Uint32(record[12:])); captured != size {
+			t.Errorf("packet %d: %d bytes captured out of %d", i+1, captured, size)
+		}
+		packet := capture.Next(size)
+		if len(packet) != ipv4HeaderSize+udpHeaderSize+len(test.payload) {
+			t.Fatalf("packet %d has %d bytes", i+1, len(packet))
+		}
+
+		ip, udp := packet[:ipv4HeaderSize], packet[ipv4HeaderSize:ipv4HeaderSize+udpHeaderSize]
+		if ip[0] != 0x45 || ip[9] != protocolUDP || int(binary.BigEndian.Uint16(ip[2:])) != len(packet) {
+			t.Errorf("packet %d has the IP header % x", i+1, ip)
+		}
+		if checksum(ip) != 0 {
+			t.Errorf("packet %d has an invalid IP checksum", i+1)
+		}
+		source := &net.UDPAddr{IP: net.IP(ip[12:16]), Port: int(binary.BigEndian.Uint16(udp[0:]))}
+		destination := &net.UDPAddr{IP: net.IP(ip[16:20]), Port: int(binary.BigEndian.Uint16(udp[2:]))}
+		if source.String() != test.source || destination.String() != test.destination {
+			t.Errorf("packet %d goes from %v to %v, expected %s to %s", i+1, source, destination, test.source, test.destination)
+		}
+		if length := int(binary.BigEndian.Uint16(udp[4:])); length != udpHeaderSize+len(test.payload) {
+			t.Errorf("packet %d has the UDP length %d", i+1, length)
+		}
+		if !bytes.Equal(packet[ipv4HeaderSize+udpHeaderSize:], test.payload) {
+			t.Errorf("packet %d carries % x, expected % x", i+1, packet[ipv4HeaderSize+udpHeaderSize:], test.payload)
+		}
+	}
+	if capture.Len() != 0 {
+		t.Errorf("%d bytes follow the packets", capture.Len())
+	}
+}
+
+// TestText expects a line describing each datagram
+func TestText(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69}
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	var text bytes.Buffer
+	tracer := NewTracer(&text)
+	tracer.Sent(local, remote, packets.NewAckPacket(1).Bytes())
+	tracer.Received(local, remote, []byte{0, 9})
+
+	lines := strings.Split(strings.TrimSuffix(text.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("traced %q", text.String())
+	}
+	if !strings.Contains(lines[0], "sent     127.0.0.1:69 > 127.0.0.1:5000") || !strings.Contains(lines[0], "(4 bytes)") {
+		t.Errorf("traced %q for the ACK", lines[0])
+	}
+	if !strings.Contains(lines[1], "received 127.0.0.1:5000 > 127.0.0.1:69 malformed packet of 2 bytes") {
+		t.Errorf("traced %q for the malformed datagram", lines[1])
+	}
+}
+
+// TestNilTracer expects a nil tracer to discard the datagrams
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	tracer.Sent(&net.UDPAddr{}, &net.UDPAddr{}, []byte{0, 4, 0, 1})
+}
@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// demuxQueueSize is the number of datagrams a peer connection can hold
+// before the following ones are dropped
+const demuxQueueSize = 64
+
+// Demux shares a socket between several peers. The datagrams of a peer
+// having a connection opened with Conn are delivered to that connection,
+// while ReadFrom returns the datagrams of the other peers. Connections
+// only receive datagrams while ReadFrom is being called
+type Demux struct {
+	net.PacketConn
+
+	mu    sync.Mutex
+	peers map[string]*peerConn
+}
+
+func NewDemux(conn net.PacketConn) *Demux {
+	return &Demux{PacketConn: conn, peers: make(map[string]*peerConn)}
+}
+
+// ReadFrom returns the next datagram coming from a peer without connection
+func (d *Demux) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := d.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		from := UDPAddr(addr)
+		d.mu.Lock()
+		peer, ok := d.peers[from.String()]
+		d.mu.Unlock()
+		if !ok {
+			return n, addr, nil
+		}
+
+		data := make([]byte, n)
+		copy(data, p[:n])
+		peer.inbox.deliver(datagram{from: from, data: data})
+	}
+}
+
+// Conn returns a connection exchanging datagrams with the peer only,
+// through the shared socket. It fails if the peer already has one
+func (d *Demux) Conn(peer *net.UDPAddr) (net.PacketConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := peer.String()
+	if _, ok := d.peers[key]; ok {
+		return nil, errors.Errorf("%s already has a connection", key)
+	}
+	conn := &peerConn{demux: d, peer: peer, inbox: newInbox(demuxQueueSize)}
+	d.peers[key] = conn
+
+	return conn, nil
+}
+
+func (d *Demux) remove(conn *peerConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.peers[conn.peer.String()] == conn {
+		delete(d.peers, conn.peer.String())
+	}
+}
+
+// peerConn is the connection of a peer of a Demux
+type peerConn struct {
+	demux *Demux
+	peer  *net.UDPAddr
+	inbox *inbox
+}
+
+func (c *peerConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, from, err := c.inbox.read(p)
+	if err != nil {
+		return 0, nil, c.error("read", err)
+	}
+	return n, from, nil
+}
+
+// WriteTo sends the datagram through the shared socket
+func (c *peerConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.inbox.isClosed() {
+		return 0, c.error("write", net.ErrClosed)
+	}
+	return c.demux.WriteTo(p, addr)
+}
+
+// Close stops the delivery of the datagrams of the peer, leaving the
+// shared socket open
+func (c *peerConn) Close() error {
+	if !c.inbox.close() {
+		return c.error("close", net.ErrClosed)
+	}
+	c.demux.remove(c)
+	return nil
+}
+
+func (c *peerConn) LocalAddr() net.Addr {
+	return c.demux.LocalAddr()
+}
+
+func (c *peerConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *peerConn) SetReadDeadline(t time.Time) error {
+	c.inbox.setReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes go through the shared socket
+func (c *peerConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *peerConn) error(op string, err error) error {
+	return &net.OpError{Op: op, Net: "demux", Addr: c.demux.LocalAddr(), Err: err}
+}
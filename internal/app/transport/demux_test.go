@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDemux(t *testing.T) {
+	memory := NewMemory(Conditions{}, 1)
+	shared := listen(t, memory)
+	demux := NewDemux(shared)
+	connected, other := listen(t, memory), listen(t, memory)
+
+	conn, err := demux.Conn(UDPAddr(connected.LocalAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := demux.Conn(UDPAddr(connected.LocalAddr())); err == nil {
+		t.Error("a second connection has been opened for the same peer")
+	}
+
+	sendAll(t, connected, shared, "session")
+	sendAll(t, other, shared, "request")
+	if received := receiveAll(t, demux); !reflect.DeepEqual(received, []string{"request"}) {
+		t.Errorf("the shared socket has received %q", received)
+	}
+	if received := receiveAll(t, conn); !reflect.DeepEqual(received, []string{"session"}) {
+		t.Errorf("the connection has received %q", received)
+	}
+
+	// The answers go through the shared socket
+	if _, err := conn.WriteTo([]byte("answer"), connected.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	from := make([]byte, 64)
+	n, addr, err := connected.ReadFrom(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(from[:n]) != "answer" || addr.String() != shared.LocalAddr().String() {
+		t.Errorf("received %q from %v", from[:n], addr)
+	}
+
+	// Once closed, the datagrams of the peer are returned by the shared socket
+	conn.Close()
+	sendAll(t, connected, shared, "new request")
+	if received := receiveAll(t, demux); !reflect.DeepEqual(received, []string{"new request"}) {
+		t.Errorf("the shared socket has received %q", received)
+	}
+	if _, err := conn.WriteTo([]byte("late"), connected.LocalAddr()); err == nil {
+		t.Error("a closed connection has sent a datagram")
+	}
+}
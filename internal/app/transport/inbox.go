@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type datagram struct {
+	from *net.UDPAddr
+	data []byte
+}
+
+// inbox holds the datagrams delivered to a socket living in the process
+// until they are read, honoring the read deadline of the socket
+type inbox struct {
+	queue     chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu              sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+}
+
+func newInbox(size int) *inbox {
+	return &inbox{
+		queue:           make(chan datagram, size),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// deliver queues a datagram, dropping it when the inbox is full
+func (b *inbox) deliver(d datagram) bool {
+	select {
+	case b.queue <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+// read waits for the next datagram until the read deadline. It fails with
+// os.ErrDeadlineExceeded or net.ErrClosed, to be wrapped by the socket
+func (b *inbox) read(p []byte) (int, net.Addr, error) {
+	for {
+		b.mu.Lock()
+		deadline := b.readDeadline
+		deadlineChanged := b.deadlineChanged
+		b.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		var n int
+		var from net.Addr
+		var err error
+		select {
+		case d := <-b.queue:
+			n, from = copy(p, d.data), d.from
+		case <-b.closed:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-deadlineChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return n, from, err
+	}
+}
+
+// setReadDeadline wakes up a pending read, which waits again
+// with the new deadline
+func (b *inbox) setReadDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.readDeadline = t
+	close(b.deadlineChanged)
+	b.deadlineChanged = make(chan struct{})
+}
+
+// close wakes up the pending reads, and reports whether it was still open
+func (b *inbox) close() bool {
+	closed := false
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		closed = true
+	})
+	return closed
+}
+
+func (b *inbox) isClosed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,334 @@
+package transport
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// memoryQueueSize is the number of datagrams a socket can hold before
+	// the following ones are dropped, like a full UDP receive buffer
+	memoryQueueSize = 1024
+	firstMemoryPort = 49152
+)
+
+// Conditions describes how a memory network alters the datagrams.
+// Probabilities are between 0 and 1
+type Conditions struct {
+	// Loss is the probability of a datagram being dropped
+	Loss float64
+	// Duplicate is the probability of a datagram being delivered twice
+	Duplicate float64
+	// Reorder is the probability of a datagram being held back until the
+	// next one to the same destination has been delivered. A datagram held
+	// back and never followed by another one is lost
+	Reorder float64
+	// Corrupt is the probability of a bit of the datagram being flipped
+	Corrupt float64
+	// Delay is added to the delivery of every datagram
+	Delay time.Duration
+	// Jitter is the upper bound of a random delay added to Delay
+	Jitter time.Duration
+	// Drop, when set, drops the datagrams for which it returns true. It
+	// allows scripting the losses instead of relying on probabilities.
+	// It is called with the network locked and must not use it
+	Drop func(from *net.UDPAddr, to *net.UDPAddr, datagram []byte) bool
+}
+
+// Stats counts what happened to the datagrams sent on a memory network
+type Stats struct {
+	Sent       int
+	Delivered  int
+	Dropped    int
+	Duplicated int
+	Reordered  int
+	Corrupted  int
+}
+
+// Memory is a network living in the process. Every host of the network is
+// 127.0.0.1, and the random decisions taken to apply the conditions come
+// from a seeded source, so that the same seed and the same sequence of
+// datagrams give the same result. The datagrams sent to a multicast group
+// are delivered to each of its members under the conditions
+type Memory struct {
+	mu         sync.Mutex
+	conditions Conditions
+	random     *rand.Rand
+	conns      map[int]*memoryConn
+	groups     map[string][]*memoryConn
+	held       map[*memoryConn][]datagram
+	nextPort   int
+	stats      Stats
+}
+
+func NewMemory(conditions Conditions, seed int64) *Memory {
+	return &Memory{
+		conditions: conditions,
+		random:     rand.New(rand.NewSource(seed)),
+		conns:      make(map[int]*memoryConn),
+		groups:     make(map[string][]*memoryConn),
+		held:       make(map[*memoryConn][]datagram),
+		nextPort:   firstMemoryPort,
+	}
+}
+
+// SetConditions replaces the conditions applied to the next datagrams
+func (m *Memory) SetConditions(conditions Conditions) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.conditions = conditions
+}
+
+func (m *Memory) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.stats
+}
+
+func (m *Memory) ListenPacket(address string) (net.PacketConn, error) {
+	_, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid address %q", address)
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.Errorf("invalid port in address %q", address)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if port == 0 {
+		port = m.freePort()
+		if port == 0 {
+			return nil, errors.New("no free port left on the memory network")
+		}
+	} else if _, ok := m.conns[port]; ok {
+		return nil, errors.Errorf("address %s is already in use", address)
+	}
+
+	conn := &memoryConn{
+		network: m,
+		addr:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		inbox:   newInbox(memoryQueueSize),
+	}
+	m.conns[port] = conn
+
+	return conn, nil
+}
+
+// ListenMulticast opens a socket receiving the datagrams sent to the group,
+// which cannot be reached by other addresses
+func (m *Memory) ListenMulticast(group *net.UDPAddr) (net.PacketConn, error) {
+	if !group.IP.IsMulticast() {
+		return nil, errors.Errorf("%s is not a multicast group", group)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conn := &memoryConn{
+		network: m,
+		addr:    &net.UDPAddr{IP: group.IP, Port: group.Port},
+		inbox:   newInbox(memoryQueueSize),
+		member:  true,
+	}
+	m.groups[group.String()] = append(m.groups[group.String()], conn)
+
+	return conn, nil
+}
+
+func (m *Memory) freePort() int {
+	for i := 0; i < 65536-firstMemoryPort; i++ {
+		port := m.nextPort
+		m.nextPort++
+		if m.nextPort > 65535 {
+			m.nextPort = firstMemoryPort
+		}
+		if _, ok := m.conns[port]; !ok {
+			return port
+		}
+	}
+	return 0
+}
+
+func (m *Memory) chance(probability float64) bool {
+	return probability > 0 && m.random.Float64() < probability
+}
+
+// send delivers a datagram to its destination, or to every member of the
+// group it is sent to
+func (m *Memory) send(from *net.UDPAddr, to *net.UDPAddr, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if to.IP.IsMulticast() {
+		for _, member := range m.groups[to.String()] {
+			copied := make([]byte, len(data))
+			copy(copied, data)
+			m.transmit(from, to, member, copied)
+		}
+		return
+	}
+	m.transmit(from, to, m.conns[to.Port], data)
+}
+
+// transmit applies the conditions to a datagram and schedules its delivery
+// to conn, which is nil when nothing listens at the destination. It must be
+// called with the lock held
+func (m *Memory) transmit(from *net.UDPAddr, to *net.UDPAddr, conn *memoryConn, data []byte) {
+	m.stats.Sent++
+	conditions := m.conditions
+	if conditions.Drop != nil && conditions.Drop(from, to, data) || m.chance(conditions.Loss) {
+		m.stats.Dropped++
+		return
+	}
+
+	copies := 1
+	if m.chance(conditions.Duplicate) {
+		copies = 2
+		m.stats.Duplicated++
+	}
+	if m.chance(conditions.Corrupt) && len(data) > 0 {
+		bit := m.random.Intn(len(data) * 8)
+		data[bit/8] ^= 1 << uint(bit%8)
+		m.stats.Corrupted++
+	}
+
+	if m.chance(conditions.Reorder) {
+		m.held[conn] = append(m.held[conn], datagram{from: from, data: data})
+		m.stats.Reordered++
+		return
+	}
+
+	outgoing := make([]datagram, 0, copies+len(m.held[conn]))
+	for i := 0; i < copies; i++ {
+		outgoing = append(outgoing, datagram{from: from, data: data})
+	}
+	outgoing = append(outgoing, m.held[conn]...)
+	delete(m.held, conn)
+
+	delay := conditions.Delay
+	if conditions.Jitter > 0 {
+		delay += time.Duration(m.random.Int63n(int64(conditions.Jitter)))
+	}
+	if delay <= 0 {
+		for _, d := range outgoing {
+			m.deliver(conn, d)
+		}
+		return
+	}
+	time.AfterFunc(delay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, d := range outgoing {
+			m.deliver(conn, d)
+		}
+	})
+}
+
+// deliver queues the datagram on the destination socket, unless there is
+// none or it has been closed. It must be called with the lock held
+func (m *Memory) deliver(conn *memoryConn, d datagram) {
+	if conn == nil || conn.inbox.isClosed() {
+		m.stats.Dropped++
+		return
+	}
+	if conn.inbox.deliver(d) {
+		m.stats.Delivered++
+	} else {
+		m.stats.Dropped++
+	}
+}
+
+func (m *Memory) remove(conn *memoryConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.held, conn)
+	if conn.member {
+		key := conn.addr.String()
+		members := m.groups[key]
+		for i, member := range members {
+			if member == conn {
+				m.groups[key] = append(members[:i:i], members[i+1:]...)
+				break
+			}
+		}
+		if len(m.groups[key]) == 0 {
+			delete(m.groups, key)
+		}
+		return
+	}
+	if m.conns[conn.addr.Port] == conn {
+		delete(m.conns, conn.addr.Port)
+	}
+}
+
+// memoryConn is a socket of a memory network
+type memoryConn struct {
+	network *Memory
+	addr    *net.UDPAddr
+	inbox   *inbox
+	// member is set for the sockets of a multicast group
+	member bool
+}
+
+func (c *memoryConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, from, err := c.inbox.read(p)
+	if err != nil {
+		return 0, nil, c.error("read", err)
+	}
+	return n, from, nil
+}
+
+func (c *memoryConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.inbox.isClosed() {
+		return 0, c.error("write", net.ErrClosed)
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+	c.network.send(c.addr, UDPAddr(addr), data)
+
+	return len(p), nil
+}
+
+func (c *memoryConn) Close() error {
+	if !c.inbox.close() {
+		return c.error("close", net.ErrClosed)
+	}
+	c.network.remove(c)
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline wakes up a pending read, which waits again
+// with the new deadline
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.inbox.setReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes never block
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memoryConn) error(op string, err error) error {
+	return &net.OpError{Op: op, Net: "memory", Addr: c.addr, Err: err}
+}
@@ -0,0 +1,172 @@
+package transport
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, network Network) net.PacketConn {
+	t.Helper()
+	conn, err := network.ListenPacket("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendAll(t *testing.T, from net.PacketConn, to net.PacketConn, datagrams ...string) {
+	t.Helper()
+	for _, d := range datagrams {
+		if _, err := from.WriteTo([]byte(d), to.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// receiveAll returns the datagrams queued on conn
+func receiveAll(t *testing.T, conn net.PacketConn) []string {
+	t.Helper()
+	var received []string
+	buf := make([]byte, 64)
+	for {
+		conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return received
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, string(buf[:n]))
+	}
+}
+
+func TestMemoryConditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions Conditions
+		received   []string
+	}{
+		{"none", Conditions{}, []string{"1", "2", "3"}},
+		{"loss", Conditions{Loss: 1}, nil},
+		{"duplicate", Conditions{Duplicate: 1}, []string{"1", "1", "2", "2", "3", "3"}},
+		{"held back forever", Conditions{Reorder: 1}, nil},
+		{"drop", Conditions{Drop: func(_ *net.UDPAddr, _ *net.UDPAddr, datagram []byte) bool {
+			return string(datagram) == "2"
+		}}, []string{"1", "3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memory := NewMemory(test.conditions, 1)
+			from, to := listen(t, memory), listen(t, memory)
+
+			sendAll(t, from, to, "1", "2", "3")
+			if received := receiveAll(t, to); !reflect.DeepEqual(received, test.received) {
+				t.Errorf("received %q, expected %q", received, test.received)
+			}
+		})
+	}
+}
+
+func TestMemoryReorder(t *testing.T) {
+	memory := NewMemory(Conditions{Reorder: 1}, 1)
+	from, to := listen(t, memory), listen(t, memory)
+
+	sendAll(t, from, to, "1")
+	memory.SetConditions(Conditions{})
+	sendAll(t, from, to, "2")
+	if received := receiveAll(t, to); !reflect.DeepEqual(received, []string{"2", "1"}) {
+		t.Errorf("received %q, expected the first datagram after the second one", received)
+	}
+}
+
+func TestMemoryDelay(t *testing.T) {
+	memory := NewMemory(Conditions{Delay: 50 * time.Millisecond}, 1)
+	from, to := listen(t, memory), listen(t, memory)
+
+	start := time.Now()
+	sendAll(t, from, to, "1")
+	to.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := to.ReadFrom(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("the datagram has been delivered after %v", elapsed)
+	}
+}
+
+// TestMemorySeed expects the same seed to alter the same datagrams
+func TestMemorySeed(t *testing.T) {
+	var outcomes [2][]string
+	for i := range outcomes {
+		memory := NewMemory(Conditions{Loss: 0.3, Duplicate: 0.3}, 42)
+		from, to := listen(t, memory), listen(t, memory)
+		for j := 0; j < 50; j++ {
+			sendAll(t, from, to, string(rune('a'+j%26)))
+		}
+		outcomes[i] = receiveAll(t, to)
+	}
+
+	if !reflect.DeepEqual(outcomes[0], outcomes[1]) {
+		t.Errorf("the same seed has given %q and %q", outcomes[0], outcomes[1])
+	}
+	if len(outcomes[0]) == 50 {
+		t.Error("no datagram has been lost or duplicated")
+	}
+}
+
+func TestMemoryClosedSocket(t *testing.T) {
+	memory := NewMemory(Conditions{}, 1)
+	from := listen(t, memory)
+	to, err := memory.ListenPacket("127.0.0.1:69")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memory.ListenPacket("127.0.0.1:69"); err == nil {
+		t.Error("the port of an open socket has been bound again")
+	}
+
+	to.Close()
+	sendAll(t, from, to, "1")
+	if stats := memory.Stats(); stats.Sent != 1 || stats.Dropped != 1 {
+		t.Errorf("got %+v, expected the datagram to a closed socket to be dropped", stats)
+	}
+	if _, _, err := to.ReadFrom(make([]byte, 64)); err == nil {
+		t.Error("a closed socket has been read")
+	}
+}
+
+func TestMemoryMulticast(t *testing.T) {
+	memory := NewMemory(Conditions{}, 1)
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 42, 69), Port: 1758}
+	var members []net.PacketConn
+	for i := 0; i < 2; i++ {
+		member, err := memory.ListenMulticast(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer member.Close()
+		members = append(members, member)
+	}
+	sender, other := listen(t, memory), listen(t, memory)
+
+	if _, err := sender.WriteTo([]byte("block"), group); err != nil {
+		t.Fatal(err)
+	}
+	for i, member := range members {
+		if received := receiveAll(t, member); !reflect.DeepEqual(received, []string{"block"}) {
+			t.Errorf("member %d has received %q", i, received)
+		}
+	}
+	if received := receiveAll(t, other); len(received) > 0 {
+		t.Errorf("a socket outside the group has received %q", received)
+	}
+
+	if _, err := memory.ListenMulticast(sender.LocalAddr().(*net.UDPAddr)); err == nil {
+		t.Error("a unicast address has been joined as a group")
+	}
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"net"
+)
+
+// Network opens the datagram sockets used by servers and clients, so that
+// the transfers can run over real UDP sockets or over a simulated network
+type Network interface {
+	// ListenPacket opens a socket bound to the given host:port address.
+	// An empty host binds every interface and a zero port picks a free one
+	ListenPacket(address string) (net.PacketConn, error)
+	// ListenMulticast opens a socket receiving the datagrams sent to the
+	// multicast group, which are the only ones it receives
+	ListenMulticast(group *net.UDPAddr) (net.PacketConn, error)
+}
+
+// UDP is the network of the operating system
+type UDP struct{}
+
+func (UDP) ListenPacket(address string) (net.PacketConn, error) {
+	return net.ListenPacket("udp4", address)
+}
+
+// ListenMulticast joins the group on the interface chosen by the system.
+// Several sockets of the host can join the same group
+func (UDP) ListenMulticast(group *net.UDPAddr) (net.PacketConn, error) {
+	return net.ListenMulticastUDP("udp4", nil, group)
+}
+
+// UDPAddr converts the address of a datagram to a UDP address
+func UDPAddr(addr net.Addr) *net.UDPAddr {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr.String())
+	if err != nil {
+		return &net.UDPAddr{IP: net.IPv4zero}
+	}
+	return udpAddr
+}
+
+// SameAddr reports whether two UDP addresses are equal
+func SameAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"math/rand"
 	"time"
 )
@@ -12,3 +13,9 @@ func GetRandomTID() int {
 	// The range of available UDP ports is 4096-65535
 	return rand.Intn(65535-4096) + 4096
 }
+
+// NewSessionID returns a random identifier used to
+// correlate the log messages of a transfer
+func NewSessionID() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
@@ -7,22 +7,12 @@ import (
 	"github.com/pkg/errors"
 )
 
-const (
-	MAX_DATA_FIELD_LENGTH = 512
-)
-
-// CalculateNumberOfBlocks returns the number of blocks
-// needed to transfer the file having its size
-func CalculateNumberOfBlocks(dataSize int) int {
-	// Get the number of full blocks
-	var numberOfBlocks int = dataSize / MAX_DATA_FIELD_LENGTH
-
-	// Add an additional not full block if needed
-	if dataSize%MAX_DATA_FIELD_LENGTH > 0 {
-		numberOfBlocks++
-	}
-
-	return numberOfBlocks
+// CalculateNumberOfBlocks returns the number of blocks needed to transfer
+// the file having its size. The last block is always shorter than
+// blockSize, and it is empty when the size is a multiple of blockSize,
+// since a short block is what marks the end of a transfer
+func CalculateNumberOfBlocks(dataSize int, blockSize int) int {
+	return dataSize/blockSize + 1
 }
 
 func ReadFileFromFS(filename string) ([]byte, error) {
@@ -35,17 +25,17 @@ func ReadFileFromFS(filename string) ([]byte, error) {
 }
 
 // CreateDataBlocks returns a list of bytes array splitted in blocks
-// of size 512
-func CreateDataBlocks(fileContent []byte) ([][]byte, int) {
-	numberOfBlocks := CalculateNumberOfBlocks(len(fileContent))
+// of size blockSize, followed by a short and possibly empty last block
+func CreateDataBlocks(fileContent []byte, blockSize int) ([][]byte, int) {
+	numberOfBlocks := CalculateNumberOfBlocks(len(fileContent), blockSize)
 
 	var dataBlocks [][]byte
 	for i := 0; i < numberOfBlocks; i++ {
 		if i == numberOfBlocks-1 {
-			dataBlocks = append(dataBlocks, fileContent[512*i:])
+			dataBlocks = append(dataBlocks, fileContent[blockSize*i:])
 			continue
 		}
-		dataBlocks = append(dataBlocks, fileContent[512*i:512*(i+1)])
+		dataBlocks = append(dataBlocks, fileContent[blockSize*i:blockSize*(i+1)])
 	}
 
 	return dataBlocks, numberOfBlocks
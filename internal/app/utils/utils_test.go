@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCreateDataBlocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		blocks  []string
+	}{
+		{"empty", "", []string{""}},
+		{"shorter than a block", "abc", []string{"abc"}},
+		{"multiple of the block size", "abcdefgh", []string{"abcd", "efgh", ""}},
+		{"several blocks", "abcdefghij", []string{"abcd", "efgh", "ij"}},
+		{"NUL bytes", "a\x00\x00bc\x00", []string{"a\x00\x00b", "c\x00"}},
+	}
+
+	for _, test := range tests {
+		blocks, n := CreateDataBlocks([]byte(test.content), 4)
+		var got []string
+		for _, block := range blocks {
+			got = append(got, string(block))
+		}
+		if !reflect.DeepEqual(got, test.blocks) || n != len(test.blocks) {
+			t.Errorf("%s: split into %d blocks %q, expected %q", test.name, n, got, test.blocks)
+		}
+	}
+}